@@ -7,12 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/mostlygeek/llama-swap/proxy"
-	"github.com/synw/goinfer/models"
-	"github.com/synw/goinfer/state"
 
 	"gopkg.in/yaml.v3"
 )
@@ -22,6 +18,26 @@ const DefaultGoInferConf = `# Configuration of https://github.com/LM4eu/goinfer
 # Recursively search *.gguf files (one or multiple directories separated by ':')
 models_dir: ./models
 
+# Scan models_dir every N seconds and update the llama-swap models
+# when model files are added or removed (0 = disabled)
+models_watch: 10
+
+# Settings of the llama-swap entries generated from the model files,
+# keyed by a glob pattern matching the model name (file name without .gguf).
+# The more specific patterns (longer) override the others.
+# models:
+#   "*":
+#     ttl: 600
+#   "Qwen2.5-*":
+#     ctx: 32768
+#     threads: 8
+#     aliases: [qwen]
+#     groups: [small]
+#     args: --flash-attn on
+
+# YAML task files (see /task)
+tasks_dir: ./task_files
+
 server:
   api_key:
     # ⚠️ Set 64-byte secure API keys 🚨
@@ -32,22 +48,54 @@ server:
     ":8080": admin
     ":5143": openai,goinfer,mcp
 
+# inference queue
+queue:
+  # max number of waiting requests (0 = unbounded), then 429 Too Many Requests
+  depth: 32
+  # max number of running inferences per model
+  concurrency: 1
+  # Retry-After header (seconds) when the queue is full
+  retry_after: 10
+  # per-model concurrency (overrides the above value)
+  # models:
+  #   "Qwen2.5-1.5B-Instruct-Q4_K_M": 4
+
 llama:
   exe: ./llama-server
+  # URL of a running llama-server, used when the llama-swap proxy is disabled
+  # url: http://localhost:8080
+  # else goinfer starts llama-server with this model file (and restarts it on crashes)
+  # model: ./models/Qwen2.5-1.5B-Instruct-Q4_K_M.gguf
   args:
     # --props: enable changing global properties via POST /props
     # --no-webui: no Web UI server
     "common": --props --no-webui --no-warmup
     "goinfer": --jinja --chat-template-file template.jinja
+
+# whisper.cpp server of the /v1/audio endpoints: llama-swap starts it on demand
+# (one generated entry per model), else the server running at url is used
+whisper:
+  exe: ./whisper-server
+  # --convert: convert the audio files with ffmpeg (else only WAV)
+  # args: --convert
+  # ttl: 300
+  # models:
+  #   "whisper-1": ./models/ggml-base.bin
+  # url: http://localhost:8090
 `
 
 // GoInferConf holds the configuration for GoInfer.
 type GoInferConf struct {
-	Verbose   bool         `json:"verbose,omitempty"    yaml:"verbose,omitempty"`
-	ModelsDir string       `json:"models_dir,omitempty" yaml:"models_dir,omitempty"` // one or multiple directories separated by ':'
-	Server    ServerConf   `json:"server,omitempty"     yaml:"server,omitempty"`     // HTTP server
-	Llama     LlamaConf    `json:"llama,omitempty"      yaml:"llama,omitempty"`      // llama.cpp
-	Proxy     proxy.Config `json:"proxy,omitempty"      yaml:"proxy,omitempty"`      // llama-swap proxy
+	Verbose     bool         `json:"verbose,omitempty"      yaml:"verbose,omitempty"`
+	ModelsDir   string       `json:"models_dir,omitempty"   yaml:"models_dir,omitempty"`   // one or multiple directories separated by ':'
+	ModelsWatch int          `json:"models_watch,omitempty" yaml:"models_watch,omitempty"` // seconds between two scans of models_dir, 0 = disabled
+	Models      ModelsConf   `json:"models,omitempty"       yaml:"models,omitempty"`       // settings of the generated llama-swap entries
+	TasksDir    string       `json:"tasks_dir,omitempty"    yaml:"tasks_dir,omitempty"`    // YAML task files
+	Server      ServerConf   `json:"server,omitempty"       yaml:"server,omitempty"`       // HTTP server
+	Queue       QueueConf    `json:"queue,omitempty"        yaml:"queue,omitempty"`        // inference queue
+	Llama       LlamaConf    `json:"llama,omitempty"        yaml:"llama,omitempty"`        // llama.cpp
+	Whisper     WhisperConf  `json:"whisper,omitempty"      yaml:"whisper,omitempty"`      // whisper.cpp
+	Proxy       proxy.Config `json:"proxy,omitempty"        yaml:"proxy,omitempty"`        // llama-swap proxy
 }
 
 // ServerConf = config for the GoInfer http server.
@@ -57,10 +105,42 @@ type ServerConf struct {
 	Origins string            `json:"origins,omitempty" yaml:"origins,omitempty"`
 }
 
+// QueueConf - configuration of the inference queue.
+type QueueConf struct {
+	Depth       int            `json:"depth,omitempty"       yaml:"depth,omitempty"`       // max waiting requests (0 = unbounded)
+	Concurrency int            `json:"concurrency,omitempty" yaml:"concurrency,omitempty"` // max running inferences per model
+	RetryAfter  int            `json:"retry_after,omitempty" yaml:"retry_after,omitempty"` // seconds, when the queue is full
+	Models      map[string]int `json:"models,omitempty"      yaml:"models,omitempty"`      // per-model concurrency
+}
+
+// ModelsConf - settings of the generated llama-swap entries, keyed by a glob pattern on the model name.
+type ModelsConf map[string]ModelConf
+
+// ModelConf - settings of a generated llama-swap entry.
+type ModelConf struct {
+	Ctx     int      `json:"ctx,omitempty"     yaml:"ctx,omitempty"`     // --ctx-size
+	Threads int      `json:"threads,omitempty" yaml:"threads,omitempty"` // --threads
+	TTL     int      `json:"ttl,omitempty"     yaml:"ttl,omitempty"`     // seconds of inactivity before unloading
+	Aliases []string `json:"aliases,omitempty" yaml:"aliases,omitempty"` // OpenAI model names
+	Groups  []string `json:"groups,omitempty"  yaml:"groups,omitempty"`  // llama-swap groups
+	Args    string   `json:"args,omitempty"    yaml:"args,omitempty"`    // extra llama-server arguments
+}
+
 // LlamaConf - configuration for llama-server proxy.
 type LlamaConf struct {
-	Exe  string            `json:"exe,omitempty"  yaml:"exe,omitempty"`  // Path to llama-server binary
-	Args map[string]string `json:"args,omitempty" yaml:"args,omitempty"` // llama-server arguments
+	Exe   string            `json:"exe,omitempty"   yaml:"exe,omitempty"`   // Path to llama-server binary
+	URL   string            `json:"url,omitempty"   yaml:"url,omitempty"`   // Running llama-server (when llama-swap is disabled)
+	Model string            `json:"model,omitempty" yaml:"model,omitempty"` // Model file started by goinfer (when llama-swap is disabled)
+	Args  map[string]string `json:"args,omitempty"  yaml:"args,omitempty"`  // llama-server arguments
+}
+
+// WhisperConf - configuration of the whisper.cpp server of the audio endpoints.
+type WhisperConf struct {
+	Exe    string            `json:"exe,omitempty"    yaml:"exe,omitempty"`    // Path to whisper-server binary
+	URL    string            `json:"url,omitempty"    yaml:"url,omitempty"`    // Running whisper-server (when llama-swap is disabled)
+	Args   string            `json:"args,omitempty"   yaml:"args,omitempty"`   // whisper-server arguments
+	TTL    int               `json:"ttl,omitempty"    yaml:"ttl,omitempty"`    // seconds of inactivity before unloading
+	Models map[string]string `json:"models,omitempty" yaml:"models,omitempty"` // model name => ggml model file
 }
 
 // Load the goinfer config file
@@ -189,76 +269,3 @@ func ApiKey(keys map[string]string, favorite string) string {
 	}
 	return keys["admin"]
 }
-
-// Generate llama-swap config
-func GenProxyConfFromModelFiles(cfg *GoInferConf, proxyCfgFile string) {
-	//	bytes, err := os.ReadFile(proxyCfgFile)
-	//	if err != nil {
-	//		fmt.Printf("WARNING os.ReadFile(%s) %v => Ignore config file\n", proxyCfgFile, err)
-	//	} else {
-	//		err := yaml.Unmarshal(bytes, &cfg.Proxy)
-	//		if err != nil {
-	//			fmt.Printf("WARNING yaml.Unmarshal(%s) %v => Ignore config file\n", proxyCfgFile, err)
-	//		}
-	//	}
-
-	modelFiles, err := models.Dir(cfg.ModelsDir).Search()
-	if err != nil {
-		fmt.Println("ERROR while searching model files:", err)
-		return
-	}
-
-	if len(modelFiles) == 0 {
-		fmt.Println("WARNING Found zero model file => Do not generate", proxyCfgFile)
-		return
-	}
-
-	for _, m := range modelFiles {
-		base := filepath.Base(m)  // Keep the filename without the directory
-		ext := filepath.Ext(base) // Get the extension
-		stem := strings.TrimSuffix(base, ext)
-
-		// for OpenAI API: list the models
-		if state.Verbose {
-			_, ok := cfg.Proxy.Models[stem]
-			if ok {
-				fmt.Printf("Overwrite model=%s in %s\n", stem, proxyCfgFile)
-			}
-		}
-		cfg.Proxy.Models[stem] = proxy.ModelConfig{
-			Cmd:          "${llama-server-openai} --model " + m,
-			Unlisted:     false,
-			UseModelName: stem,
-		}
-
-		// for goinfer API: hide an prefix models with GI_
-		stem = "GI_" + stem
-		if state.Verbose {
-			_, ok := cfg.Proxy.Models[stem]
-			if ok {
-				fmt.Printf("Overwrite model=%s in %s\n", stem, proxyCfgFile)
-			}
-		}
-		cfg.Proxy.Models[stem] = proxy.ModelConfig{
-			Cmd:          "${llama-server-goinfer} --model " + m,
-			Unlisted:     true,
-			UseModelName: stem,
-		}
-	}
-
-	// Marshal the configuration to YAML
-	bytes, err := yaml.Marshal(&cfg.Proxy)
-	if err != nil {
-		fmt.Println("ERROR yaml.Marshal: " + err.Error())
-		return
-	}
-
-	err = os.WriteFile(proxyCfgFile, bytes, 0644)
-	if err != nil {
-		fmt.Println("ERROR os.WriteFile(" + proxyCfgFile + "): " + err.Error())
-		return
-	}
-
-	fmt.Printf("File %s generated from %d model files found in subdirectories: %s",
-		proxyCfgFile, len(modelFiles), cfg.ModelsDir)
-}
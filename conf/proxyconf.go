@@ -0,0 +1,513 @@
+package conf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/synw/goinfer/models"
+
+	"gopkg.in/yaml.v3"
+)
+
+// managedTag is the comment marking the llama-swap model entries generated by goinfer.
+// It ends with the checksum of the generated entry: an entry edited since is kept as is.
+const managedTag = "managed-by: goinfer"
+
+// Command prefixes of the generated model entries.
+const (
+	openaiCmd  = "${llama-server-openai}"
+	goinferCmd = "${llama-server-goinfer}"
+)
+
+// ChangeKind is the kind of change of a model entry in the llama-swap config.
+type ChangeKind string
+
+const (
+	ChangeAdd    ChangeKind = "+"
+	ChangeUpdate ChangeKind = "~"
+	ChangeRemove ChangeKind = "-"
+	ChangeKeep   ChangeKind = "=" // entry not managed by goinfer (hand-written or edited)
+)
+
+// ProxyChange is a change of a model entry in the llama-swap config.
+type ProxyChange struct {
+	Kind  ChangeKind
+	Model string
+	Info  string
+}
+
+func (c ProxyChange) String() string {
+	return fmt.Sprintf("%s %s (%s)", c.Kind, c.Model, c.Info)
+}
+
+// Find returns the settings of a model: the settings of the matching patterns
+// are applied from the least to the most specific (longer) pattern.
+func (mc ModelsConf) Find(name string) (ModelConf, error) {
+	var patterns []string
+	for p := range mc {
+		ok, err := path.Match(p, name)
+		if err != nil {
+			return ModelConf{}, fmt.Errorf("invalid pattern %q in the models settings: %w", p, err)
+		}
+		if ok {
+			patterns = append(patterns, p)
+		}
+	}
+	slices.SortFunc(patterns, func(a, b string) int {
+		if c := len(a) - len(b); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+
+	var c ModelConf
+	for _, p := range patterns {
+		o := mc[p]
+		if o.Ctx > 0 {
+			c.Ctx = o.Ctx
+		}
+		if o.Threads > 0 {
+			c.Threads = o.Threads
+		}
+		if o.TTL > 0 {
+			c.TTL = o.TTL
+		}
+		for _, a := range o.Aliases {
+			if !slices.Contains(c.Aliases, a) {
+				c.Aliases = append(c.Aliases, a)
+			}
+		}
+		for _, g := range o.Groups {
+			if !slices.Contains(c.Groups, g) {
+				c.Groups = append(c.Groups, g)
+			}
+		}
+		c.Args = strings.TrimSpace(c.Args + " " + o.Args)
+	}
+	return c, nil
+}
+
+// genEntry is a generated model entry, the other llama-swap fields keep their default values.
+type genEntry struct {
+	Cmd          string   `yaml:"cmd"`
+	Aliases      []string `yaml:"aliases,omitempty"`
+	TTL          int      `yaml:"ttl,omitempty"`
+	Unlisted     bool     `yaml:"unlisted,omitempty"`
+	UseModelName string   `yaml:"useModelName,omitempty"`
+}
+
+// genEntries returns the llama-swap model entries of a model: <name> for the OpenAI API
+// and, for the chat models, the hidden GI_<name> for the goinfer API.
+func genEntries(m models.ModelFile, settings ModelConf) map[string]genEntry {
+	args := " --model " + m.Path
+	if m.MMProj != "" {
+		args += " --mmproj " + m.MMProj
+	}
+	switch m.Kind {
+	case models.KindEmbedding:
+		args += " --embedding"
+	case models.KindReranker:
+		args += " --reranking"
+	}
+	if settings.Ctx > 0 {
+		args += " --ctx-size " + strconv.Itoa(settings.Ctx)
+	}
+	if settings.Threads > 0 {
+		args += " --threads " + strconv.Itoa(settings.Threads)
+	}
+	if settings.Args != "" {
+		args += " " + settings.Args
+	}
+
+	entries := map[string]genEntry{
+		// for OpenAI API: list the models
+		m.Name: {Cmd: openaiCmd + args, Aliases: settings.Aliases, TTL: settings.TTL, UseModelName: m.Name},
+	}
+	if m.Kind == models.KindChat {
+		// for goinfer API: hide an prefix models with GI_
+		entries["GI_"+m.Name] = genEntry{Cmd: goinferCmd + args, TTL: settings.TTL, Unlisted: true, UseModelName: "GI_" + m.Name}
+	}
+	return entries
+}
+
+// whisperEntry returns the llama-swap entry running whisper-server with the model file.
+func whisperEntry(name, file string, cfg WhisperConf) genEntry {
+	cmd := cfg.Exe + " --port ${PORT} --model " + file
+	if cfg.Args != "" {
+		cmd += " " + cfg.Args
+	}
+	return genEntry{Cmd: cmd, TTL: cfg.TTL, UseModelName: name}
+}
+
+// MergeProxyConf merges the model entries generated from the model files into the
+// llama-swap config: the comments, the macros and the hand-written entries are kept,
+// the generated entries are updated, and removed when their model file is gone.
+// A generated entry edited by the user (checksum mismatch) is no longer updated.
+// The settings add arguments, TTL, aliases and group memberships to the generated entries.
+// The whisper models are generated entries too.
+func MergeProxyConf(data []byte, files []models.ModelFile, settings ModelsConf, whisper WhisperConf) ([]byte, []ProxyChange, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, errors.New("the llama-swap config is not a YAML mapping")
+	}
+
+	modelsNode := mappingValue(root, "models")
+	if modelsNode == nil {
+		modelsNode = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "models"}, modelsNode)
+	} else if modelsNode.Kind == yaml.ScalarNode && modelsNode.Tag == "!!null" {
+		modelsNode.Kind, modelsNode.Tag, modelsNode.Value = yaml.MappingNode, "!!map", ""
+	} else if modelsNode.Kind != yaml.MappingNode {
+		return nil, nil, errors.New("the models of the llama-swap config are not a YAML mapping")
+	}
+
+	wanted := map[string]genEntry{}
+	members := map[string][]string{} // group => generated entries
+	aliases := map[string]string{}   // alias => model
+	for _, m := range files {
+		s, err := settings.Find(m.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, a := range s.Aliases {
+			if other, ok := aliases[a]; ok {
+				return nil, nil, fmt.Errorf("alias %q of both %s and %s: an alias must be unique", a, other, m.Name)
+			}
+			aliases[a] = m.Name
+		}
+
+		entries := genEntries(m, s)
+		maps.Copy(wanted, entries)
+		for _, g := range s.Groups {
+			members[g] = append(members[g], slices.Sorted(maps.Keys(entries))...)
+		}
+	}
+	for name, file := range whisper.Models {
+		if _, ok := wanted[name]; ok {
+			return nil, nil, fmt.Errorf("whisper model %q has the name of a model file", name)
+		}
+		if other, ok := aliases[name]; ok {
+			return nil, nil, fmt.Errorf("whisper model %q is an alias of %s", name, other)
+		}
+		wanted[name] = whisperEntry(name, file, whisper)
+	}
+
+	var changes []ProxyChange
+	var removed []string
+	generated := map[string]bool{} // the generated entries updated by the merge
+	content := make([]*yaml.Node, 0, len(modelsNode.Content))
+
+	for i := 0; i+1 < len(modelsNode.Content); i += 2 {
+		key, val := modelsNode.Content[i], modelsNode.Content[i+1]
+		name := key.Value
+		gen, isWanted := wanted[name]
+		delete(wanted, name)
+
+		sum, managed := managedChecksum(key)
+		if !managed && isLegacyEntry(name, val) {
+			managed = true // generated before the managed-by tag
+		}
+
+		switch {
+		case !managed:
+			if isWanted {
+				changes = append(changes, ProxyChange{ChangeKeep, name, "hand-written entry"})
+			}
+		case sum != "" && sum != checksum(val):
+			info := "edited since generated"
+			if !isWanted {
+				info += ", the model file is gone"
+			}
+			changes = append(changes, ProxyChange{ChangeKeep, name, info})
+		case !isWanted:
+			changes = append(changes, ProxyChange{ChangeRemove, name, "model file gone"})
+			removed = append(removed, name)
+			continue
+		default:
+			node, err := entryNode(gen)
+			if err != nil {
+				return nil, nil, err
+			}
+			newSum := checksum(node)
+			if checksum(val) != newSum {
+				changes = append(changes, ProxyChange{ChangeUpdate, name, gen.Cmd})
+			}
+			setManagedTag(key, newSum)
+			val = node
+			generated[name] = true
+		}
+
+		content = append(content, key, val)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(wanted)) {
+		node, err := entryNode(wanted[name])
+		if err != nil {
+			return nil, nil, err
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: name}
+		setManagedTag(key, checksum(node))
+		content = append(content, key, node)
+		changes = append(changes, ProxyChange{ChangeAdd, name, wanted[name].Cmd})
+		generated[name] = true
+	}
+
+	modelsNode.Content = content
+
+	changes = append(changes, syncGroups(root, members, generated, removed)...)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err = enc.Encode(&doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), changes, nil
+}
+
+// syncGroups adds the members to the llama-swap groups (the missing groups are created)
+// and removes the entries removed from the models. The membership of the generated entries
+// is set by the settings: they are removed from the other groups.
+func syncGroups(root *yaml.Node, members map[string][]string, generated map[string]bool, removed []string) []ProxyChange {
+	var changes []ProxyChange
+
+	groups := mappingValue(root, "groups")
+	if groups == nil || groups.Kind != yaml.MappingNode {
+		if len(members) == 0 {
+			return nil
+		}
+		if groups == nil {
+			groups = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "groups"}, groups)
+		} else {
+			groups.Kind, groups.Tag, groups.Value = yaml.MappingNode, "!!map", "" // empty groups
+		}
+	}
+
+	for i := 0; i+1 < len(groups.Content); i += 2 {
+		name, g := groups.Content[i].Value, groups.Content[i+1]
+		list := mappingValue(g, "members")
+		if g.Kind != yaml.MappingNode || list == nil || list.Kind != yaml.SequenceNode {
+			continue
+		}
+		list.Content = slices.DeleteFunc(list.Content, func(n *yaml.Node) bool {
+			moved := generated[n.Value] && !slices.Contains(members[name], n.Value)
+			if moved || slices.Contains(removed, n.Value) {
+				changes = append(changes, ProxyChange{ChangeUpdate, "groups." + name, "member " + n.Value + " removed"})
+				return true
+			}
+			return false
+		})
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(members)) {
+		g := mappingValue(groups, name)
+		if g == nil {
+			g = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			groups.Content = append(groups.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, g)
+			changes = append(changes, ProxyChange{ChangeAdd, "groups." + name, "new group"})
+		}
+		list := membersNode(g)
+		if list == nil {
+			continue // not a group
+		}
+		for _, m := range members[name] {
+			if !slices.ContainsFunc(list.Content, func(n *yaml.Node) bool { return n.Value == m }) {
+				list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: m})
+				changes = append(changes, ProxyChange{ChangeUpdate, "groups." + name, "member " + m + " added"})
+			}
+		}
+	}
+
+	return changes
+}
+
+// membersNode returns the members sequence of a group, created if absent. Returns nil if g is not a mapping.
+func membersNode(g *yaml.Node) *yaml.Node {
+	if g.Kind == yaml.ScalarNode && g.Tag == "!!null" {
+		g.Kind, g.Tag, g.Value = yaml.MappingNode, "!!map", ""
+	}
+	if g.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	list := mappingValue(g, "members")
+	if list == nil {
+		list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		g.Content = append(g.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "members"}, list)
+	}
+	if list.Kind == yaml.ScalarNode && list.Tag == "!!null" {
+		list.Kind, list.Tag, list.Value = yaml.SequenceNode, "!!seq", "" // only commented members
+	}
+	if list.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return list
+}
+
+// mappingValue returns the value of a key in a YAML mapping, nil if absent.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// entryNode encodes a generated entry.
+func entryNode(e genEntry) (*yaml.Node, error) {
+	var node yaml.Node
+	err := node.Encode(e)
+	return &node, err
+}
+
+// checksum returns a short hash of the entry content, independent of the YAML formatting and comments.
+func checksum(val *yaml.Node) string {
+	var v any
+	_ = val.Decode(&v)
+	b, _ := json.Marshal(v) // sorted keys
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:4])
+}
+
+// managedChecksum returns the checksum of the managed-by tag of an entry.
+func managedChecksum(key *yaml.Node) (string, bool) {
+	for line := range strings.Lines(key.HeadComment) {
+		_, tag, ok := strings.Cut(line, managedTag)
+		if ok {
+			return strings.TrimSpace(tag), true
+		}
+	}
+	return "", false
+}
+
+// setManagedTag adds or replaces the managed-by tag, the other comments are kept.
+func setManagedTag(key *yaml.Node, sum string) {
+	var lines []string
+	for line := range strings.Lines(key.HeadComment) {
+		if !strings.Contains(line, managedTag) {
+			lines = append(lines, strings.TrimRight(line, "\n"))
+		}
+	}
+	lines = append(lines, "# "+managedTag+" "+sum)
+	key.HeadComment = strings.Join(lines, "\n")
+}
+
+// isLegacyEntry reports whether the entry has been generated by a former goinfer
+// version (no managed-by tag) and not edited since.
+func isLegacyEntry(name string, val *yaml.Node) bool {
+	var m map[string]any
+	if val.Decode(&m) != nil {
+		return false
+	}
+
+	cmd, _ := m["cmd"].(string)
+	if !strings.HasPrefix(cmd, openaiCmd+" --model ") && !strings.HasPrefix(cmd, goinferCmd+" --model ") {
+		return false
+	}
+	if m["useModelName"] != name {
+		return false
+	}
+
+	for k, v := range m {
+		switch k {
+		case "cmd", "unlisted", "useModelName":
+			continue
+		}
+		switch v := v.(type) {
+		case nil:
+		case string:
+			if v != "" {
+				return false
+			}
+		case bool:
+			if v {
+				return false
+			}
+		case int:
+			if v != 0 {
+				return false
+			}
+		case []any:
+			if len(v) > 0 {
+				return false
+			}
+		case map[string]any:
+			if len(v) > 0 && k != "filters" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// GenProxyConfFromModelFiles merges the model entries generated from the model files
+// into the llama-swap config file and prints the changes. With dryRun, the file is not written.
+func GenProxyConfFromModelFiles(cfg *GoInferConf, proxyCfgFile string, dryRun bool) {
+	data, err := os.ReadFile(proxyCfgFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("ERROR os.ReadFile(%s) %v\n", proxyCfgFile, err)
+		return
+	}
+
+	modelFiles, err := models.Dir(cfg.ModelsDir).Search()
+	if err != nil {
+		fmt.Println("ERROR while searching model files:", err)
+		return
+	}
+
+	if len(modelFiles) == 0 && len(cfg.Whisper.Models) == 0 {
+		fmt.Println("WARNING Found zero model file => Do not generate", proxyCfgFile)
+		return
+	}
+
+	merged, changes, err := MergeProxyConf(data, models.Classify(modelFiles), cfg.Models, cfg.Whisper)
+	if err != nil {
+		fmt.Printf("ERROR cannot merge the model files into %s: %v\n", proxyCfgFile, err)
+		return
+	}
+
+	modified := false
+	for _, c := range changes {
+		fmt.Println(c)
+		modified = modified || c.Kind != ChangeKeep
+	}
+
+	switch {
+	case !modified:
+		fmt.Println("File", proxyCfgFile, "is up to date")
+	case dryRun:
+		fmt.Println("Dry run => file", proxyCfgFile, "not written")
+	default:
+		err = os.WriteFile(proxyCfgFile, merged, 0o644)
+		if err != nil {
+			fmt.Println("ERROR os.WriteFile(" + proxyCfgFile + "): " + err.Error())
+			return
+		}
+		fmt.Printf("File %s updated from %d model files found in: %s\n",
+			proxyCfgFile, len(modelFiles), cfg.ModelsDir)
+	}
+}
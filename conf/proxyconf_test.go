@@ -0,0 +1,96 @@
+package conf
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/synw/goinfer/models"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMergeProxyConfGroups(t *testing.T) {
+	data := []byte(`
+models:
+  manual:
+    cmd: llama-server --port ${PORT} --model /models/manual.gguf
+groups:
+  small:
+    members: [manual]
+`)
+	files := []models.ModelFile{{Name: "a", Path: "/models/a.gguf"}, {Name: "b", Path: "/models/b.gguf"}}
+
+	out, _, err := MergeProxyConf(data, files, ModelsConf{"*": {Groups: []string{"small"}}}, WhisperConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMembers(t, out, map[string][]string{"small": {"manual", "a", "b"}})
+
+	// a moves to the big group, b is gone
+	out, _, err = MergeProxyConf(out, files[:1], ModelsConf{"a": {Groups: []string{"big"}}}, WhisperConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMembers(t, out, map[string][]string{"small": {"manual"}, "big": {"a"}})
+}
+
+func assertMembers(t *testing.T, data []byte, want map[string][]string) {
+	t.Helper()
+	var px struct {
+		Groups map[string]struct {
+			Members []string `yaml:"members"`
+		} `yaml:"groups"`
+	}
+	if err := yaml.Unmarshal(data, &px); err != nil {
+		t.Fatal(err)
+	}
+	for name, members := range want {
+		if got := px.Groups[name].Members; !slices.Equal(got, members) {
+			t.Errorf("group %s: members %v, want %v", name, got, members)
+		}
+	}
+}
+
+func TestModelsConfFind(t *testing.T) {
+	mc := ModelsConf{
+		"*":          {Ctx: 4096, TTL: 300, Groups: []string{"all"}, Args: "--flash-attn on"},
+		"*-7B":       {TTL: 600},
+		"?wen*":      {Groups: []string{"small"}},
+		"Qwen*":      {Ctx: 8192, Aliases: []string{"qwen"}},
+		"Qwen2.5-*":  {Ctx: 32768, Threads: 8},
+		"Qwen2.5-7B": {Threads: 4, Aliases: []string{"qwen", "q7"}, Args: "--jinja"},
+	}
+
+	tests := []struct {
+		name string
+		want ModelConf
+	}{
+		// only the default pattern
+		{"Llama-3", ModelConf{Ctx: 4096, TTL: 300, Groups: []string{"all"}, Args: "--flash-attn on"}},
+		// same length: "?wen*" then "Qwen*"
+		{"Qwen3-8B", ModelConf{Ctx: 8192, TTL: 300, Aliases: []string{"qwen"}, Groups: []string{"all", "small"}, Args: "--flash-attn on"}},
+		// the exact name overrides the globs, the args and lists are accumulated
+		{"Qwen2.5-7B", ModelConf{
+			Ctx: 32768, Threads: 4, TTL: 600, Aliases: []string{"qwen", "q7"},
+			Groups: []string{"all", "small"}, Args: "--flash-attn on --jinja",
+		}},
+		{"Qwen2.5-14B", ModelConf{Ctx: 32768, Threads: 8, TTL: 300, Aliases: []string{"qwen"}, Groups: []string{"all", "small"}, Args: "--flash-attn on"}},
+		{"Mistral-7B", ModelConf{Ctx: 4096, TTL: 600, Groups: []string{"all"}, Args: "--flash-attn on"}},
+	}
+	for _, tt := range tests {
+		got, err := mc.Find(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if got, err := (ModelsConf{}).Find("Llama-3"); err != nil || !reflect.DeepEqual(got, ModelConf{}) {
+		t.Errorf("no settings: %+v, %v", got, err)
+	}
+	if _, err := (ModelsConf{"[": {}}).Find("Llama-3"); err == nil {
+		t.Error("invalid pattern: no error")
+	}
+}
@@ -16,7 +16,7 @@ function onParse(event) {
   switch (msg.msg_type) {
     case "system":
       if (msg.content == "start_emitting") {
-        console.log("Thinking time:", msg.data.thinking_time_format)
+        console.log("Prefill time:", msg.data.prefill_time_format)
       } else if (msg.content == "result") {
         console.log(msg.data)
       }
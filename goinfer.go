@@ -15,6 +15,7 @@ import (
 	"github.com/teal-finance/garcon"
 
 	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/lm"
 	"github.com/synw/goinfer/server"
 	"github.com/synw/goinfer/state"
 )
@@ -24,6 +25,7 @@ func main() {
 	debug := flag.Bool("debug", false, "debug mode")
 	genGiConf := flag.Bool("gen-gi-conf", false, "generate the goinfer config file (use: MODELS_DIR=/home/me/my/models)")
 	genPxConf := flag.Bool("gen-px-conf", false, "generate the llama-swap proxy config file")
+	dryRun := flag.Bool("dry-run", false, "with -gen-px-conf: print the changes without writing the file")
 	disableApiKeys := flag.Bool("disable-api-key", false, "http server will not check the api key")
 	garcon.SetVersionFlag()
 	flag.Parse()
@@ -51,7 +53,7 @@ func main() {
 	var err error
 	cfg.Proxy, err = proxy.LoadConfig("llama-swap.yml")
 	if *genPxConf {
-		conf.GenProxyConfFromModelFiles(&cfg, "llama-swap.yml")
+		conf.GenProxyConfFromModelFiles(&cfg, "llama-swap.yml", *dryRun)
 		return
 	}
 	if err != nil {
@@ -66,8 +68,31 @@ func main() {
 		cfg.Print()
 	}
 
+	state.InferenceQueue = state.NewQueue(cfg.Queue.Depth, cfg.Queue.Concurrency, cfg.Queue.Models)
+
 	proxyServer, proxyHandler := server.NewProxyServer(cfg)
 
+	// Update the llama-swap config when model files are added or removed
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	if proxyHandler != nil && cfg.ModelsWatch > 0 {
+		go proxyHandler.WatchModelFiles(watchCtx, &cfg, "llama-swap.yml")
+	}
+
+	// Without llama-swap, goinfer supervises its own llama-server
+	var llama *lm.Supervisor
+	if proxyHandler == nil && cfg.Llama.URL == "" {
+		llama = lm.NewSupervisor(cfg.Llama)
+		if cfg.Llama.Model != "" {
+			go func() {
+				err := llama.Start(context.Background(), cfg.Llama.Model)
+				if err != nil {
+					fmt.Printf("ERROR cannot start llama-server with %s: %v\n", cfg.Llama.Model, err)
+				}
+			}()
+		}
+	}
+
 	// Setup channels for server management
 	exitChan := make(chan struct{})
 	sigChan := make(chan os.Signal, 1)
@@ -80,6 +105,12 @@ func main() {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 		defer cancel()
 
+		stopWatch()
+
+		if llama != nil {
+			llama.Stop()
+		}
+
 		if proxyServer != nil {
 			proxyHandler.Shutdown()
 			if err := proxyServer.Shutdown(ctx); err != nil {
@@ -93,7 +124,7 @@ func main() {
 	var g errgroup.Group
 
 	for addr, services := range cfg.Server.Listen {
-		e := server.NewEchoServer(cfg, addr, services)
+		e := server.NewEchoServer(cfg, proxyHandler, llama, addr, services)
 		if e != nil {
 			if cfg.Verbose {
 				fmt.Println("-----------------------------")
@@ -0,0 +1,91 @@
+package lm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+)
+
+// AudioRequest is a /v1/audio/transcriptions or /v1/audio/translations request.
+type AudioRequest struct {
+	Model          string
+	File           io.Reader
+	Filename       string
+	Language       string // ISO-639-1 code, empty: detected
+	Prompt         string // text to guide the style or continue a previous segment
+	ResponseFormat string // json, text, srt or vtt
+	Temperature    float32
+	Translate      bool   // translate to English
+	Priority       string // goinfer queue: interactive (default) or batch
+}
+
+// Transcribe transcribes (or translates) the audio file on a whisper.cpp server,
+// the response is in the requested format.
+// The whisper.cpp server keeps the parameters of the previous request:
+// all of them are sent.
+func (s LlamaServer) Transcribe(ctx context.Context, req AudioRequest) ([]byte, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	part, err := w.CreateFormFile("file", req.Filename)
+	if err == nil {
+		_, err = io.Copy(part, req.File)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot copy the audio file: %w", err)
+	}
+
+	language := req.Language
+	if language == "" {
+		language = "auto"
+	}
+	fields := [][2]string{
+		{"response_format", req.ResponseFormat},
+		{"language", language},
+		{"prompt", req.Prompt},
+		{"temperature", strconv.FormatFloat(float64(req.Temperature), 'f', -1, 32)},
+		{"translate", strconv.FormatBool(req.Translate)},
+	}
+	for _, f := range fields {
+		err = w.WriteField(f[0], f[1])
+		if err != nil {
+			return nil, fmt.Errorf("cannot write the %s field: %w", f[0], err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot write the whisper payload: %w", err)
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/inference", &body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create whisper request: %w", err)
+	}
+	hreq.Header.Set("Content-Type", w.FormDataContentType())
+
+	resp, err := s.do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the whisper response: %w", err)
+	}
+
+	// some errors are replied with a 200 status
+	var res struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(out, &res) == nil && res.Error != "" {
+		return nil, &UpstreamError{StatusCode: http.StatusBadRequest, Body: res.Error}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,282 @@
+package lm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/state"
+	"github.com/synw/goinfer/types"
+)
+
+// OpenAiCompletionRequest is a legacy /v1/completions request.
+// The query holds the sampling parameters, it is run for each prompt.
+type OpenAiCompletionRequest struct {
+	Model    string
+	Prompts  []string
+	Echo     bool // the prompt is prepended to the completion
+	Logprobs *int // nil: no log probabilities, else the number of top tokens
+	BestOf   int  // completions generated per prompt, the N best are returned
+	N        int  // completions returned per prompt
+	Query    types.InferQuery
+}
+
+// OpenAiCompletion is a /v1/completions response, or one of its streamed chunks.
+type OpenAiCompletion struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []OpenAiCompletionChoice `json:"choices"`
+	Usage   *OpenAiUsage             `json:"usage,omitempty"`
+}
+
+type OpenAiCompletionChoice struct {
+	Text         string          `json:"text"`
+	Index        int             `json:"index"`
+	Logprobs     *OpenAiLogprobs `json:"logprobs"`
+	FinishReason string          `json:"finish_reason,omitempty"`
+}
+
+// OpenAiLogprobs holds the log probabilities of the completion tokens.
+type OpenAiLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
+}
+
+// add appends the log probabilities of a token at the offset in the text, with the top tokens.
+func (l *OpenAiLogprobs) add(p TokenProb, offset, top int) {
+	tops := map[string]float64{}
+	for _, t := range p.TopLogprobs[:min(top, len(p.TopLogprobs))] {
+		tops[t.Token] = t.Logprob
+	}
+	l.Tokens = append(l.Tokens, p.Token)
+	l.TokenLogprobs = append(l.TokenLogprobs, p.Logprob)
+	l.TopLogprobs = append(l.TopLogprobs, tops)
+	l.TextOffset = append(l.TextOffset, offset)
+}
+
+// completionCandidate is a completion generated for a prompt.
+type completionCandidate struct {
+	choice OpenAiCompletionChoice
+	score  float64 // mean log probability of the tokens
+	stats  InferenceStats
+}
+
+// Main Inference Functions
+
+// InferOpenAiCompletion performs OpenAI legacy completions on llama-server.
+// The inference stops when the session is aborted.
+// Exactly one message is sent: the result on ch, or an error on errCh.
+func InferOpenAiCompletion(req OpenAiCompletionRequest, srv LlamaServer, sess *state.Session, c echo.Context, ch chan<- OpenAiCompletion, errCh chan<- error) {
+	if state.Debug {
+		fmt.Println("Inference query:")
+		fmt.Printf("%+v\n\n", req)
+	}
+
+	id := newOpenAiID("cmpl")
+	enc := json.NewEncoder(c.Response())
+	stream := req.Query.InferParams.Stream
+
+	result := OpenAiCompletion{
+		ID:      id,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []OpenAiCompletionChoice{},
+		Usage:   &OpenAiUsage{PromptTokensDetails: &OpenAiTokensDetails{}},
+	}
+	usage := result.Usage
+	emitTime := 0.0
+
+	for i, prompt := range req.Prompts {
+		var candidates []completionCandidate
+		for j := range req.BestOf {
+			// streamed only when all the completions are returned
+			cand, err := completeOpenAi(req, prompt, i*req.N+j, srv, sess, c, enc, id)
+			if errors.Is(err, errAborted) || sess.Aborted() {
+				LogInfo("OpenAI", "inference aborted")
+				errCh <- createErrorMessageOpenAi("inference aborted", nil, ErrCodeInferenceAborted)
+				return
+			}
+			if err != nil {
+				LogError("OpenAI", "inference error", err)
+				var inferErr *InferError
+				if !errors.As(err, &inferErr) {
+					inferErr = createErrorMessageOpenAi("inference error", err.Error(), ErrCodeInferenceFailed)
+				}
+				errCh <- inferErr
+				return
+			}
+			if i == 0 && j == 0 {
+				usage.TimeToFirstToken = cand.stats.TimeToFirstToken
+			}
+			if j == 0 { // the same prompt for the other completions
+				usage.PromptTokens += cand.stats.PromptTokens
+				usage.PromptTokensDetails.CachedTokens += cand.stats.CachedTokens
+				usage.PromptTime += cand.stats.PromptTime
+			}
+			usage.CompletionTokens += cand.stats.TotalTokens
+			emitTime += cand.stats.EmitTime
+			candidates = append(candidates, cand)
+		}
+
+		if req.BestOf > req.N {
+			slices.SortStableFunc(candidates, func(a, b completionCandidate) int {
+				switch {
+				case a.score > b.score:
+					return -1
+				case a.score < b.score:
+					return 1
+				}
+				return 0
+			})
+		}
+
+		for j, cand := range candidates[:req.N] {
+			cand.choice.Index = i*req.N + j
+			if req.Logprobs == nil {
+				cand.choice.Logprobs = nil // only computed to rank the completions
+			}
+			result.Choices = append(result.Choices, cand.choice)
+		}
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	if usage.PromptTime > 0 {
+		processed := usage.PromptTokens - usage.PromptTokensDetails.CachedTokens
+		usage.PromptTokensPerSecond = round2(float64(processed) / usage.PromptTime)
+	}
+	if emitTime > 0 {
+		usage.TokensPerSecond = round2(float64(usage.CompletionTokens) / emitTime)
+	}
+
+	if stream {
+		last := result
+		last.Choices = []OpenAiCompletionChoice{}
+		err := writeOpenAiChunk(last, enc, c)
+		if err == nil {
+			err = SendStreamTermination(c)
+		}
+		if err != nil {
+			LogError("OpenAI", "cannot send stream termination", err)
+			errCh <- createErrorMessageOpenAi("cannot send stream termination", err.Error(), ErrCodeStreamFailed)
+			return
+		}
+	}
+
+	ch <- result
+}
+
+// completeOpenAi generates one completion of the prompt, the tokens are streamed
+// in the choice at the index.
+func completeOpenAi(req OpenAiCompletionRequest, prompt string, index int, srv LlamaServer, sess *state.Session, c echo.Context, enc *json.Encoder, id string) (completionCandidate, error) {
+	var cand completionCandidate
+	var text strings.Builder
+
+	stream := req.Query.InferParams.Stream
+	query := req.Query
+	query.Prompt = prompt
+
+	top := 0
+	creq := NewCompletionRequest(query)
+	if req.Logprobs != nil {
+		top = *req.Logprobs
+		creq.NProbs = max(top, 1) // the probability of the token itself
+	} else if req.BestOf > req.N {
+		creq.NProbs = 1
+	}
+	logprobs := &OpenAiLogprobs{}
+	sum := 0.0
+	ntokens := 0
+
+	startPrefill := time.Now()
+	var prefillElapsed time.Duration
+	var startEmitting time.Time
+
+	streamText := func(s string, lp *OpenAiLogprobs, finishReason string) error {
+		if !stream {
+			return nil
+		}
+		chunk := OpenAiCompletion{
+			ID:      id,
+			Object:  "text_completion",
+			Created: time.Now().Unix(),
+			Model:   req.Model,
+			Choices: []OpenAiCompletionChoice{{Text: s, Index: index, Logprobs: lp, FinishReason: finishReason}},
+		}
+		return writeOpenAiChunk(chunk, enc, c)
+	}
+
+	if req.Echo {
+		text.WriteString(prompt)
+		if err := streamText(prompt, nil, ""); err != nil {
+			return cand, err
+		}
+	}
+
+	last, err := srv.Completion(sess.Context(), creq, func(chunk CompletionChunk) error {
+		if sess.Aborted() {
+			return errAborted
+		}
+		if ntokens == 0 {
+			startEmitting = time.Now()
+			prefillElapsed = time.Since(startPrefill)
+		}
+		LogToken(chunk.Content)
+
+		var lp *OpenAiLogprobs
+		if req.Logprobs != nil {
+			lp = &OpenAiLogprobs{}
+		}
+		offset := text.Len()
+		for _, p := range chunk.Probs {
+			logprobs.add(p, offset, top)
+			if lp != nil {
+				lp.add(p, offset, top)
+			}
+			offset += len(p.Token)
+			sum += p.Logprob
+		}
+
+		text.WriteString(chunk.Content)
+		ntokens++
+		return streamText(chunk.Content, lp, "")
+	})
+	if err != nil {
+		return cand, err
+	}
+
+	if last.Timings != nil {
+		cand.stats = StatsFromTimings(*last.Timings, last.TokensEvaluated)
+	} else {
+		cand.stats, _ = CalculateInferenceStats(ntokens, prefillElapsed, startEmitting)
+		cand.stats.PromptTokens = last.TokensEvaluated
+	}
+	cand.stats.SetTimeToFirstToken(prefillElapsed)
+	if n := len(logprobs.Tokens); n > 0 {
+		cand.score = sum / float64(n)
+	}
+
+	cand.choice = OpenAiCompletionChoice{
+		Text:         text.String(),
+		Index:        index,
+		Logprobs:     logprobs,
+		FinishReason: finishReason(last.StopType),
+	}
+
+	return cand, streamText("", nil, cand.choice.FinishReason)
+}
+
+// finishReason converts the llama-server stop type to an OpenAI finish reason.
+func finishReason(stopType string) string {
+	if stopType == "limit" {
+		return "length"
+	}
+	return "stop"
+}
@@ -0,0 +1,97 @@
+package lm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// OpenAiEmbeddingRequest is a /v1/embeddings request.
+type OpenAiEmbeddingRequest struct {
+	Model          string   `json:"model"`
+	Input          []string `json:"input"`
+	EncodingFormat string   `json:"encoding_format"`    // float (default) or base64
+	Priority       string   `json:"priority,omitempty"` // goinfer queue: interactive (default) or batch
+}
+
+// OpenAiEmbedding is the vector of an input.
+// Embedding is a []float32, or a base64 string of the little-endian float32 values.
+type OpenAiEmbedding struct {
+	Object    string `json:"object"`
+	Index     int    `json:"index"`
+	Embedding any    `json:"embedding"`
+}
+
+type OpenAiEmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// OpenAiEmbeddingList is the /v1/embeddings response.
+type OpenAiEmbeddingList struct {
+	Object string               `json:"object"`
+	Data   []OpenAiEmbedding    `json:"data"`
+	Model  string               `json:"model"`
+	Usage  OpenAiEmbeddingUsage `json:"usage"`
+}
+
+// embeddingResponse is the response of the llama-server /v1/embeddings endpoint.
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage OpenAiEmbeddingUsage `json:"usage"`
+}
+
+// Embeddings computes the vectors of the inputs on llama-server,
+// the model must be started with --embedding.
+func (s LlamaServer) Embeddings(ctx context.Context, req OpenAiEmbeddingRequest) (OpenAiEmbeddingList, error) {
+	list := OpenAiEmbeddingList{Object: "list", Data: []OpenAiEmbedding{}, Model: req.Model}
+
+	payload := map[string]any{"input": req.Input, "encoding_format": "float"}
+	if req.Model != "" {
+		payload["model"] = req.Model
+	}
+
+	resp, err := s.Post(ctx, "/v1/embeddings", payload)
+	if err != nil {
+		return list, err
+	}
+	defer resp.Body.Close()
+
+	var res embeddingResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return list, fmt.Errorf("cannot decode llama-server embeddings: %w", err)
+	}
+	if len(res.Data) != len(req.Input) {
+		return list, fmt.Errorf("llama-server returned %d embeddings for %d inputs", len(res.Data), len(req.Input))
+	}
+
+	for _, d := range res.Data {
+		var vec any = d.Embedding
+		if req.EncodingFormat == "base64" {
+			vec = encodeEmbedding(d.Embedding)
+		}
+		list.Data = append(list.Data, OpenAiEmbedding{Object: "embedding", Index: d.Index, Embedding: vec})
+	}
+	list.Usage = res.Usage
+	if list.Usage.TotalTokens == 0 {
+		list.Usage.TotalTokens = list.Usage.PromptTokens
+	}
+
+	return list, nil
+}
+
+// encodeEmbedding returns the base64 encoding of the little-endian float32 values, like OpenAI.
+func encodeEmbedding(vec []float32) string {
+	b := make([]byte, 4*len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(v))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
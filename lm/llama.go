@@ -2,7 +2,9 @@ package lm
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -14,8 +16,9 @@ import (
 
 // InferResult holds the result of inference.
 type InferResult struct {
-	Text  string     `json:"text"`
-	Stats InferStats `json:"stats"`
+	Text      string     `json:"text"`
+	Reasoning string     `json:"reasoning,omitempty"` // the <think> segments
+	Stats     InferStats `json:"stats"`
 }
 
 // InferStats holds statistics about inference (alias for unified InferenceStats)
@@ -42,147 +45,119 @@ const (
 	ErrCodeInferenceFailed  = "INFERENCE_FAILED"
 	ErrCodeStreamFailed     = "STREAM_FAILED"
 	ErrCodeInvalidParams    = "INVALID_PARAMS"
+	ErrCodeMissingField     = "MISSING_FIELD"
+	ErrCodeUnknownField     = "UNKNOWN_FIELD"
+	ErrCodeInvalidType      = "INVALID_TYPE"
+	ErrCodeOutOfRange       = "OUT_OF_RANGE"
+	ErrCodeContextExceeded  = "CONTEXT_EXCEEDED"
+	ErrCodeModelNotFound    = "MODEL_NOT_FOUND"
+	ErrCodeInferenceAborted = "INFERENCE_ABORTED"
+	ErrCodeNotFound         = "NOT_FOUND"
+	ErrCodeQueueFull        = "QUEUE_FULL"
+	ErrCodeBackend          = "BACKEND_UNAVAILABLE"
+	ErrCodeUnauthorized     = "UNAUTHORIZED"
+	ErrCodeForbidden        = "FORBIDDEN"
+	ErrCodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	ErrCodeInternal         = "INTERNAL_ERROR"
 )
 
-// Main Inference Functions
-
-// Infer performs language model inference.
-func Infer(query types.InferQuery, c echo.Context, ch chan<- types.StreamedMessage, errCh chan<- types.StreamedMessage) {
-	// if !state.Llama.IsRunning() {
-	// 	errCh <- createErrorMessage(1, "no model loaded")
-	// 	return
-	// }
+// errAborted stops the token stream when the inference is aborted.
+var errAborted = errors.New("inference aborted")
 
-	// Initialize statistics
-	var stats InferenceStats
-	LogVerboseInfo("Llama", &stats, query.Prompt)
+// Main Inference Functions
 
+// Infer performs language model inference on llama-server.
+// The inference stops when the session is aborted.
+// Exactly one message is sent: the result on ch, or an error on errCh.
+func Infer(query types.InferQuery, srv LlamaServer, sess *state.Session, c echo.Context, ch chan<- types.StreamedMessage, errCh chan<- types.StreamedMessage) {
 	if state.Debug {
 		fmt.Println("Inference params:")
 		fmt.Printf("%+v\n\n", query.InferParams)
 	}
 
 	ntokens := 0
-	// enc := json.NewEncoder(c.Response())
-
-	// startThinking := time.Now()
-	// var thinkingElapsed time.Duration
-	// var startEmitting time.Time
-	//
-	// state.IsInferring = true
-	// state.ContinueInferringController = true
-	//
-	//res, err := state.Llama.Predict(
-	//	query,
-	//	func(token string) bool {
-	//		err := streamDeltaMsg(ntokens, token, enc, c, query.InferParams, startThinking, &thinkingElapsed, &startEmitting)
-	//		if err != nil {
-	//			errCh <- createErrorMessage(ntokens+1, "streamDeltaMsg error")
-	//		}
-	//		return state.ContinueInferringController
-	//	})
-	//
-	// state.IsInferring = false
-	//
-	// if err != nil {
-	// 	state.ContinueInferringController = false
-	// 	errCh <- createErrorMessage(ntokens+1, "inference error")
-	// }
-
-	if !state.ContinueInferringController {
-		return
-	}
-
-	if query.InferParams.Stream {
-		err := SendStreamTermination(c)
-		if err != nil {
-			state.ContinueInferringController = false
-			errCh <- createErrorMessage(ntokens+1, "cannot send stream termination")
-			LogError("Llama", "cannot send stream termination", err)
+	enc := json.NewEncoder(c.Response())
+
+	startPrefill := time.Now()
+	var prefillElapsed time.Duration
+	var startEmitting time.Time
+	var text, reasoning strings.Builder
+	nreasoning := 0
+
+	parser := newReasoningParser(query.Prompt)
+	if query.Infill != nil {
+		parser = &reasoningParser{started: true} // no reasoning in the middle of a code
+	}
+
+	last, err := srv.Completion(sess.Context(), NewCompletionRequest(query),
+		func(chunk CompletionChunk) error {
+			if sess.Aborted() {
+				return errAborted
+			}
+			wasThinking := parser.thinking
+			r, content := parser.push(chunk.Content)
+			err := StreamDeltaMessage(ntokens, r, content, enc, c, query.InferParams, sess.ID, startPrefill, &prefillElapsed, &startEmitting)
+			if err != nil {
+				return err
+			}
+			LogToken(chunk.Content)
+			if content == "" && (wasThinking || parser.thinking) {
+				nreasoning++
+			}
+			reasoning.WriteString(r)
+			text.WriteString(content)
+			ntokens++
+			return nil
+		})
+
+	if err == nil {
+		r, content := parser.flush()
+		if r != "" || content != "" {
+			err = StreamDeltaMessage(ntokens, r, content, enc, c, query.InferParams, sess.ID, startPrefill, &prefillElapsed, &startEmitting)
 		}
+		reasoning.WriteString(r)
+		text.WriteString(content)
 	}
 
-	// stats := statsCollector.GetStats()
-	// endmsg, err := createResult(res, stats, enc, c, query.InferParams)
-	// if err != nil {
-	// 	state.ContinueInferringController = false
-	// 	errCh <- createErrorMessage(ntokens+1, "cannot create result msg")
-	// }
-
-	// if state.ContinueInferringController {
-	// 	ch <- endmsg
-	// }
-}
-
-// Streaming Functions
-
-
-// streamDeltaMsg handles token processing during prediction.
-func streamDeltaMsg(ntokens int, token string, enc *json.Encoder, c echo.Context, params types.InferParams, startThinking time.Time, startEmitting *time.Time, thinkingElapsed *time.Duration) error {
-	if ntokens == 0 {
-		*startEmitting = time.Now()
-		*thinkingElapsed = time.Since(startThinking)
-
-		err := sendStartEmittingMessage(enc, c, params, ntokens, *thinkingElapsed)
-		if err != nil {
-			LogError("Llama", "cannot emit start message", err)
-			state.ContinueInferringController = false
-			return err
-		}
-	}
-
-	if !state.ContinueInferringController {
-		return nil
-	}
-
-	LogToken(token)
-
-	if !params.Stream {
-		return nil
-	}
-
-	tmsg := types.StreamedMessage{
-		Content: token,
-		Num:     ntokens,
-		MsgType: types.TokenMsgType,
+	if errors.Is(err, errAborted) || sess.Aborted() {
+		LogInfo("Llama", "inference aborted")
+		errCh <- createErrorMessage(ntokens+1, "inference aborted")
+		return
 	}
-
-	_, err := c.Response().Write([]byte("data: "))
 	if err != nil {
-		return fmt.Errorf("failed to write stream begin: %w", err)
+		LogError("Llama", "inference error", err)
+		errCh <- createErrorMessage(ntokens+1, "inference error: "+err.Error())
+		return
 	}
 
-	err = enc.Encode(tmsg)
-	if err != nil {
-		return fmt.Errorf("failed to encode stream message: %w", err)
-	}
+	var stats InferenceStats
+	if last.Timings != nil {
+		stats = StatsFromTimings(*last.Timings, last.TokensEvaluated)
+	} else {
+		stats, _ = CalculateInferenceStats(ntokens, prefillElapsed, startEmitting)
+		stats.PromptTokens = last.TokensEvaluated
+	}
+	stats.SetTimeToFirstToken(prefillElapsed)
+	stats.ReasoningTokens = nreasoning
+	LogVerboseInfo("Llama", &stats, query.Prompt)
 
-	_, err = c.Response().Write([]byte("\n"))
+	endmsg, err := CreateResultMessage(text.String(), reasoning.String(), stats, enc, c, query.InferParams)
 	if err != nil {
-		return fmt.Errorf("failed to write stream message: %w", err)
+		LogError("Llama", "cannot create result msg", err)
+		errCh <- createErrorMessage(ntokens+1, "cannot create result msg")
+		return
 	}
 
-	c.Response().Flush()
-	return nil
-}
-
-// sendStartEmittingMessage sends the start_emitting message to the client.
-func sendStartEmittingMessage(enc *json.Encoder, c echo.Context, params types.InferParams, ntokens int, thinkingElapsed time.Duration) error {
-	if !params.Stream || !state.ContinueInferringController {
-		return nil
+	if query.InferParams.Stream {
+		err := SendStreamTermination(c)
+		if err != nil {
+			LogError("Llama", "cannot send stream termination", err)
+			errCh <- createErrorMessage(ntokens+1, "cannot send stream termination")
+			return
+		}
 	}
 
-	smsg := StreamSystemMessage("start_emitting", ntokens, map[string]any{
-		"thinking_time":        thinkingElapsed,
-		"thinking_time_format": thinkingElapsed.String(),
-	})
-
-	err := StreamMsg(smsg, c, enc)
-	if err != nil {
-		LogError("Llama", "cannot stream start_emitting message", err)
-	}
-	time.Sleep(2 * time.Millisecond) // Give some time to stream this message
-	return err
+	ch <- endmsg
 }
 
 // Utility Functions
@@ -195,51 +170,3 @@ func createErrorMessage(ntokens int, content string) types.StreamedMessage {
 		MsgType: types.ErrorMsgType,
 	}
 }
-
-
-// Statistics Functions
-
-// calculateStats calculates inference statistics (now uses the unified function).
-func calculateStats(ntokens int, thinkingElapsed time.Duration, startEmitting time.Time) (InferStats, float64) {
-	stats, tps := CalculateInferenceStats(ntokens, thinkingElapsed, startEmitting)
-	return stats, tps
-}
-
-// Result Creation Functions
-
-// createResult creates the final result message to the client.
-func createResult(res string, stats InferStats, enc *json.Encoder, c echo.Context, params types.InferParams) (types.StreamedMessage, error) {
-	result := InferResult{
-		Text:  res,
-		Stats: stats,
-	}
-
-	endmsg := types.StreamedMessage{}
-
-	b, err := json.Marshal(&result)
-	if err != nil {
-		return endmsg, fmt.Errorf("error marshalling result: %w", err)
-	}
-
-	var _res map[string]any
-	err = json.Unmarshal(b, &_res)
-	if err != nil {
-		return endmsg, fmt.Errorf("error unmarshalling result: %w", err)
-	}
-
-	endmsg = types.StreamedMessage{
-		Num:     stats.TotalTokens + 1,
-		Content: "result",
-		MsgType: types.SystemMsgType,
-		Data:    _res,
-	}
-
-	if params.Stream {
-		err := StreamMsg(&endmsg, c, enc)
-		if err != nil {
-			return endmsg, fmt.Errorf("error streaming result message: %w", err)
-		}
-	}
-
-	return endmsg, nil
-}
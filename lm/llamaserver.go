@@ -0,0 +1,425 @@
+package lm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/synw/goinfer/types"
+)
+
+// LlamaServer sends requests to a llama-server, either directly (URL of the
+// running server) or through the in-process llama-swap proxy.
+type LlamaServer struct {
+	URL    string       // base URL, e.g. http://localhost:8080
+	Client *http.Client // nil => http.DefaultClient
+}
+
+// proxyHost is a fake host name: requests never leave the process.
+const proxyHost = "http://llama-swap"
+
+// ProxyLlamaServer reaches the llama-server of a model through the llama-swap
+// handler (the proxy.ProxyManager), which loads the model on demand.
+func ProxyLlamaServer(h http.Handler, model string) LlamaServer {
+	return LlamaServer{
+		URL:    proxyHost + "/upstream/" + url.PathEscape(model),
+		Client: &http.Client{Transport: HandlerTransport{Handler: h}},
+	}
+}
+
+// UpstreamError is returned when llama-server replies with a non-2xx status.
+type UpstreamError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("llama-server replied %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// CompletionRequest is the payload of the llama-server /completion endpoint,
+// or of the /infill endpoint for a fill-in-the-middle query.
+type CompletionRequest struct {
+	Prompt           any                `json:"prompt"` // a string, or a multimodalPrompt
+	InputPrefix      string             `json:"input_prefix,omitempty"`
+	InputSuffix      string             `json:"input_suffix,omitempty"`
+	InputExtra       []types.InfillFile `json:"input_extra,omitempty"`
+	Stream           bool               `json:"stream"`
+	NPredict         int                `json:"n_predict,omitempty"`
+	TopK             int                `json:"top_k"`
+	TopP             float32            `json:"top_p"`
+	MinP             float32            `json:"min_p"`
+	Temperature      float32            `json:"temperature"`
+	FrequencyPenalty float32            `json:"frequency_penalty"`
+	PresencePenalty  float32            `json:"presence_penalty"`
+	RepeatPenalty    float32            `json:"repeat_penalty"`
+	TfsZ             float32            `json:"tfs_z"`
+	Stop             []string           `json:"stop,omitempty"`
+	NProbs           int                `json:"n_probs,omitempty"` // top tokens returned with their log probability
+	CachePrompt      bool               `json:"cache_prompt"`
+	infill           bool               // sent to /infill, even with an empty prefix and suffix
+}
+
+// endpoint returns the llama-server endpoint of the request.
+func (r CompletionRequest) endpoint() string {
+	if r.infill {
+		return "/infill"
+	}
+	return "/completion"
+}
+
+// NewCompletionRequest converts a goinfer query to a llama-server payload.
+// The prompt of a fill-in-the-middle query is the input prefix.
+func NewCompletionRequest(query types.InferQuery) CompletionRequest {
+	p := query.InferParams
+	req := CompletionRequest{
+		Prompt:           query.Prompt,
+		Stream:           true,
+		NPredict:         p.MaxTokens,
+		TopK:             p.TopK,
+		TopP:             p.TopP,
+		MinP:             p.MinP,
+		Temperature:      p.Temperature,
+		FrequencyPenalty: p.FrequencyPenalty,
+		PresencePenalty:  p.PresencePenalty,
+		RepeatPenalty:    p.RepeatPenalty,
+		TfsZ:             p.TailFreeSamplingZ,
+		Stop:             p.StopPrompts,
+		CachePrompt:      true,
+	}
+	if len(p.Images) > 0 {
+		req.Prompt = newMultimodalPrompt(query.Prompt, p.Images)
+	}
+	if query.Infill != nil {
+		req.Prompt = ""
+		req.InputPrefix = query.Prompt
+		req.InputSuffix = query.Infill.Suffix
+		req.InputExtra = query.Infill.Extra
+		req.infill = true
+	}
+	return req
+}
+
+// mediaMarker is the placeholder of a media in a llama-server multimodal prompt.
+const mediaMarker = "<__media__>"
+
+// multimodalPrompt is a llama-server prompt with media, the model must be started with --mmproj.
+type multimodalPrompt struct {
+	PromptString   string   `json:"prompt_string"`
+	MultimodalData []string `json:"multimodal_data"` // base64 encoded
+}
+
+// newMultimodalPrompt returns the prompt with the images. The images without a
+// media marker in the prompt are placed at its beginning.
+func newMultimodalPrompt(prompt string, images []types.Image) multimodalPrompt {
+	mp := multimodalPrompt{PromptString: prompt}
+	for _, img := range images {
+		mp.MultimodalData = append(mp.MultimodalData, base64.StdEncoding.EncodeToString(img.Data))
+	}
+	if missing := len(images) - strings.Count(prompt, mediaMarker); missing > 0 {
+		mp.PromptString = strings.Repeat(mediaMarker, missing) + prompt
+	}
+	return mp
+}
+
+// CompletionChunk is one streamed response of the llama-server /completion endpoint.
+// The last chunk has Stop=true and carries the timings.
+type CompletionChunk struct {
+	Content         string      `json:"content"`
+	Stop            bool        `json:"stop"`
+	StopType        string      `json:"stop_type,omitempty"`
+	TokensPredicted int         `json:"tokens_predicted,omitempty"`
+	TokensEvaluated int         `json:"tokens_evaluated,omitempty"`
+	TokensCached    int         `json:"tokens_cached,omitempty"`
+	Probs           []TokenProb `json:"completion_probabilities,omitempty"` // when n_probs is set
+	Timings         *Timings    `json:"timings,omitempty"`
+}
+
+// TokenProb is the log probability of a generated token, with the most likely tokens.
+type TokenProb struct {
+	ID          int         `json:"id"`
+	Token       string      `json:"token"`
+	Logprob     float64     `json:"logprob"`
+	TopLogprobs []TokenProb `json:"top_logprobs,omitempty"`
+}
+
+// Timings reported by llama-server at the end of a generation.
+type Timings struct {
+	CacheN             int     `json:"cache_n"` // prompt tokens reused from the cache
+	PromptN            int     `json:"prompt_n"`
+	PromptMs           float64 `json:"prompt_ms"`
+	PromptPerSecond    float64 `json:"prompt_per_second"`
+	PredictedN         int     `json:"predicted_n"`
+	PredictedMs        float64 `json:"predicted_ms"`
+	PredictedPerSecond float64 `json:"predicted_per_second"`
+}
+
+// Completion streams the generation of llama-server: onToken is called for each token.
+// Returning an error from onToken stops the generation (the upstream connection is closed).
+// Completion returns the last chunk (with the timings).
+func (s LlamaServer) Completion(ctx context.Context, req CompletionRequest, onToken func(chunk CompletionChunk) error) (CompletionChunk, error) {
+	req.Stream = true
+
+	var last CompletionChunk
+
+	resp, err := s.Post(ctx, req.endpoint(), req)
+	if err != nil {
+		return last, err
+	}
+	defer resp.Body.Close()
+
+	err = ReadSSE(resp.Body, func(data []byte) error {
+		var chunk CompletionChunk
+		err := json.Unmarshal(data, &chunk)
+		if err != nil {
+			return fmt.Errorf("cannot decode llama-server chunk %q: %w", data, err)
+		}
+		if chunk.Stop {
+			last = chunk
+			return errStopSSE
+		}
+		if chunk.Content == "" {
+			return nil
+		}
+		return onToken(chunk)
+	})
+
+	return last, err
+}
+
+// ChatCompletionEnd is the end of a streamed chat completion.
+type ChatCompletionEnd struct {
+	FinishReason string
+	Usage        *OpenAiUsage
+	Timings      *Timings
+}
+
+// chatChunk is one streamed response of the llama-server /v1/chat/completions endpoint.
+type chatChunk struct {
+	Choices []struct {
+		Delta        OpenAiDelta `json:"delta"`
+		FinishReason *string     `json:"finish_reason"`
+	} `json:"choices"`
+	Usage   *OpenAiUsage `json:"usage,omitempty"`
+	Timings *Timings     `json:"timings,omitempty"`
+}
+
+// ChatCompletion streams the chat completion of llama-server: onDelta is called for each token,
+// the delta has the content or the reasoning content (when llama-server extracts it).
+// Returning an error from onDelta stops the generation (the upstream connection is closed).
+func (s LlamaServer) ChatCompletion(ctx context.Context, payload any, onDelta func(delta OpenAiDelta) error) (ChatCompletionEnd, error) {
+	var end ChatCompletionEnd
+
+	resp, err := s.Post(ctx, "/v1/chat/completions", payload)
+	if err != nil {
+		return end, err
+	}
+	defer resp.Body.Close()
+
+	err = ReadSSE(resp.Body, func(data []byte) error {
+		var chunk chatChunk
+		err := json.Unmarshal(data, &chunk)
+		if err != nil {
+			return fmt.Errorf("cannot decode llama-server chunk %q: %w", data, err)
+		}
+		if chunk.Usage != nil {
+			end.Usage = chunk.Usage
+		}
+		if chunk.Timings != nil {
+			end.Timings = chunk.Timings
+		}
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil {
+				end.FinishReason = *choice.FinishReason
+			}
+			if choice.Delta.Content != "" || choice.Delta.ReasoningContent != "" {
+				err := onDelta(choice.Delta)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	return end, err
+}
+
+// Post sends a JSON payload to llama-server and checks the response status.
+// The caller must close the response body.
+func (s LlamaServer) Post(ctx context.Context, path string, payload any) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode llama-server payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create llama-server request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return s.do(req)
+}
+
+// Get sends a GET request to llama-server and checks the response status.
+// The caller must close the response body.
+func (s LlamaServer) Get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+path, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create llama-server request: %w", err)
+	}
+	return s.do(req)
+}
+
+func (s LlamaServer) do(req *http.Request) (*http.Response, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach llama-server %s: %w", req.URL, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, &UpstreamError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+	}
+
+	return resp, nil
+}
+
+// errStopSSE stops ReadSSE without error.
+var errStopSSE = errors.New("stop reading SSE")
+
+// ReadSSE calls onData for each "data:" line of a Server-Sent Events stream
+// until the end of the stream or the "[DONE]" terminator.
+func ReadSSE(r io.Reader, onData func(data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		data, ok := bytes.CutPrefix(line, []byte("data:"))
+		if !ok {
+			continue // empty line, comment, event name...
+		}
+		data = bytes.TrimSpace(data)
+		if bytes.Equal(data, []byte("[DONE]")) {
+			return nil
+		}
+		err := onData(data)
+		if errors.Is(err, errStopSSE) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// HandlerTransport is a http.RoundTripper serving the requests with an
+// in-process http.Handler. The response body is streamed through a pipe.
+type HandlerTransport struct {
+	Handler http.Handler
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t HandlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+
+	pr, pw := io.Pipe()
+	w := &pipeResponseWriter{
+		header: http.Header{},
+		pw:     pw,
+		ready:  make(chan struct{}),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				pw.CloseWithError(fmt.Errorf("panic in proxy handler: %v", r))
+				return
+			}
+			w.WriteHeader(http.StatusOK) // no-op if already written
+			pw.Close()
+		}()
+		t.Handler.ServeHTTP(w, req)
+	}()
+
+	// unblock the reader when the request is canceled (abort)
+	go func() {
+		select {
+		case <-req.Context().Done():
+			pr.CloseWithError(req.Context().Err())
+		case <-done:
+		}
+	}()
+
+	select {
+	case <-w.ready:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.code, http.StatusText(w.code)),
+		StatusCode:    w.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.sent,
+		Body:          pr,
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// pipeResponseWriter is the http.ResponseWriter given to the in-process handler.
+type pipeResponseWriter struct {
+	header http.Header
+	sent   http.Header // copy of the header when WriteHeader is called
+	pw     *io.PipeWriter
+	code   int
+	once   sync.Once
+	ready  chan struct{}
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(code int) {
+	w.once.Do(func() {
+		w.code = code
+		w.sent = w.header.Clone()
+		close(w.ready)
+	})
+}
+
+func (w *pipeResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(b)
+}
+
+// Flush implements http.Flusher: the pipe is not buffered, nothing to do.
+func (w *pipeResponseWriter) Flush() {}
@@ -0,0 +1,26 @@
+package lm
+
+import (
+	"testing"
+
+	"github.com/synw/goinfer/types"
+)
+
+func TestCompletionRequestEndpoint(t *testing.T) {
+	tests := []struct {
+		name  string
+		query types.InferQuery
+		want  string
+	}{
+		{"completion", types.InferQuery{Prompt: "x"}, "/completion"},
+		{"infill", types.InferQuery{Prompt: "x", Infill: &types.Infill{Suffix: "y"}}, "/infill"},
+		{"empty infill", types.InferQuery{Infill: &types.Infill{}}, "/infill"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewCompletionRequest(tt.query).endpoint(); got != tt.want {
+				t.Errorf("endpoint = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
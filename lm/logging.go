@@ -12,13 +12,15 @@ func LogVerboseInfo(prefix string, stats *InferenceStats, finalPrompt string) {
 		fmt.Println("----------", prefix, "prompt ----------")
 		fmt.Println(finalPrompt)
 		fmt.Println("----------------------------")
-		fmt.Println("Thinking ..")
-		fmt.Println("Thinking time:", stats.ThinkingTimeFormat)
+		fmt.Println("Processing the prompt ..")
+		fmt.Println("Prefill time:", stats.PrefillTimeFormat)
 		fmt.Println("Emitting ..")
 		fmt.Println("Emitting time:", stats.EmitTimeFormat)
 		fmt.Println("Total time:", stats.TotalTimeFormat)
 		fmt.Println("Tokens per seconds", stats.TokensPerSecond)
 		fmt.Println("Tokens emitted", stats.TotalTokens)
+		fmt.Println("Prompt tokens", stats.PromptTokens, "cached", stats.CachedTokens)
+		fmt.Println("Time to first token:", stats.TimeToFirstTokenFormat)
 	}
 }
 
@@ -2,15 +2,41 @@ package lm
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/synw/goinfer/state"
-	"github.com/synw/goinfer/types"
 )
 
+// OpenAI request structures
+
+// OpenAiChatRequest is a /v1/chat/completions request.
+// Only the fields used by goinfer are decoded, the payload is forwarded to llama-server.
+type OpenAiChatRequest struct {
+	Model    string                     `json:"model"`
+	Stream   bool                       `json:"stream"`
+	Priority string                     `json:"priority,omitempty"` // goinfer queue: interactive (default) or batch
+	Payload  map[string]json.RawMessage `json:"-"`                  // request without the goinfer fields
+
+	StripReasoning bool `json:"strip_reasoning,omitempty"` // drop the reasoning content
+}
+
+// upstreamPayload returns the payload sent to llama-server:
+// always streamed (to forward tokens and abort), with the usage.
+func (req OpenAiChatRequest) upstreamPayload() map[string]any {
+	payload := make(map[string]any, len(req.Payload)+2)
+	for name, v := range req.Payload {
+		payload[name] = v
+	}
+	payload["stream"] = true
+	payload["stream_options"] = map[string]any{"include_usage": true}
+	return payload
+}
+
 // OpenAI response structures
 type OpenAiChoice struct {
 	Index        int           `json:"index"`
@@ -19,14 +45,31 @@ type OpenAiChoice struct {
 }
 
 type OpenAiMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role             string `json:"role"`
+	Content          string `json:"content"`
+	ReasoningContent string `json:"reasoning_content,omitempty"`
 }
 
 type OpenAiUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens            int                            `json:"prompt_tokens"`
+	CompletionTokens        int                            `json:"completion_tokens"`
+	TotalTokens             int                            `json:"total_tokens"`
+	PromptTokensDetails     *OpenAiTokensDetails           `json:"prompt_tokens_details,omitempty"`
+	CompletionTokensDetails *OpenAiCompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+
+	// goinfer extensions, from the llama-server timings (seconds)
+	PromptTime            float64 `json:"prompt_time,omitempty"`
+	PromptTokensPerSecond float64 `json:"prompt_tokens_per_second,omitempty"`
+	TimeToFirstToken      float64 `json:"time_to_first_token,omitempty"`
+	TokensPerSecond       float64 `json:"tokens_per_second,omitempty"`
+}
+
+type OpenAiTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+type OpenAiCompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
 }
 
 type OpenAiChatCompletion struct {
@@ -39,8 +82,9 @@ type OpenAiChatCompletion struct {
 }
 
 type OpenAiDelta struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role             string `json:"role,omitempty"`
+	Content          string `json:"content"`
+	ReasoningContent string `json:"reasoning_content,omitempty"`
 }
 
 type OpenAiDeltaChoice struct {
@@ -50,112 +94,188 @@ type OpenAiDeltaChoice struct {
 }
 
 type OpenAiChatCompletionDeltaResponse struct {
-	ID      string             `json:"id"`
-	Object  string             `json:"object"`
-	Created int64              `json:"created"`
-	Model   string             `json:"model"`
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
 	Choices []OpenAiDeltaChoice `json:"choices"`
+	Usage   *OpenAiUsage        `json:"usage,omitempty"`
 }
 
-// Main Inference Functions
-
-// InferOpenAi performs OpenAI model inference.
-func InferOpenAi(query types.InferQuery, c echo.Context, ch chan<- OpenAiChatCompletion, errCh chan<- error) {
-
-	/*
-		if !state.Llama.IsRunning() {
-			errCh <- createErrorMessageOpenAi(1, "no model loaded", nil, ErrCodeModelNotLoaded)
-			return
-		}
-
-		// LogVerboseInfo("OpenAI", &stats, query.Prompt)
+// OpenAiModel is an entry of the /v1/models response.
+type OpenAiModel struct {
+	ID          string `json:"id"`
+	Object      string `json:"object"`
+	Created     int64  `json:"created"`
+	OwnedBy     string `json:"owned_by"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
 
-		if state.IsDebug {
-			fmt.Println("Inference query:")
-			fmt.Printf("%+v\n\n", query)
-		}
+// OpenAiModelList is the /v1/models response.
+type OpenAiModelList struct {
+	Object string        `json:"object"`
+	Data   []OpenAiModel `json:"data"`
+}
 
-		ntokens := 0
-		enc := json.NewEncoder(c.Response())
+// Main Inference Functions
 
-		startThinking := time.Now()
-		var thinkingElapsed time.Duration
-		var startEmitting time.Time
+// InferOpenAi performs OpenAI chat completion on llama-server.
+// The inference stops when the session is aborted.
+// Exactly one message is sent: the result on ch, or an error on errCh.
+func InferOpenAi(req OpenAiChatRequest, srv LlamaServer, sess *state.Session, c echo.Context, ch chan<- OpenAiChatCompletion, errCh chan<- error) {
+	if state.Debug {
+		fmt.Println("Inference query:")
+		payload, _ := json.Marshal(req.Payload)
+		fmt.Printf("%s\n\n", payload)
+	}
 
-		state.IsInferring = true
-		state.ContinueInferringController = true
+	id := newOpenAiID("chatcmpl")
+	ntokens := 0
+	enc := json.NewEncoder(c.Response())
 
-		res, err := state.Llama.Predict(
-			query,
-			func(token string) bool {
-				err := streamDeltaMsgOpenAi(ntokens, token, enc, c, query, startThinking, &thinkingElapsed, &startEmitting)
-				if err != nil {
-					errCh <- createErrorMessageOpenAi(ntokens+1, "streamDeltaMsgOpenAi error", err, ErrStreamDeltaMsgOpenAi)
-				}
-				return state.ContinueInferringController
-			})
+	startPrefill := time.Now()
+	var prefillElapsed time.Duration
+	var startEmitting time.Time
+	var text, reasoning strings.Builder
+	nreasoning, nsent := 0, 0
 
-		state.IsInferring = false
+	// the <think> segments left in the content (llama-server started with --reasoning-format none)
+	parser := &reasoningParser{}
 
-		if err != nil {
-			state.ContinueInferringController = false
-			errCh <- createErrorMessageOpenAi(ntokens+1, "inference error", err, ErrCodeInferenceFailed)
+	end, err := srv.ChatCompletion(sess.Context(), req.upstreamPayload(),
+		func(delta OpenAiDelta) error {
+			if sess.Aborted() {
+				return errAborted
+			}
+			wasThinking := parser.thinking
+			r, content := parser.push(delta.Content)
+			r = delta.ReasoningContent + r
+			err := streamDeltaMsgOpenAi(ntokens, &nsent, r, content, enc, c, req, id, startPrefill, &prefillElapsed, &startEmitting)
+			if err != nil {
+				return createErrorMessageOpenAi("streamDeltaMsgOpenAi error", err, ErrStreamDeltaMsgOpenAi)
+			}
+			if content == "" && (r != "" || wasThinking || parser.thinking) {
+				nreasoning++
+			}
+			reasoning.WriteString(r)
+			text.WriteString(content)
+			ntokens++
+			return nil
+		})
+
+	if err == nil {
+		r, content := parser.flush()
+		if r != "" || content != "" {
+			err = streamDeltaMsgOpenAi(ntokens, &nsent, r, content, enc, c, req, id, startPrefill, &prefillElapsed, &startEmitting)
 		}
+		reasoning.WriteString(r)
+		text.WriteString(content)
+	}
 
-		if !state.ContinueInferringController {
-			return
+	if errors.Is(err, errAborted) || sess.Aborted() {
+		LogInfo("OpenAI", "inference aborted")
+		errCh <- createErrorMessageOpenAi("inference aborted", nil, ErrCodeInferenceAborted)
+		return
+	}
+	if err != nil {
+		LogError("OpenAI", "inference error", err)
+		var inferErr *InferError
+		if !errors.As(err, &inferErr) {
+			inferErr = createErrorMessageOpenAi("inference error", err.Error(), ErrCodeInferenceFailed)
 		}
+		errCh <- inferErr
+		return
+	}
 
-		if query.InferParams.Stream {
-			err := sendOpenAiStreamTermination(c)
-			if err != nil {
-				state.ContinueInferringController = false
-				errCh <- createErrorMessageOpenAi(ntokens+1, "cannot send stream termination", err, ErrCodeStreamFailed)
-				LogError("OpenAI", "cannot send stream termination", err)
-			}
+	var stats InferenceStats
+	if end.Timings != nil {
+		promptTokens := 0
+		if end.Usage != nil {
+			promptTokens = end.Usage.PromptTokens
 		}
+		stats = StatsFromTimings(*end.Timings, promptTokens)
+	} else {
+		stats, _ = CalculateInferenceStats(ntokens, prefillElapsed, startEmitting)
+	}
+	stats.SetTimeToFirstToken(prefillElapsed)
+	stats.ReasoningTokens = nreasoning
+
+	usage := stats.OpenAiUsage()
+	if end.Usage != nil {
+		usage.PromptTokens = end.Usage.PromptTokens
+		usage.CompletionTokens = end.Usage.CompletionTokens
+		usage.TotalTokens = end.Usage.TotalTokens
+	}
+
+	result := createOpenAiResult(req, id, text.String(), reasoning.String(), end, usage)
 
-		if state.ContinueInferringController {
-			ch <- createOpenAiResult(query, ntokens, res)
+	if req.Stream {
+		err := sendFinalDeltaMsgOpenAi(enc, c, req, id, result)
+		if err == nil {
+			err = SendStreamTermination(c)
 		}
-	*/
+		if err != nil {
+			LogError("OpenAI", "cannot send stream termination", err)
+			errCh <- createErrorMessageOpenAi("cannot send stream termination", err.Error(), ErrCodeStreamFailed)
+			return
+		}
+	}
+
+	ch <- result
 }
 
 // Streaming Functions
 
-
-// streamDeltaMsgOpenAi streams a delta message to the client.
-func streamDeltaMsgOpenAi(ntokens int, token string, enc *json.Encoder, c echo.Context, query types.InferQuery, startThinking time.Time, thinkingElapsed *time.Duration, startEmitting *time.Time) error {
+// streamDeltaMsgOpenAi streams a delta message to the client, nsent counts the messages sent.
+// The reasoning is not sent when stripped.
+func streamDeltaMsgOpenAi(ntokens int, nsent *int, reasoning, token string, enc *json.Encoder, c echo.Context, req OpenAiChatRequest, id string, startPrefill time.Time, prefillElapsed *time.Duration, startEmitting *time.Time) error {
 	if ntokens == 0 {
 		*startEmitting = time.Now()
-		*thinkingElapsed = time.Since(startThinking)
-
-		err := sendStartEmittingMessageOpenAi(enc, c, query, ntokens, *thinkingElapsed)
-		if err != nil {
-			LogError("OpenAI", "cannot emit start message", err)
-			state.ContinueInferringController = false
-			return err
-		}
+		*prefillElapsed = time.Since(startPrefill)
 	}
 
-	if !state.ContinueInferringController {
+	LogToken(reasoning + token)
+
+	if req.StripReasoning {
+		reasoning = ""
+	}
+	if !req.Stream || (reasoning == "" && token == "") {
 		return nil
 	}
 
-	LogToken(token)
+	tmsg := createOpenAiDeltaMessage(req, id, *nsent, reasoning, token)
+	*nsent++
+	return writeOpenAiChunk(tmsg, enc, c)
+}
 
-	if !query.InferParams.Stream {
-		return nil
+// sendFinalDeltaMsgOpenAi streams the last chunk: the finish reason and the usage.
+func sendFinalDeltaMsgOpenAi(enc *json.Encoder, c echo.Context, req OpenAiChatRequest, id string, result OpenAiChatCompletion) error {
+	msg := OpenAiChatCompletionDeltaResponse{
+		ID:      id,
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []OpenAiDeltaChoice{
+			{
+				Index:        0,
+				FinishReason: result.Choices[0].FinishReason,
+				Delta:        OpenAiDelta{Content: ""},
+			},
+		},
+		Usage: &result.Usage,
 	}
+	return writeOpenAiChunk(msg, enc, c)
+}
 
-	tmsg := createOpenAiDeltaMessage(query, ntokens, token)
-
+// writeOpenAiChunk writes a Server-Sent Event.
+func writeOpenAiChunk(msg any, enc *json.Encoder, c echo.Context) error {
 	_, err := c.Response().Write([]byte("data: "))
 	if err != nil {
 		return fmt.Errorf("failed to write stream begin: %w", err)
 	}
 
-	err = enc.Encode(tmsg)
+	err = enc.Encode(msg)
 	if err != nil {
 		return fmt.Errorf("failed to encode stream message: %w", err)
 	}
@@ -166,78 +286,39 @@ func streamDeltaMsgOpenAi(ntokens int, token string, enc *json.Encoder, c echo.C
 	}
 
 	c.Response().Flush()
-
 	return nil
 }
 
 // createOpenAiDeltaMessage creates a delta message for streaming.
-func createOpenAiDeltaMessage(query types.InferQuery, ntokens int, token string) OpenAiChatCompletionDeltaResponse {
-	return OpenAiChatCompletionDeltaResponse{
-		ID:      strconv.Itoa(ntokens),
-		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		Model:   query.ModelParams.Name,
-		Choices: []OpenAiDeltaChoice{
-			{
-				Index:        ntokens,
-				FinishReason: "",
-				Delta: OpenAiDelta{
-					Role:    "assistant",
-					Content: token,
-				},
-			},
-		},
-	}
-}
-
-// sendStartEmittingMessageOpenAi sends the start_emitting message to the client.
-func sendStartEmittingMessageOpenAi(enc *json.Encoder, c echo.Context, query types.InferQuery, ntokens int, thinkingElapsed time.Duration) error {
-	if !query.InferParams.Stream || !state.ContinueInferringController {
-		return nil
+// The role is only sent in the first chunk.
+func createOpenAiDeltaMessage(req OpenAiChatRequest, id string, nsent int, reasoning, token string) OpenAiChatCompletionDeltaResponse {
+	role := ""
+	if nsent == 0 {
+		role = "assistant"
 	}
-
-	// Create a system message similar to the one in infer.go but adapted for OpenAI format
-	smsg := OpenAiChatCompletionDeltaResponse{
-		ID:      strconv.Itoa(ntokens),
+	return OpenAiChatCompletionDeltaResponse{
+		ID:      id,
 		Object:  "chat.completion.chunk",
 		Created: time.Now().Unix(),
-		Model:   query.ModelParams.Name,
+		Model:   req.Model,
 		Choices: []OpenAiDeltaChoice{
 			{
-				Index:        ntokens,
+				Index:        0,
 				FinishReason: "",
 				Delta: OpenAiDelta{
-					Role:    "system",
-					Content: "start_emitting",
+					Role:             role,
+					Content:          token,
+					ReasoningContent: reasoning,
 				},
 			},
 		},
 	}
-
-	_, err := c.Response().Write([]byte("data: "))
-	if err != nil {
-		return fmt.Errorf("failed to write stream begin: %w", err)
-	}
-
-	err = enc.Encode(smsg)
-	if err != nil {
-		return fmt.Errorf("failed to encode stream message: %w", err)
-	}
-
-	_, err = c.Response().Write([]byte("\n"))
-	if err != nil {
-		return fmt.Errorf("failed to write stream message: %w", err)
-	}
-
-	c.Response().Flush()
-	time.Sleep(2 * time.Millisecond) // Give some time to stream this message
-	return err
 }
 
 // Utility Functions
 
 // createErrorMessageOpenAi creates an InferenceError for OpenAI inference.
-func createErrorMessageOpenAi(ntokens int, content string, context any, errorCode string) *InferError {
+func createErrorMessageOpenAi(content string, context any, errorCode string) *InferError {
 	return &InferError{
 		Code:    errorCode,
 		Message: content,
@@ -245,32 +326,39 @@ func createErrorMessageOpenAi(ntokens int, content string, context any, errorCod
 	}
 }
 
-
+// newOpenAiID returns a unique identifier like "chatcmpl-m3x8k2a1".
+func newOpenAiID(prefix string) string {
+	return prefix + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
 
 // Result Creation Functions
 
 // createOpenAiResult creates the final OpenAI result.
-func createOpenAiResult(query types.InferQuery, ntokens int, res string) OpenAiChatCompletion {
-	id := strconv.Itoa(ntokens)
+func createOpenAiResult(req OpenAiChatRequest, id, res, reasoning string, end ChatCompletionEnd, usage OpenAiUsage) OpenAiChatCompletion {
+	finishReason := end.FinishReason
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	if req.StripReasoning {
+		reasoning = ""
+	}
+
 	return OpenAiChatCompletion{
 		ID:      id,
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
-		Model:   query.ModelParams.Name,
+		Model:   req.Model,
 		Choices: []OpenAiChoice{
 			{
 				Index: 0,
 				Message: OpenAiMessage{
-					Role:    "assistant",
-					Content: res,
+					Role:             "assistant",
+					Content:          res,
+					ReasoningContent: reasoning,
 				},
-				FinishReason: "stop",
+				FinishReason: finishReason,
 			},
 		},
-		Usage: OpenAiUsage{
-			PromptTokens:     0,
-			CompletionTokens: 0,
-			TotalTokens:      ntokens,
-		},
+		Usage: usage,
 	}
 }
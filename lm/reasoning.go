@@ -0,0 +1,100 @@
+package lm
+
+import "strings"
+
+// The tags of the reasoning segments.
+const (
+	thinkOpen  = "<think>"
+	thinkClose = "</think>"
+)
+
+// spaces are the characters trimmed around the tags.
+const spaces = " \t\r\n"
+
+// reasoningParser splits the streamed tokens into the reasoning segment
+// (<think>...</think>) and the content. The segment opens only at the start
+// of the generation: a <think> tag in the content is kept as is.
+// A tag may be split across tokens.
+type reasoningParser struct {
+	thinking bool   // inside the reasoning segment
+	started  bool   // past the start of the generation: no segment can open
+	pending  string // end of the text that may be the beginning of a tag
+	trim     bool   // trim the spaces before the content following the reasoning segment
+}
+
+// newReasoningParser returns a parser of the generation of the prompt:
+// the generation starts inside the reasoning segment when the prompt
+// ends with the <think> tag of the template.
+func newReasoningParser(prompt string) *reasoningParser {
+	thinking := strings.HasSuffix(strings.TrimRight(prompt, spaces), thinkOpen)
+	return &reasoningParser{thinking: thinking, started: thinking}
+}
+
+// push parses a token and returns its reasoning and content parts.
+func (p *reasoningParser) push(token string) (reasoning, content string) {
+	var r, c strings.Builder
+	s := p.pending + token
+	p.pending = ""
+
+	if !p.started {
+		// the generation may begin with spaces then the <think> tag
+		t := strings.TrimLeft(s, spaces)
+		if strings.HasPrefix(thinkOpen, t) && len(t) < len(thinkOpen) {
+			p.pending = s
+			return "", ""
+		}
+		if rest, ok := strings.CutPrefix(t, thinkOpen); ok {
+			s = rest
+			p.thinking = true
+		}
+		p.started = true
+	}
+
+	if p.thinking {
+		i := strings.Index(s, thinkClose)
+		if i < 0 {
+			i = len(s) - partialTagLen(s, thinkClose)
+			p.write(&r, &c, s[:i])
+			p.pending = s[i:]
+			return r.String(), c.String()
+		}
+		p.write(&r, &c, s[:i])
+		s = s[i+len(thinkClose):]
+		p.thinking = false
+		p.trim = true
+	}
+
+	p.write(&r, &c, s)
+	return r.String(), c.String()
+}
+
+// flush returns the remaining text, at the end of the generation.
+func (p *reasoningParser) flush() (reasoning, content string) {
+	var r, c strings.Builder
+	p.write(&r, &c, p.pending)
+	p.pending = ""
+	return r.String(), c.String()
+}
+
+// write appends the text to the reasoning or to the content.
+func (p *reasoningParser) write(r, c *strings.Builder, s string) {
+	if p.thinking {
+		r.WriteString(s)
+		return
+	}
+	if p.trim {
+		s = strings.TrimLeft(s, spaces)
+		p.trim = s == ""
+	}
+	c.WriteString(s)
+}
+
+// partialTagLen returns the length of the longest end of s that begins the tag.
+func partialTagLen(s, tag string) int {
+	for n := min(len(s), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package lm
+
+import "testing"
+
+func TestReasoningParser(t *testing.T) {
+	tests := []struct {
+		name      string
+		prompt    string
+		tokens    []string
+		reasoning string
+		content   string
+	}{
+		{"no reasoning", "", []string{"Hello", " world"}, "", "Hello world"},
+		{"segment", "", []string{"<think>", "hmm", "</think>", "\n\n", "Answer"}, "hmm", "Answer"},
+		{"split tags", "", []string{" <th", "ink>a", "b</", "thi", "nk>  x"}, "ab", "x"},
+		{"tag in the content", "", []string{"Use the <think> tag in HTML. Done"}, "", "Use the <think> tag in HTML. Done"},
+		{"tag after the content", "", []string{"Use the ", "<think>", " tag"}, "", "Use the <think> tag"},
+		{"second segment", "", []string{"<think>a</think>b", "<think>c</think>"}, "a", "b<think>c</think>"},
+		{"partial open tag", "", []string{"<th", "e>"}, "", "<the>"},
+		{"unfinished open tag", "", []string{"<thi"}, "", "<thi"},
+		{"template prefix", "<|im_start|>assistant\n<think>\n", []string{"reason", "</think>", "done"}, "reason", "done"},
+		{"tag in the prompt", "What is <think>?<|im_start|>assistant\n", []string{"A tag"}, "", "A tag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newReasoningParser(tt.prompt)
+			var reasoning, content string
+			for _, tok := range append(tt.tokens, "") {
+				r, c := p.push(tok)
+				reasoning += r
+				content += c
+			}
+			r, c := p.flush()
+			reasoning += r
+			content += c
+			if reasoning != tt.reasoning || content != tt.content {
+				t.Errorf("reasoning %q content %q, want %q %q", reasoning, content, tt.reasoning, tt.content)
+			}
+		})
+	}
+}
@@ -7,57 +7,137 @@ import (
 )
 
 // InferenceStats holds unified statistics about inference.
+// PrefillTime is the time before the first token: the prompt processing.
 type InferenceStats struct {
+	PrefillTime       float64 `json:"prefillTime"`
+	PrefillTimeFormat string  `json:"prefillTimeFormat"`
+	EmitTime          float64 `json:"emitTime"`
+	EmitTimeFormat    string  `json:"emitTimeFormat"`
+	TotalTime         float64 `json:"totalTime"`
+	TotalTimeFormat   string  `json:"totalTimeFormat"`
+	TokensPerSecond   float64 `json:"tokensPerSecond"`
+	TotalTokens       int     `json:"totalTokens"`
+	ReasoningTokens   int     `json:"reasoningTokens"` // tokens of the <think> segments, included in TotalTokens
+
+	// prompt processing, reported by llama-server
+	PromptTokens           int     `json:"promptTokens"`
+	CachedTokens           int     `json:"cachedTokens"` // prompt tokens reused from the cache
+	PromptTime             float64 `json:"promptTime"`
+	PromptTimeFormat       string  `json:"promptTimeFormat"`
+	PromptTokensPerSecond  float64 `json:"promptTokensPerSecond"`
+	TimeToFirstToken       float64 `json:"timeToFirstToken"`
+	TimeToFirstTokenFormat string  `json:"timeToFirstTokenFormat"`
+
+	// Deprecated: the former names of PrefillTime and PrefillTimeFormat,
+	// it is not the time of the reasoning segments.
 	ThinkingTime       float64 `json:"thinkingTime"`
 	ThinkingTimeFormat string  `json:"thinkingTimeFormat"`
-	EmitTime           float64 `json:"emitTime"`
-	EmitTimeFormat     string  `json:"emitTimeFormat"`
-	TotalTime          float64 `json:"totalTime"`
-	TotalTimeFormat    string  `json:"totalTimeFormat"`
-	TokensPerSecond    float64 `json:"tokensPerSecond"`
-	TotalTokens        int     `json:"totalTokens"`
+}
+
+// setPrefillTime sets the time before the first token, and its deprecated alias.
+func (s *InferenceStats) setPrefillTime(d time.Duration) {
+	s.PrefillTime = d.Seconds()
+	s.PrefillTimeFormat = d.String()
+	s.ThinkingTime = s.PrefillTime
+	s.ThinkingTimeFormat = s.PrefillTimeFormat
+}
+
+// SetTimeToFirstToken sets the time measured from the start of the inference to the first token.
+func (s *InferenceStats) SetTimeToFirstToken(d time.Duration) {
+	s.TimeToFirstToken = d.Seconds()
+	s.TimeToFirstTokenFormat = d.String()
+}
+
+// OpenAiUsage returns the usage of an OpenAI response.
+func (s InferenceStats) OpenAiUsage() OpenAiUsage {
+	return OpenAiUsage{
+		PromptTokens:            s.PromptTokens,
+		CompletionTokens:        s.TotalTokens,
+		TotalTokens:             s.PromptTokens + s.TotalTokens,
+		PromptTokensDetails:     &OpenAiTokensDetails{CachedTokens: s.CachedTokens},
+		CompletionTokensDetails: &OpenAiCompletionTokensDetails{ReasoningTokens: s.ReasoningTokens},
+		PromptTime:              s.PromptTime,
+		PromptTokensPerSecond:   s.PromptTokensPerSecond,
+		TimeToFirstToken:        s.TimeToFirstToken,
+		TokensPerSecond:         s.TokensPerSecond,
+	}
 }
 
 // CalculateInferenceStats calculates inference statistics from raw data
-func CalculateInferenceStats(ntokens int, thinkingElapsed time.Duration, startEmitting time.Time) (InferenceStats, float64) {
+func CalculateInferenceStats(ntokens int, prefillElapsed time.Duration, startEmitting time.Time) (InferenceStats, float64) {
 	var errs []error
-	
+
 	if ntokens < 0 {
 		errs = append(errs, errors.New("token count cannot be negative"))
 	}
-	
+
 	if startEmitting.IsZero() && ntokens > 0 {
 		errs = append(errs, errors.New("startEmitting time is required when tokens > 0"))
 	}
-	
+
 	if len(errs) > 0 {
 		return InferenceStats{}, 0.0
 	}
 
 	emittingElapsed := time.Since(startEmitting)
 	var tps float64
-	
+
 	if emittingElapsed.Seconds() > 0 {
-		tpsRaw := float64(ntokens) / emittingElapsed.Seconds()
-		var err error
-		tps, err = strconv.ParseFloat(strconv.FormatFloat(tpsRaw, 'f', 2, 64), 64)
-		if err != nil {
-			tps = 0.0
-		}
+		tps = round2(float64(ntokens) / emittingElapsed.Seconds())
 	} else {
 		tps = 0.0
 	}
 
-	totalTime := thinkingElapsed + emittingElapsed
+	totalTime := prefillElapsed + emittingElapsed
 
-	return InferenceStats{
-		ThinkingTime:       thinkingElapsed.Seconds(),
-		ThinkingTimeFormat: thinkingElapsed.String(),
-		EmitTime:           emittingElapsed.Seconds(),
-		EmitTimeFormat:     emittingElapsed.String(),
-		TotalTime:          totalTime.Seconds(),
-		TotalTimeFormat:    totalTime.String(),
-		TokensPerSecond:    tps,
-		TotalTokens:        ntokens,
-	}, tps
-}
\ No newline at end of file
+	stats := InferenceStats{
+		EmitTime:        emittingElapsed.Seconds(),
+		EmitTimeFormat:  emittingElapsed.String(),
+		TotalTime:       totalTime.Seconds(),
+		TotalTimeFormat: totalTime.String(),
+		TokensPerSecond: tps,
+		TotalTokens:     ntokens,
+	}
+	stats.setPrefillTime(prefillElapsed)
+	return stats, tps
+}
+
+// StatsFromTimings converts the timings reported by llama-server.
+// promptTokens is the size of the prompt (0 if unknown): the tokens not processed
+// were reused from the prompt cache.
+func StatsFromTimings(t Timings, promptTokens int) InferenceStats {
+	prefillElapsed := time.Duration(t.PromptMs * float64(time.Millisecond))
+	emittingElapsed := time.Duration(t.PredictedMs * float64(time.Millisecond))
+	totalTime := prefillElapsed + emittingElapsed
+
+	cached := t.CacheN
+	if cached == 0 && promptTokens > t.PromptN {
+		cached = promptTokens - t.PromptN // older llama-server without cache_n
+	}
+
+	stats := InferenceStats{
+		EmitTime:        emittingElapsed.Seconds(),
+		EmitTimeFormat:  emittingElapsed.String(),
+		TotalTime:       totalTime.Seconds(),
+		TotalTimeFormat: totalTime.String(),
+		TokensPerSecond: round2(t.PredictedPerSecond),
+		TotalTokens:     t.PredictedN,
+
+		PromptTokens:          t.PromptN + cached,
+		CachedTokens:          cached,
+		PromptTime:            prefillElapsed.Seconds(),
+		PromptTimeFormat:      prefillElapsed.String(),
+		PromptTokensPerSecond: round2(t.PromptPerSecond),
+	}
+	stats.setPrefillTime(prefillElapsed)
+	return stats
+}
+
+// round2 rounds to 2 decimals.
+func round2(f float64) float64 {
+	r, err := strconv.ParseFloat(strconv.FormatFloat(f, 'f', 2, 64), 64)
+	if err != nil {
+		return 0.0
+	}
+	return r
+}
@@ -0,0 +1,31 @@
+package lm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStatsFromTimings(t *testing.T) {
+	stats := StatsFromTimings(Timings{PromptN: 3, PromptMs: 10, PredictedN: 2, PredictedMs: 20}, 5)
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{
+		"prefillTime":  0.01,
+		"thinkingTime": 0.01, // deprecated alias
+		"promptTime":   0.01,
+		"emitTime":     0.02,
+		"promptTokens": 5.0,
+		"cachedTokens": 2.0,
+	} {
+		if m[key] != want {
+			t.Errorf("%s = %v, want %v", key, m[key], want)
+		}
+	}
+}
@@ -38,8 +38,8 @@ func StreamErrorMessage(content string, num int) *types.StreamedMessage {
 	}
 }
 
-// SendStartEmittingMessage sends the start_emitting message to the client
-func SendStartEmittingMessage(enc *json.Encoder, c echo.Context, params types.InferParams, ntokens int, thinkingElapsed time.Duration) error {
+// SendStartEmittingMessage sends the start_emitting message (with the inference ID) to the client
+func SendStartEmittingMessage(enc *json.Encoder, c echo.Context, params types.InferParams, ntokens int, prefillElapsed time.Duration, inferenceID string) error {
 	if !params.Stream {
 		return nil
 	}
@@ -49,8 +49,12 @@ func SendStartEmittingMessage(enc *json.Encoder, c echo.Context, params types.In
 		Num:     ntokens,
 		MsgType: types.SystemMsgType,
 		Data: map[string]any{
-			"thinking_time":        thinkingElapsed,
-			"thinking_time_format": thinkingElapsed.String(),
+			"inference_id":        inferenceID,
+			"prefill_time":        prefillElapsed.Seconds(),
+			"prefill_time_format": prefillElapsed.String(),
+			// Deprecated: the former names of prefill_time (in nanoseconds) and prefill_time_format
+			"thinking_time":        prefillElapsed,
+			"thinking_time_format": prefillElapsed.String(),
 		},
 	}
 
@@ -74,15 +78,16 @@ func SendStartEmittingMessage(enc *json.Encoder, c echo.Context, params types.In
 	return err
 }
 
-// StreamDeltaMessage handles token processing during prediction
-func StreamDeltaMessage(ntokens int, token string, enc *json.Encoder, c echo.Context, params types.InferParams,
-	startThinking time.Time, thinkingElapsed *time.Duration, startEmitting *time.Time) error {
-	
+// StreamDeltaMessage handles token processing during prediction:
+// the reasoning part of the token is sent in a reasoning message, unless stripped.
+func StreamDeltaMessage(ntokens int, reasoning, token string, enc *json.Encoder, c echo.Context, params types.InferParams, inferenceID string,
+	startPrefill time.Time, prefillElapsed *time.Duration, startEmitting *time.Time) error {
+
 	if ntokens == 0 {
 		*startEmitting = time.Now()
-		*thinkingElapsed = time.Since(startThinking)
+		*prefillElapsed = time.Since(startPrefill)
 
-		err := SendStartEmittingMessage(enc, c, params, ntokens, *thinkingElapsed)
+		err := SendStartEmittingMessage(enc, c, params, ntokens, *prefillElapsed, inferenceID)
 		if err != nil {
 			fmt.Printf("Error emitting msg: %v\n", err)
 			return err
@@ -93,36 +98,28 @@ func StreamDeltaMessage(ntokens int, token string, enc *json.Encoder, c echo.Con
 		return nil
 	}
 
-	tmsg := types.StreamedMessage{
-		Content: token,
-		Num:     ntokens,
-		MsgType: types.TokenMsgType,
-	}
-
-	_, err := c.Response().Write([]byte("data: "))
-	if err != nil {
-		return fmt.Errorf("failed to write stream begin: %w", err)
-	}
-
-	err = enc.Encode(tmsg)
-	if err != nil {
-		return fmt.Errorf("failed to encode stream message: %w", err)
+	if reasoning != "" && !params.StripReasoning {
+		err := StreamMsg(&types.StreamedMessage{Content: reasoning, Num: ntokens, MsgType: types.ReasoningMsgType}, c, enc)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = c.Response().Write([]byte("\n"))
-	if err != nil {
-		return fmt.Errorf("failed to write stream message: %w", err)
+	if token == "" {
+		return nil
 	}
-
-	c.Response().Flush()
-	return nil
+	return StreamMsg(&types.StreamedMessage{Content: token, Num: ntokens, MsgType: types.TokenMsgType}, c, enc)
 }
 
 // CreateResultMessage creates the final result message
-func CreateResultMessage(res string, stats InferStats, enc *json.Encoder, c echo.Context, params types.InferParams) (types.StreamedMessage, error) {
+func CreateResultMessage(res, reasoning string, stats InferStats, enc *json.Encoder, c echo.Context, params types.InferParams) (types.StreamedMessage, error) {
 	result := InferResult{
-		Text:  res,
-		Stats: stats,
+		Text:      res,
+		Reasoning: reasoning,
+		Stats:     stats,
+	}
+	if params.StripReasoning {
+		result.Reasoning = ""
 	}
 
 	endmsg := types.StreamedMessage{}
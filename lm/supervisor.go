@@ -0,0 +1,380 @@
+package lm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/state"
+)
+
+// ProcessState is the state of the llama-server process.
+type ProcessState string
+
+const (
+	ProcessStopped    ProcessState = "stopped"
+	ProcessStarting   ProcessState = "starting"
+	ProcessReady      ProcessState = "ready"
+	ProcessRestarting ProcessState = "restarting" // crashed, restarting after the backoff delay
+	ProcessFailed     ProcessState = "failed"
+)
+
+// SupervisorStatus is a snapshot of the supervised llama-server.
+type SupervisorStatus struct {
+	State    ProcessState `json:"state"`
+	Model    string       `json:"model,omitempty"`
+	Args     []string     `json:"args,omitempty"` // extra arguments of the model
+	Port     int          `json:"port,omitempty"`
+	PID      int          `json:"pid,omitempty"`
+	Started  time.Time    `json:"started,omitzero"` // when the server became ready
+	Restarts int          `json:"restarts"`
+	Error    string       `json:"error,omitempty"` // last error
+}
+
+// Supervisor runs llama-server without llama-swap: one model at a time,
+// on a free port, restarted with an exponential backoff when it crashes.
+// It is safe for concurrent use.
+type Supervisor struct {
+	Exe           string
+	Args          []string      // llama-server arguments, --model and --port are added
+	Host          string        // listen address of llama-server
+	HealthTimeout time.Duration // max duration to wait for /health
+	MinBackoff    time.Duration // first restart delay, doubled on each crash
+	MaxBackoff    time.Duration
+
+	startMu  sync.Mutex // serializes Start and Stop: a single supervising goroutine
+	mu       sync.Mutex
+	state    ProcessState
+	model    string
+	args     []string // extra arguments
+	port     int
+	pid      int
+	started  time.Time
+	restarts int
+	lastErr  error
+	stop     chan struct{} // closed by Stop
+	done     chan struct{} // closed when the supervising goroutine ends
+}
+
+// NewSupervisor creates a supervisor with the llama-server executable
+// and the common and goinfer arguments of the config.
+func NewSupervisor(cfg conf.LlamaConf) *Supervisor {
+	args := strings.Fields(cfg.Args["common"] + " " + cfg.Args["goinfer"])
+	return &Supervisor{
+		Exe:           cfg.Exe,
+		Args:          args,
+		Host:          "127.0.0.1",
+		HealthTimeout: 2 * time.Minute,
+		MinBackoff:    time.Second,
+		MaxBackoff:    30 * time.Second,
+		state:         ProcessStopped,
+	}
+}
+
+// Start runs llama-server with the model file (the previous model is stopped)
+// and waits until /health replies. The server is restarted when it crashes, until Stop.
+func (s *Supervisor) Start(ctx context.Context, model string, extraArgs ...string) error {
+	s.startMu.Lock()
+	s.halt(nil)
+
+	s.mu.Lock()
+	s.state = ProcessStarting
+	s.model = model
+	s.args = extraArgs
+	s.port = 0
+	s.pid = 0
+	s.started = time.Time{}
+	s.restarts = 0
+	s.lastErr = nil
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	stop, done := s.stop, s.done
+	s.mu.Unlock()
+
+	args := append([]string{"--model", model}, s.Args...)
+	args = append(args, extraArgs...)
+
+	ready := make(chan error, 1)
+	go s.supervise(args, stop, done, ready)
+	s.startMu.Unlock()
+
+	select {
+	case err := <-ready:
+		return err
+	case <-done: // stopped by another goroutine
+		select {
+		case err := <-ready:
+			return err
+		default:
+			return errors.New("llama-server stopped during the start")
+		}
+	case <-ctx.Done():
+		s.startMu.Lock()
+		s.halt(stop)
+		s.startMu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Stop kills llama-server and stops the restarts.
+func (s *Supervisor) Stop() {
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+	s.halt(nil)
+}
+
+// halt stops the supervising goroutine of the stop channel, nil for the current one.
+// Nothing is done when another Start has replaced it. s.startMu must be locked.
+func (s *Supervisor) halt(stop chan struct{}) {
+	s.mu.Lock()
+	current, done := s.stop, s.done
+	if current == nil || (stop != nil && stop != current) {
+		s.mu.Unlock()
+		return
+	}
+	s.stop = nil
+	s.mu.Unlock()
+
+	close(current)
+	<-done
+
+	s.mu.Lock()
+	s.state = ProcessStopped
+	s.port = 0
+	s.pid = 0
+	s.mu.Unlock()
+}
+
+// Status returns the current state of llama-server.
+func (s *Supervisor) Status() SupervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := SupervisorStatus{
+		State:    s.state,
+		Model:    s.model,
+		Args:     s.args,
+		Port:     s.port,
+		PID:      s.pid,
+		Started:  s.started,
+		Restarts: s.restarts,
+	}
+	if s.lastErr != nil {
+		st.Error = s.lastErr.Error()
+	}
+	return st
+}
+
+// Server returns the llama-server when it is ready.
+func (s *Supervisor) Server() (LlamaServer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != ProcessReady {
+		return LlamaServer{}, false
+	}
+	return LlamaServer{URL: "http://" + net.JoinHostPort(s.Host, strconv.Itoa(s.port))}, true
+}
+
+// supervise starts llama-server and restarts it after a crash. The first start
+// is reported on ready: a model that cannot start is not retried.
+func (s *Supervisor) supervise(args []string, stop, done chan struct{}, ready chan<- error) {
+	defer close(done)
+
+	backoff := s.MinBackoff
+	firstStart := true
+
+	for {
+		p, err := s.spawn(args)
+		if err == nil {
+			err = s.waitHealthy(p, stop)
+		}
+
+		if err == nil {
+			s.setReady(p)
+			if firstStart {
+				firstStart = false
+				ready <- nil
+			}
+
+			readyAt := time.Now()
+			select {
+			case <-stop:
+				p.kill()
+				return
+			case err = <-p.exited:
+				if err == nil {
+					err = errors.New("llama-server has exited")
+				}
+			}
+			if time.Since(readyAt) > time.Minute {
+				backoff = s.MinBackoff // it was running fine
+			}
+		} else {
+			p.kill()
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if firstStart {
+			s.setFailed(err)
+			ready <- err
+			return
+		}
+
+		s.setRestarting(err)
+		fmt.Printf("WARNING llama-server crashed: %v => restart in %v\n", err, backoff)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.MaxBackoff)
+	}
+}
+
+// process is a running llama-server.
+type process struct {
+	cmd    *exec.Cmd
+	port   int
+	exited chan error // receives the cmd.Wait result
+}
+
+// spawn starts llama-server on a free port.
+func (s *Supervisor) spawn(args []string) (*process, error) {
+	port, err := freePort(s.Host)
+	if err != nil {
+		return nil, fmt.Errorf("no free port: %w", err)
+	}
+
+	args = append(args, "--host", s.Host, "--port", strconv.Itoa(port))
+	cmd := exec.Command(s.Exe, args...)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = io.Discard
+	if state.Verbose {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	if state.Debug {
+		fmt.Println("Starting", s.Exe, strings.Join(args, " "))
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("cannot start %s: %w", s.Exe, err)
+	}
+
+	p := &process{cmd: cmd, port: port, exited: make(chan error, 1)}
+	go func() { p.exited <- cmd.Wait() }()
+
+	s.mu.Lock()
+	s.port = port
+	s.pid = cmd.Process.Pid
+	s.mu.Unlock()
+
+	return p, nil
+}
+
+// waitHealthy polls /health until llama-server replies 200.
+func (s *Supervisor) waitHealthy(p *process, stop <-chan struct{}) error {
+	url := "http://" + net.JoinHostPort(s.Host, strconv.Itoa(p.port)) + "/health"
+	client := http.Client{Timeout: time.Second}
+	deadline := time.After(s.HealthTimeout)
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case <-stop:
+			return errors.New("stopped")
+		case err := <-p.exited:
+			p.exited <- err // for kill
+			return fmt.Errorf("llama-server has exited during the start: %v", err)
+		case <-deadline:
+			return fmt.Errorf("llama-server not ready after %v", s.HealthTimeout)
+		case <-tick.C:
+		}
+	}
+}
+
+// kill interrupts llama-server, then kills it after 5 seconds.
+func (p *process) kill() {
+	if p == nil {
+		return
+	}
+
+	err := p.cmd.Process.Signal(os.Interrupt)
+	if err != nil {
+		_ = p.cmd.Process.Kill()
+	}
+
+	select {
+	case <-p.exited:
+	case <-time.After(5 * time.Second):
+		_ = p.cmd.Process.Kill()
+		<-p.exited
+	}
+}
+
+func (s *Supervisor) setReady(p *process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = ProcessReady
+	s.started = time.Now()
+	s.lastErr = nil
+	if state.Verbose {
+		fmt.Printf("llama-server ready on port %d (model %s)\n", p.port, s.model)
+	}
+}
+
+func (s *Supervisor) setRestarting(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = ProcessRestarting
+	s.pid = 0
+	s.restarts++
+	s.lastErr = err
+}
+
+func (s *Supervisor) setFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = ProcessFailed
+	s.port = 0
+	s.pid = 0
+	s.lastErr = err
+}
+
+// freePort returns a TCP port available on host.
+func freePort(host string) (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,212 @@
+package lm
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs the fake llama-server when the test binary is started by a supervisor.
+func TestMain(m *testing.M) {
+	if os.Getenv("GOINFER_FAKE_LLAMA") == "1" {
+		fakeLlamaServer()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeLlamaServer replies 200 on /health. It writes its PID in GOINFER_FAKE_PIDS,
+// exits --exit-after its first health check, and never gets healthy with --unhealthy.
+func fakeLlamaServer() {
+	fs := flag.NewFlagSet("llama-server", flag.ExitOnError)
+	host := fs.String("host", "127.0.0.1", "")
+	port := fs.Int("port", 0, "")
+	fs.String("model", "", "")
+	exitAfter := fs.Duration("exit-after", 0, "")
+	unhealthy := fs.Bool("unhealthy", false, "")
+	_ = fs.Parse(os.Args[1:])
+
+	pid := strconv.Itoa(os.Getpid())
+	_ = os.WriteFile(filepath.Join(os.Getenv("GOINFER_FAKE_PIDS"), pid), nil, 0o644)
+
+	var exit sync.Once
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if *exitAfter > 0 {
+			// once healthy: the supervisor start does not depend on the machine load
+			exit.Do(func() { time.AfterFunc(*exitAfter, func() { os.Exit(1) }) })
+		}
+		if *unhealthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	err := http.ListenAndServe(net.JoinHostPort(*host, strconv.Itoa(*port)), nil)
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// newTestSupervisor returns a supervisor running the fake llama-server,
+// and the directory where the fake servers write their PID.
+func newTestSupervisor(t *testing.T) (*Supervisor, string) {
+	t.Helper()
+	pids := t.TempDir()
+	t.Setenv("GOINFER_FAKE_LLAMA", "1")
+	t.Setenv("GOINFER_FAKE_PIDS", pids)
+
+	s := &Supervisor{
+		Exe:           os.Args[0],
+		Host:          "127.0.0.1",
+		HealthTimeout: 10 * time.Second,
+		MinBackoff:    10 * time.Millisecond,
+		MaxBackoff:    100 * time.Millisecond,
+		state:         ProcessStopped,
+	}
+	t.Cleanup(s.Stop)
+	return s, pids
+}
+
+// running returns the PIDs of the fake servers still running.
+func running(t *testing.T, pids string) []int {
+	t.Helper()
+	entries, err := os.ReadDir(pids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alive []int
+	for _, e := range entries {
+		pid, _ := strconv.Atoi(e.Name())
+		if syscall.Kill(pid, 0) == nil {
+			alive = append(alive, pid)
+		}
+	}
+	return alive
+}
+
+func TestSupervisorStart(t *testing.T) {
+	s, pids := newTestSupervisor(t)
+
+	err := s.Start(context.Background(), "model.gguf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := s.Status()
+	if st.State != ProcessReady || st.Model != "model.gguf" || st.PID == 0 || st.Port == 0 {
+		t.Errorf("status = %+v", st)
+	}
+	srv, ok := s.Server()
+	if !ok {
+		t.Fatal("the server is not ready")
+	}
+	if _, err := srv.Get(context.Background(), "/health"); err != nil {
+		t.Error(err)
+	}
+
+	s.Stop()
+	if st := s.Status(); st.State != ProcessStopped || st.PID != 0 {
+		t.Errorf("status = %+v", st)
+	}
+	if alive := running(t, pids); len(alive) > 0 {
+		t.Errorf("processes still running: %v", alive)
+	}
+}
+
+func TestSupervisorConcurrentStarts(t *testing.T) {
+	s, pids := newTestSupervisor(t)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = s.Start(context.Background(), fmt.Sprintf("model%d.gguf", i))
+			if i%3 == 0 {
+				s.Stop()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a single llama-server, or none when the last call is a Stop
+	alive := running(t, pids)
+	st := s.Status()
+	switch st.State {
+	case ProcessReady:
+		if len(alive) != 1 || alive[0] != st.PID {
+			t.Errorf("running processes %v, want [%d]", alive, st.PID)
+		}
+	case ProcessStopped:
+		if len(alive) != 0 {
+			t.Errorf("running processes %v, want none", alive)
+		}
+	default:
+		t.Errorf("status = %+v", st)
+	}
+
+	s.Stop()
+	if alive := running(t, pids); len(alive) > 0 {
+		t.Errorf("orphan processes: %v", alive)
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	s, _ := newTestSupervisor(t)
+
+	err := s.Start(context.Background(), "model.gguf", "--exit-after", "200ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := s.Status().PID
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := s.Status()
+		if st.State == ProcessReady && st.Restarts > 0 && st.PID != pid {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not restarted: %+v", st)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSupervisorStartErrors(t *testing.T) {
+	s, pids := newTestSupervisor(t)
+
+	s.HealthTimeout = 500 * time.Millisecond
+	err := s.Start(context.Background(), "model.gguf", "--unhealthy")
+	if err == nil {
+		t.Fatal("started an unhealthy server")
+	}
+	if st := s.Status(); st.State != ProcessFailed || st.Error == "" {
+		t.Errorf("status = %+v", st)
+	}
+	if alive := running(t, pids); len(alive) > 0 {
+		t.Errorf("processes still running: %v", alive)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	s.HealthTimeout = 10 * time.Second
+	err = s.Start(ctx, "model.gguf", "--unhealthy")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if st := s.Status(); st.State != ProcessStopped {
+		t.Errorf("status = %+v", st)
+	}
+
+	s.Exe = filepath.Join(t.TempDir(), "missing")
+	if err := s.Start(context.Background(), "model.gguf"); err == nil {
+		t.Error("started a missing executable")
+	}
+}
@@ -0,0 +1,79 @@
+package lm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Swap drives the in-process llama-swap proxy: load, unload and list the running models.
+type Swap struct {
+	Handler http.Handler // the proxy.ProxyManager
+}
+
+// RunningModel is a model process of llama-swap.
+type RunningModel struct {
+	Model string `json:"model"`
+	State string `json:"state"` // e.g. starting, ready, stopping
+	Proxy string `json:"proxy"` // URL of the llama-server
+	TTL   int    `json:"ttl"`   // seconds of inactivity before unloading, 0 = never
+}
+
+// api reaches the llama-swap endpoints.
+func (sw Swap) api() LlamaServer {
+	return LlamaServer{URL: proxyHost, Client: &http.Client{Transport: HandlerTransport{Handler: sw.Handler}}}
+}
+
+// Running lists the model processes of llama-swap.
+func (sw Swap) Running(ctx context.Context) ([]RunningModel, error) {
+	resp, err := sw.api().Get(ctx, "/running")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Running []RunningModel `json:"running"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode the llama-swap /running response: %w", err)
+	}
+	return body.Running, nil
+}
+
+// IsReady reports whether the model is loaded and ready.
+func (sw Swap) IsReady(ctx context.Context, model string) (bool, error) {
+	running, err := sw.Running(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range running {
+		if r.Model == model && r.State == "ready" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Load starts the llama-server of the model (llama-swap stops the models of
+// the same swap group) and waits until its /health endpoint replies.
+func (sw Swap) Load(ctx context.Context, model string) error {
+	resp, err := ProxyLlamaServer(sw.Handler, model).Get(ctx, "/health")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Unload stops all the running models.
+func (sw Swap) Unload(ctx context.Context) error {
+	resp, err := sw.api().Get(ctx, "/unload")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,68 @@
+package lm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Tokenize returns the tokens of the content, with the special tokens (BOS...) if addSpecial.
+func (s LlamaServer) Tokenize(ctx context.Context, content string, addSpecial bool) ([]int, error) {
+	resp, err := s.Post(ctx, "/tokenize", map[string]any{"content": content, "add_special": addSpecial})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Tokens []int `json:"tokens"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode llama-server tokens: %w", err)
+	}
+	return res.Tokens, nil
+}
+
+// Detokenize returns the text of the tokens.
+func (s LlamaServer) Detokenize(ctx context.Context, tokens []int) (string, error) {
+	resp, err := s.Post(ctx, "/detokenize", map[string]any{"tokens": tokens})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Content string `json:"content"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode llama-server content: %w", err)
+	}
+	return res.Content, nil
+}
+
+// ContextSize returns the context size of a llama-server slot:
+// the maximum of prompt and predicted tokens of an inference.
+func (s LlamaServer) ContextSize(ctx context.Context) (int, error) {
+	resp, err := s.Get(ctx, "/props")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var props struct {
+		Settings struct {
+			NCtx int `json:"n_ctx"`
+		} `json:"default_generation_settings"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&props)
+	if err != nil {
+		return 0, fmt.Errorf("cannot decode llama-server props: %w", err)
+	}
+	if props.Settings.NCtx <= 0 {
+		return 0, errors.New("llama-server props without the context size")
+	}
+	return props.Settings.NCtx, nil
+}
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/state"
+)
+
+// ModelInfo is the metadata of a model file, read from its GGUF header.
+type ModelInfo struct {
+	Name          string    `json:"name"` // file name without the .gguf extension
+	Path          string    `json:"path"`
+	Architecture  string    `json:"architecture,omitempty"`
+	Parameters    uint64    `json:"parameters,omitempty"`
+	SizeLabel     string    `json:"size_label,omitempty"` // e.g. 7B, from the general.size_label metadata
+	Quantization  string    `json:"quantization,omitempty"`
+	ContextLength uint64    `json:"context_length,omitempty"` // trained context length
+	ChatTemplate  string    `json:"chat_template,omitempty"`
+	Size          int64     `json:"size"`
+	ModTime       time.Time `json:"mod_time"`
+	Error         string    `json:"error,omitempty"` // the GGUF header cannot be read
+}
+
+// Catalog lists the model files with their metadata.
+// The GGUF headers are parsed once per file version (size and modification time).
+// It is safe for concurrent use.
+type Catalog struct {
+	Dir Dir
+
+	mu    sync.Mutex
+	cache map[string]catalogEntry
+}
+
+// catalogEntry is a parsed version of a model file.
+type catalogEntry struct {
+	info   ModelInfo
+	header GGUFHeader // empty if it cannot be read
+}
+
+// NewCatalog creates the catalog of the model files found in dir
+// (one or multiple directories separated by ':').
+func NewCatalog(dir string) *Catalog {
+	return &Catalog{Dir: Dir(dir), cache: map[string]catalogEntry{}}
+}
+
+// Models returns the metadata of the model files, sorted by name.
+func (cat *Catalog) Models() ([]ModelInfo, error) {
+	files, err := cat.Dir.Search()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]ModelInfo, 0, len(files))
+	for _, f := range files {
+		list = append(list, cat.entry(f).info)
+	}
+	cat.prune(files)
+
+	slices.SortFunc(list, func(a, b ModelInfo) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return list, nil
+}
+
+// Classify classifies the model files like Classify, the GGUF headers
+// are read from the cache when the files have not changed.
+func (cat *Catalog) Classify(files []string) []ModelFile {
+	list := classify(files, func(path string) GGUFHeader { return cat.entry(path).header })
+	cat.prune(files)
+	return list
+}
+
+// prune removes the files that are gone from the cache.
+func (cat *Catalog) prune(files []string) {
+	cat.mu.Lock()
+	defer cat.mu.Unlock()
+	for path := range cat.cache {
+		if !slices.Contains(files, path) {
+			delete(cat.cache, path)
+		}
+	}
+}
+
+// entry returns the metadata of a model file, from the cache if the file has not changed.
+func (cat *Catalog) entry(path string) catalogEntry {
+	info := ModelInfo{
+		Name: strings.TrimSuffix(filepath.Base(path), ".gguf"),
+		Path: path,
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		info.Error = err.Error()
+		return catalogEntry{info: info}
+	}
+	info.Size = fi.Size()
+	info.ModTime = fi.ModTime()
+
+	cat.mu.Lock()
+	cached, ok := cat.cache[path]
+	cat.mu.Unlock()
+	if ok && cached.info.Size == info.Size && cached.info.ModTime.Equal(info.ModTime) {
+		return cached
+	}
+
+	h, err := ReadGGUFHeader(path)
+	if err != nil {
+		info.Error = err.Error()
+		h = GGUFHeader{}
+	} else {
+		info.Architecture = h.String("general.architecture")
+		info.Parameters = h.Parameters
+		info.SizeLabel = h.String("general.size_label")
+		info.Quantization = h.Quantization()
+		info.ContextLength = h.ContextLength()
+		info.ChatTemplate = h.String("tokenizer.chat_template")
+	}
+
+	e := catalogEntry{info: info, header: h}
+	cat.mu.Lock()
+	cat.cache[path] = e
+	cat.mu.Unlock()
+
+	return e
+}
+
+// StateHandler returns the metadata of the model files.
+func (cat *Catalog) StateHandler(c echo.Context) error {
+	list, err := cat.Models()
+	if err != nil {
+		fmt.Println("Error while reading models:", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot fetch model files: "+err.Error())
+	}
+
+	if state.Verbose {
+		fmt.Println("Found", len(list), "models")
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
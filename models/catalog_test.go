@@ -0,0 +1,65 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatalog(t *testing.T) {
+	dir := t.TempDir()
+	model := filepath.Join(dir, "llama-7b.gguf")
+	writeFile(t, model, llamaGGUF)
+	writeFile(t, filepath.Join(dir, "bad.gguf"), []byte("nope"))
+	cat := NewCatalog(dir)
+
+	list, err := cat.Models()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "bad" || list[0].Error == "" {
+		t.Fatalf("models = %+v", list)
+	}
+	m := list[1]
+	if m.Architecture != "llama" || m.Parameters != 205 || m.SizeLabel != "7B" || m.Quantization != "Q4_K_M" ||
+		m.ContextLength != 8192 || m.ChatTemplate != "{{ messages }}" || m.Size != int64(len(llamaGGUF)) {
+		t.Errorf("model = %+v", m)
+	}
+
+	// the same size and modification time: the cached header is used
+	fi, err := os.Stat(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := make([]byte, len(llamaGGUF))
+	writeFile(t, model, corrupt)
+	if err := os.Chtimes(model, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = cat.Models()
+	if list[1].Error != "" || list[1].Architecture != "llama" {
+		t.Errorf("the header is not cached: %+v", list[1])
+	}
+	if got := cat.Classify([]string{model}); got[0].Kind != KindChat || got[0].Name != "llama-7b" {
+		t.Errorf("classified from the cache: %+v", got)
+	}
+
+	// modified: the header is read again
+	if err := os.Chtimes(model, fi.ModTime(), fi.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = cat.Models()
+	if list[1].Error == "" {
+		t.Errorf("the modified file is not read again: %+v", list[1])
+	}
+
+	// removed: the file leaves the cache
+	if err := os.Remove(model); err != nil {
+		t.Fatal(err)
+	}
+	list, _ = cat.Models()
+	if len(list) != 1 || len(cat.cache) != 1 {
+		t.Errorf("models %+v, cache %v", list, cat.cache)
+	}
+}
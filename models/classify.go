@@ -0,0 +1,152 @@
+package models
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ModelKind is the kind of model served by llama-server.
+type ModelKind string
+
+const (
+	KindChat      ModelKind = "chat"
+	KindEmbedding ModelKind = "embedding"
+	KindReranker  ModelKind = "reranker"
+)
+
+// ModelFile is a model to serve: a GGUF file or the first shard of a split model,
+// with its multimodal projector if any.
+type ModelFile struct {
+	Name   string // file name without the shard suffix and the .gguf extension
+	Path   string // the model file, or its first shard
+	Kind   ModelKind
+	MMProj string // multimodal projector file, "" if none
+}
+
+// shardSuffix matches the files of a split model: model-00001-of-00003.gguf
+var shardSuffix = regexp.MustCompile(`-(\d{5})-of-\d{5}\.gguf$`)
+
+// poolingRank is the pooling type of the rerankers (LLAMA_POOLING_TYPE_RANK).
+const poolingRank = 4
+
+// embeddingArchs are the architectures of the embedding only models.
+var embeddingArchs = []string{"bert", "nomic-bert", "nomic-bert-moe", "jina-bert-v2", "jina-bert-v3", "modern-bert", "neo-bert", "t5encoder"}
+
+// Classify returns the models of the GGUF files, from their metadata and file names:
+// the projectors (mmproj) are paired with a model of the same directory,
+// only the first shard of a split model is kept, the embedding and reranker
+// models are detected from their pooling type.
+func Classify(files []string) []ModelFile {
+	return classify(files, func(path string) GGUFHeader {
+		h, err := ReadGGUFHeader(path)
+		if err != nil {
+			return GGUFHeader{} // classify from the file name only
+		}
+		return h
+	})
+}
+
+// classify classifies the files with the GGUF headers returned by header.
+func classify(files []string, header func(path string) GGUFHeader) []ModelFile {
+	var list []ModelFile
+	var projectors []string
+
+	for _, f := range files {
+		base := filepath.Base(f)
+		name := strings.TrimSuffix(base, ".gguf")
+
+		if m := shardSuffix.FindStringSubmatch(base); m != nil {
+			if m[1] != "00001" {
+				continue // the other shards are loaded by llama-server
+			}
+			name = strings.TrimSuffix(base, m[0])
+		}
+
+		h := header(f)
+
+		if isProjector(name, h) {
+			projectors = append(projectors, f)
+			continue
+		}
+
+		list = append(list, ModelFile{Name: name, Path: f, Kind: modelKind(name, h)})
+	}
+
+	for _, p := range projectors {
+		i := pairProjector(p, list)
+		if i < 0 {
+			fmt.Println("WARNING no model found for the projector", p)
+			continue
+		}
+		list[i].MMProj = p
+	}
+
+	return list
+}
+
+// isProjector reports whether the file is a multimodal projector.
+func isProjector(name string, h GGUFHeader) bool {
+	return h.String("general.architecture") == "clip" ||
+		strings.Contains(strings.ToLower(name), "mmproj")
+}
+
+// modelKind returns the kind of model, from the pooling type of the embedding models
+// (a chat model has no pooling type) or else from the file name.
+func modelKind(name string, h GGUFHeader) ModelKind {
+	arch := h.String("general.architecture")
+	if _, ok := h.Metadata[arch+".pooling_type"]; ok && arch != "" {
+		if h.Uint(arch+".pooling_type") == poolingRank {
+			return KindReranker
+		}
+		return KindEmbedding
+	}
+	if slices.Contains(embeddingArchs, arch) {
+		return KindEmbedding
+	}
+
+	lower := strings.ToLower(name)
+	switch {
+	case strings.Contains(lower, "rerank"):
+		return KindReranker
+	case arch == "" && strings.Contains(lower, "embed"):
+		return KindEmbedding
+	}
+	return KindChat
+}
+
+// pairProjector returns the index of the chat model of the projector: the model of the
+// same directory, the one sharing the longest name prefix when there are several.
+// Returns -1 if none.
+func pairProjector(projector string, list []ModelFile) int {
+	dir := filepath.Dir(projector)
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(projector), ".gguf"))
+	name = strings.Trim(strings.ReplaceAll(name, "mmproj", ""), "-_.")
+
+	best, bestLen, count := -1, -1, 0
+	for i, m := range list {
+		if m.Kind != KindChat || filepath.Dir(m.Path) != dir {
+			continue
+		}
+		count++
+		n := commonPrefixLen(name, strings.ToLower(m.Name))
+		if n > bestLen {
+			best, bestLen = i, n
+		}
+	}
+
+	if count > 1 && bestLen == 0 {
+		return -1 // ambiguous
+	}
+	return best
+}
+
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
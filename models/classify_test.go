@@ -0,0 +1,61 @@
+package models
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	notGGUF := []byte("not a gguf file") // classified from the file name
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"vision/qwen-vl-7b-Q4_K_M.gguf", modelGGUF("qwen2vl")},
+		{"vision/gemma-3-4b.gguf", modelGGUF("gemma3")},
+		{"vision/mmproj-qwen-vl-7b-f16.gguf", modelGGUF("clip")},
+		{"split/big-00001-of-00002.gguf", modelGGUF("llama")},
+		{"split/big-00002-of-00002.gguf", notGGUF},
+		{"embed/bge-m3.gguf", modelGGUF("bert", ggufKV{"bert.pooling_type", ggufUint32, uint32(2)})},
+		{"embed/nomic.gguf", modelGGUF("nomic-bert")},
+		{"embed/qwen3-rerank-model.gguf", modelGGUF("qwen3", ggufKV{"qwen3.pooling_type", ggufUint32, uint32(poolingRank)})},
+		{"embed/qwen3-embedding.gguf", modelGGUF("qwen3", ggufKV{"qwen3.pooling_type", ggufUint32, uint32(3)})},
+		{"names/bge-reranker.gguf", notGGUF},
+		{"names/text-embed.gguf", notGGUF},
+		{"names/mmproj-orphan.gguf", notGGUF},
+		{"ambiguous/a.gguf", modelGGUF("llama")},
+		{"ambiguous/b.gguf", modelGGUF("llama")},
+		{"ambiguous/mmproj.gguf", modelGGUF("clip")},
+	}
+	var paths []string
+	for _, f := range files {
+		writeFile(t, path(f.name), f.data)
+		paths = append(paths, path(f.name))
+	}
+
+	want := []ModelFile{
+		{Name: "qwen-vl-7b-Q4_K_M", Path: path("vision/qwen-vl-7b-Q4_K_M.gguf"), Kind: KindChat, MMProj: path("vision/mmproj-qwen-vl-7b-f16.gguf")},
+		{Name: "gemma-3-4b", Path: path("vision/gemma-3-4b.gguf"), Kind: KindChat},
+		{Name: "big", Path: path("split/big-00001-of-00002.gguf"), Kind: KindChat},
+		{Name: "bge-m3", Path: path("embed/bge-m3.gguf"), Kind: KindEmbedding},
+		{Name: "nomic", Path: path("embed/nomic.gguf"), Kind: KindEmbedding},
+		{Name: "qwen3-rerank-model", Path: path("embed/qwen3-rerank-model.gguf"), Kind: KindReranker},
+		{Name: "qwen3-embedding", Path: path("embed/qwen3-embedding.gguf"), Kind: KindEmbedding},
+		{Name: "bge-reranker", Path: path("names/bge-reranker.gguf"), Kind: KindReranker},
+		{Name: "text-embed", Path: path("names/text-embed.gguf"), Kind: KindEmbedding},
+		{Name: "a", Path: path("ambiguous/a.gguf"), Kind: KindChat},
+		{Name: "b", Path: path("ambiguous/b.gguf"), Kind: KindChat},
+	}
+
+	got := Classify(paths)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Classify:\n got %+v\nwant %+v", got, want)
+	}
+	if got := NewCatalog(dir).Classify(paths); !reflect.DeepEqual(got, want) {
+		t.Errorf("Catalog.Classify:\n got %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,299 @@
+package models
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// ggufMagic is "GGUF" in little endian.
+const ggufMagic = 0x46554747
+
+// GGUF metadata value types.
+const (
+	ggufUint8 uint32 = iota
+	ggufInt8
+	ggufUint16
+	ggufInt16
+	ggufUint32
+	ggufInt32
+	ggufFloat32
+	ggufBool
+	ggufString
+	ggufArray
+	ggufUint64
+	ggufInt64
+	ggufFloat64
+)
+
+// maxGGUFString limits the size of a metadata string (the chat templates are a few KB).
+const maxGGUFString = 16 << 20
+
+// maxGGUFDims is the maximum number of dimensions of a tensor (GGML_MAX_DIMS).
+const maxGGUFDims = 4
+
+// GGUFHeader is the header of a GGUF file: the metadata and the tensor count.
+type GGUFHeader struct {
+	Version     uint32
+	TensorCount uint64
+	Metadata    map[string]any // scalar and string values, arrays are replaced by their length
+	Parameters  uint64         // sum of the tensor elements
+}
+
+// String returns a string metadata value, "" if absent.
+func (h GGUFHeader) String(key string) string {
+	s, _ := h.Metadata[key].(string)
+	return s
+}
+
+// Uint returns an unsigned integer metadata value, 0 if absent.
+func (h GGUFHeader) Uint(key string) uint64 {
+	switch v := h.Metadata[key].(type) {
+	case uint8:
+		return uint64(v)
+	case uint16:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case uint64:
+		return v
+	case int8:
+		return uint64(max(v, 0))
+	case int16:
+		return uint64(max(v, 0))
+	case int32:
+		return uint64(max(v, 0))
+	case int64:
+		return uint64(max(v, 0))
+	}
+	return 0
+}
+
+// ReadGGUFHeader parses the header of a GGUF file without reading the tensor data.
+func ReadGGUFHeader(path string) (GGUFHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return GGUFHeader{}, err
+	}
+	defer f.Close()
+
+	h, err := readGGUFHeader(bufio.NewReaderSize(f, 1<<16))
+	if err != nil {
+		return h, fmt.Errorf("invalid GGUF file %s: %w", path, err)
+	}
+	return h, nil
+}
+
+func readGGUFHeader(r io.Reader) (GGUFHeader, error) {
+	g := ggufReader{r: r}
+	h := GGUFHeader{Metadata: map[string]any{}}
+
+	if g.u32() != ggufMagic {
+		if g.err != nil {
+			return h, g.err
+		}
+		return h, errors.New("bad magic number")
+	}
+
+	h.Version = g.u32()
+	if h.Version == 1 {
+		// v1 counts are 32 bits
+		return h, errors.New("GGUF v1 is not supported")
+	}
+
+	h.TensorCount = g.u64()
+	kvCount := g.u64()
+	if g.err != nil {
+		return h, g.err
+	}
+
+	for range kvCount {
+		key := g.str()
+		typ := g.u32()
+		val := g.value(typ)
+		if g.err != nil {
+			return h, fmt.Errorf("metadata %q: %w", key, g.err)
+		}
+		h.Metadata[key] = val
+	}
+
+	// tensor infos: name, dims, type, offset
+	for range h.TensorCount {
+		g.skipStr()
+		nDims := g.u32()
+		if g.err == nil && nDims > maxGGUFDims {
+			g.err = fmt.Errorf("tensor with %d dimensions", nDims)
+		}
+		n := uint64(1)
+		for i := uint32(0); i < nDims && g.err == nil; i++ {
+			n *= g.u64()
+		}
+		g.u32() // type
+		g.u64() // offset
+		if g.err != nil {
+			return h, fmt.Errorf("tensor infos: %w", g.err)
+		}
+		h.Parameters += n
+	}
+
+	return h, nil
+}
+
+// ggufReader reads little endian values, the first error stops the reading.
+type ggufReader struct {
+	r   io.Reader
+	err error
+	buf [8]byte
+}
+
+func (g *ggufReader) read(n int) []byte {
+	if g.err != nil {
+		return g.buf[:n]
+	}
+	_, g.err = io.ReadFull(g.r, g.buf[:n])
+	return g.buf[:n]
+}
+
+func (g *ggufReader) u8() uint8   { return g.read(1)[0] }
+func (g *ggufReader) u16() uint16 { return binary.LittleEndian.Uint16(g.read(2)) }
+func (g *ggufReader) u32() uint32 { return binary.LittleEndian.Uint32(g.read(4)) }
+func (g *ggufReader) u64() uint64 { return binary.LittleEndian.Uint64(g.read(8)) }
+
+func (g *ggufReader) str() string {
+	n := g.strLen()
+	if g.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	_, g.err = io.ReadFull(g.r, b)
+	return string(b)
+}
+
+func (g *ggufReader) skipStr() {
+	n := g.strLen()
+	if g.err != nil {
+		return
+	}
+	_, g.err = io.CopyN(io.Discard, g.r, int64(n))
+	if errors.Is(g.err, io.EOF) {
+		g.err = io.ErrUnexpectedEOF
+	}
+}
+
+// strLen reads the length of a string, a corrupt length is an error.
+func (g *ggufReader) strLen() uint64 {
+	n := g.u64()
+	if g.err == nil && n > maxGGUFString {
+		g.err = fmt.Errorf("string too long: %d bytes", n)
+	}
+	return n
+}
+
+// value reads a metadata value, the arrays are skipped and replaced by their length.
+func (g *ggufReader) value(typ uint32) any {
+	switch typ {
+	case ggufUint8:
+		return g.u8()
+	case ggufInt8:
+		return int8(g.u8())
+	case ggufUint16:
+		return g.u16()
+	case ggufInt16:
+		return int16(g.u16())
+	case ggufUint32:
+		return g.u32()
+	case ggufInt32:
+		return int32(g.u32())
+	case ggufFloat32:
+		return math.Float32frombits(g.u32())
+	case ggufBool:
+		return g.u8() != 0
+	case ggufString:
+		return g.str()
+	case ggufUint64:
+		return g.u64()
+	case ggufInt64:
+		return int64(g.u64())
+	case ggufFloat64:
+		return math.Float64frombits(g.u64())
+	case ggufArray:
+		elemType := g.u32()
+		n := g.u64()
+		if g.err != nil {
+			return nil
+		}
+		if elemType == ggufArray {
+			g.err = errors.New("nested arrays are not supported") // like llama.cpp
+			return nil
+		}
+		for range n {
+			if elemType == ggufString {
+				g.skipStr()
+			} else {
+				g.value(elemType)
+			}
+			if g.err != nil {
+				break
+			}
+		}
+		return n
+	}
+	if g.err == nil {
+		g.err = fmt.Errorf("unknown value type %d", typ)
+	}
+	return nil
+}
+
+// fileTypes names the general.file_type values (llama_ftype in llama.cpp).
+var fileTypes = map[uint64]string{
+	0:  "F32",
+	1:  "F16",
+	2:  "Q4_0",
+	3:  "Q4_1",
+	7:  "Q8_0",
+	8:  "Q5_0",
+	9:  "Q5_1",
+	10: "Q2_K",
+	11: "Q3_K_S",
+	12: "Q3_K_M",
+	13: "Q3_K_L",
+	14: "Q4_K_S",
+	15: "Q4_K_M",
+	16: "Q5_K_S",
+	17: "Q5_K_M",
+	18: "Q6_K",
+	19: "IQ2_XXS",
+	20: "IQ2_XS",
+	21: "Q2_K_S",
+	22: "IQ3_XS",
+	23: "IQ3_XXS",
+	24: "IQ1_S",
+	25: "IQ4_NL",
+	26: "IQ3_S",
+	27: "IQ3_M",
+	28: "IQ2_S",
+	29: "IQ2_M",
+	30: "IQ4_XS",
+	31: "IQ1_M",
+	32: "BF16",
+	36: "TQ1_0",
+	37: "TQ2_0",
+	38: "MXFP4_MOE",
+}
+
+// Quantization returns the quantization type of the model, "" if unknown.
+func (h GGUFHeader) Quantization() string {
+	if _, ok := h.Metadata["general.file_type"]; !ok {
+		return ""
+	}
+	return fileTypes[h.Uint("general.file_type")]
+}
+
+// ContextLength returns the trained context length of the model.
+func (h GGUFHeader) ContextLength() uint64 {
+	return h.Uint(h.String("general.architecture") + ".context_length")
+}
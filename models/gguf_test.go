@@ -0,0 +1,183 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ggufKV is a metadata entry of a GGUF fixture: val is a string, a []string
+// (array of strings), a fixed size number of the type typ or raw bytes.
+type ggufKV struct {
+	key string
+	typ uint32
+	val any
+}
+
+// ggufTensor is a tensor info of a GGUF fixture.
+type ggufTensor struct {
+	name string
+	dims []uint64
+}
+
+// buildGGUF returns a GGUF v3 header with the metadata and the tensor infos.
+func buildGGUF(kvs []ggufKV, tensors []ggufTensor) []byte {
+	var b bytes.Buffer
+	put := func(v any) { _ = binary.Write(&b, binary.LittleEndian, v) }
+	str := func(s string) {
+		put(uint64(len(s)))
+		b.WriteString(s)
+	}
+
+	put(uint32(ggufMagic))
+	put(uint32(3))
+	put(uint64(len(tensors)))
+	put(uint64(len(kvs)))
+	for _, kv := range kvs {
+		str(kv.key)
+		put(kv.typ)
+		switch v := kv.val.(type) {
+		case string:
+			str(v)
+		case []string:
+			put(ggufString)
+			put(uint64(len(v)))
+			for _, s := range v {
+				str(s)
+			}
+		default:
+			put(v)
+		}
+	}
+	for _, t := range tensors {
+		str(t.name)
+		put(uint32(len(t.dims)))
+		for _, d := range t.dims {
+			put(d)
+		}
+		put(uint32(0)) // type
+		put(uint64(0)) // offset
+	}
+	return b.Bytes()
+}
+
+// modelGGUF returns the header of a model of the architecture, with extra metadata.
+func modelGGUF(arch string, kvs ...ggufKV) []byte {
+	kvs = append([]ggufKV{{"general.architecture", ggufString, arch}}, kvs...)
+	return buildGGUF(kvs, []ggufTensor{{"output.weight", []uint64{4, 8}}})
+}
+
+// writeFile writes the file, creating its directory.
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// llamaGGUF is a complete fixture with every kind of metadata value.
+var llamaGGUF = buildGGUF([]ggufKV{
+	{"general.architecture", ggufString, "llama"},
+	{"general.size_label", ggufString, "7B"},
+	{"llama.context_length", ggufUint32, uint32(8192)},
+	{"general.file_type", ggufUint32, uint32(15)},
+	{"llama.rope.freq_base", ggufFloat32, float32(10000)},
+	{"llama.expert_count", ggufInt64, int64(-1)},
+	{"tokenizer.ggml.add_bos_token", ggufBool, uint8(1)},
+	{"tokenizer.ggml.tokens", ggufArray, []string{"a", "bb", "ccc"}},
+	{"tokenizer.chat_template", ggufString, "{{ messages }}"},
+}, []ggufTensor{
+	{"t1", []uint64{10, 20}},
+	{"t2", []uint64{5}},
+})
+
+func TestReadGGUFHeader(t *testing.T) {
+	h, err := readGGUFHeader(bytes.NewReader(llamaGGUF))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Version != 3 || h.TensorCount != 2 || h.Parameters != 205 {
+		t.Errorf("version %d, tensors %d, parameters %d", h.Version, h.TensorCount, h.Parameters)
+	}
+	if got := h.String("tokenizer.chat_template"); got != "{{ messages }}" {
+		t.Errorf("chat template = %q", got)
+	}
+	if got := h.Uint("tokenizer.ggml.tokens"); got != 3 {
+		t.Errorf("the array is replaced by its length, got %d", got)
+	}
+	if h.Metadata["tokenizer.ggml.add_bos_token"] != true || h.Metadata["llama.rope.freq_base"] != float32(10000) {
+		t.Errorf("metadata = %v", h.Metadata)
+	}
+	if got := h.Uint("llama.expert_count"); got != 0 {
+		t.Errorf("a negative value is 0, got %d", got)
+	}
+	if h.Quantization() != "Q4_K_M" || h.ContextLength() != 8192 {
+		t.Errorf("quantization %q, context length %d", h.Quantization(), h.ContextLength())
+	}
+}
+
+func TestReadGGUFHeaderErrors(t *testing.T) {
+	// a corrupt length or count in place of the field
+	corrupt := func(kvs []ggufKV, tensors []ggufTensor, field []byte, value uint64) []byte {
+		b := buildGGUF(kvs, tensors)
+		i := bytes.LastIndex(b, field)
+		out := bytes.Clone(b[:i])
+		out = binary.LittleEndian.AppendUint64(out, value)
+		return append(out, b[i+8:]...)
+	}
+	u64 := func(n uint64) []byte { return binary.LittleEndian.AppendUint64(nil, n) }
+	u32 := func(n uint32) []byte { return binary.LittleEndian.AppendUint32(nil, n) }
+	tensor := []ggufTensor{{"tensor", []uint64{3}}}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "EOF"},
+		{"bad magic", []byte("GGML\x03\x00\x00\x00"), "bad magic"},
+		{"v1", append(u32(ggufMagic), u32(1)...), "v1"},
+		{"unknown type", buildGGUF([]ggufKV{{"k", 99, uint8(0)}}, nil), "unknown value type"},
+		{"nested array", buildGGUF([]ggufKV{{"k", ggufArray, append(u32(ggufArray), u64(1)...)}}, nil), "nested arrays"},
+		{"string length", corrupt([]ggufKV{{"k", ggufString, "value"}}, nil, u64(5), 1<<63), "string too long"},
+		{"array string length", corrupt([]ggufKV{{"k", ggufArray, []string{"value"}}}, nil, u64(5), 1<<63), "string too long"},
+		{"tensor name length", corrupt(nil, tensor, u64(6), 1<<63+6), "string too long"},
+		{"tensor dimensions", bytes.Replace(buildGGUF(nil, tensor), append(u32(1), u64(3)...), append(u32(0xFFFFFFFF), u64(3)...), 1), "dimensions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readGGUFHeader(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadGGUFHeaderTruncated(t *testing.T) {
+	for n := range len(llamaGGUF) {
+		if _, err := readGGUFHeader(bytes.NewReader(llamaGGUF[:n])); err == nil {
+			t.Fatalf("no error for the header truncated to %d bytes", n)
+		}
+	}
+}
+
+func TestReadGGUFHeaderFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "bad.gguf"), []byte("nope"))
+
+	_, err := ReadGGUFHeader(filepath.Join(dir, "bad.gguf"))
+	if err == nil || !strings.Contains(err.Error(), "bad.gguf") {
+		t.Errorf("error %v, want the file name", err)
+	}
+	if _, err := ReadGGUFHeader(filepath.Join(dir, "missing.gguf")); !os.IsNotExist(err) {
+		t.Errorf("error %v, want not exist", err)
+	}
+}
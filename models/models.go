@@ -1,13 +1,14 @@
 package models
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
-	"net/http"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/labstack/echo/v4"
 	"github.com/synw/goinfer/state"
 )
 
@@ -17,28 +18,16 @@ func (dir Dir) Str() string {
 	return string(dir)
 }
 
-// StateHandler returns the state of models.
-func (dir Dir) StateHandler(c echo.Context) error {
-	models, err := dir.Search()
-	if err != nil {
-		fmt.Println("Error while reading models:", err)
-		e := map[string]string{"error": "cannot fetch model files: " + err.Error()}
-		return c.JSON(http.StatusInternalServerError, e)
-	}
-
-	if state.Verbose {
-		fmt.Println("Found models:", models)
-	}
-
-	return c.JSON(http.StatusOK, models)
+func (dir Dir) Search() ([]string, error) {
+	return dir.search(state.Verbose)
 }
 
-func (dir Dir) Search() ([]string, error) {
+func (dir Dir) search(verbose bool) ([]string, error) {
 	var modelFiles []string
 	// dir = one or multiple directories separated by ':'
 	directories := strings.Split(dir.Str(), ":")
 	for _, d := range directories {
-		err := appendModels(modelFiles, strings.TrimSpace(d))
+		err := appendModels(&modelFiles, strings.TrimSpace(d), verbose)
 		if err != nil {
 			return nil, err
 		}
@@ -46,20 +35,50 @@ func (dir Dir) Search() ([]string, error) {
 	return modelFiles, nil
 }
 
-func appendModels(files []string, root string) error {
+func appendModels(files *[]string, root string, verbose bool) error {
 	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		if d.IsDir() {
-			if state.Verbose {
+			if verbose {
 				fmt.Println("Searching model files in:", path)
 			}
 			return nil // => step into this directory
 		}
 		if strings.HasSuffix(path, ".gguf") {
-			files = append(files, path)
+			*files = append(*files, path)
 		}
 		return nil
 	})
 }
+
+// Watch scans the directories every interval and calls onChange with the
+// sorted model files after the first scan and when files are added or removed,
+// until ctx is done.
+func (dir Dir) Watch(ctx context.Context, interval time.Duration, onChange func(files []string)) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	var previous []string
+	scanned := false
+	for {
+		files, err := dir.search(false)
+		if err != nil {
+			fmt.Println("WARNING cannot scan the model files:", err)
+		} else {
+			slices.Sort(files)
+			if !scanned || !slices.Equal(files, previous) {
+				previous = files
+				scanned = true
+				onChange(files)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDirSearch(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	for _, f := range []string{filepath.Join(a, "m1.gguf"), filepath.Join(a, "sub", "m2.gguf"), filepath.Join(b, "m3.gguf")} {
+		writeFile(t, f, nil)
+	}
+	writeFile(t, filepath.Join(a, "notes.txt"), nil)
+
+	files, err := Dir(a + ": " + b).Search()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(a, "m1.gguf"), filepath.Join(a, "sub", "m2.gguf"), filepath.Join(b, "m3.gguf")}
+	if !slices.Equal(files, want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+
+	if _, err := Dir(filepath.Join(a, "missing")).Search(); err == nil {
+		t.Error("no error for a missing directory")
+	}
+}
+
+func TestDirWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "b.gguf"), nil)
+
+	changes := make(chan []string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Dir(dir).Watch(ctx, 10*time.Millisecond, func(files []string) { changes <- files })
+		close(done)
+	}()
+
+	next := func() []string {
+		t.Helper()
+		select {
+		case files := <-changes:
+			return files
+		case <-time.After(5 * time.Second):
+			t.Fatal("no change notified")
+			return nil
+		}
+	}
+
+	if files := next(); !slices.Equal(files, []string{filepath.Join(dir, "b.gguf")}) {
+		t.Errorf("first scan = %v", files)
+	}
+	writeFile(t, filepath.Join(dir, "a.gguf"), nil)
+	if files := next(); !slices.Equal(files, []string{filepath.Join(dir, "a.gguf"), filepath.Join(dir, "b.gguf")}) {
+		t.Errorf("after an added file = %v", files)
+	}
+
+	// no change: no call
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case files := <-changes:
+		t.Errorf("unexpected change %v", files)
+	default:
+	}
+
+	cancel()
+	<-done
+}
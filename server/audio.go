@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/synw/goinfer/lm"
+	"github.com/synw/goinfer/state"
+)
+
+// maxAudioSize is the maximum size of an uploaded audio file, like OpenAI.
+const maxAudioSize = 25 << 20
+
+// audioBodyLimit rejects the requests larger than an audio file and its form fields
+// with 413 Request Entity Too Large, before the multipart form is read.
+var audioBodyLimit = middleware.BodyLimit(strconv.Itoa(maxAudioSize>>20+1) + "M")
+
+// audioContentTypes are the content types of the audio response formats.
+var audioContentTypes = map[string]string{
+	"json": echo.MIMEApplicationJSONCharsetUTF8,
+	"text": echo.MIMETextPlainCharsetUTF8,
+	"srt":  "application/x-subrip; charset=utf-8",
+	"vtt":  "text/vtt; charset=utf-8",
+}
+
+// whisperServer returns the whisper.cpp server running the model:
+// through llama-swap when enabled, else the whisper-server configured in whisper.url.
+// Without model name, the model is the only one of the whisper config.
+func (h *Handlers) whisperServer(model string) (lm.LlamaServer, string, error) {
+	if h.ProxyMan != nil {
+		if model == "" && len(h.Cfg.Whisper.Models) == 1 {
+			for name := range h.Cfg.Whisper.Models {
+				model = name
+			}
+		}
+		if model == "" {
+			return lm.LlamaServer{}, model, fmt.Errorf("%w: missing model name", errModelNotFound)
+		}
+		px := h.ProxyMan.Config()
+		if _, ok := px.RealModelName(model); !ok {
+			return lm.LlamaServer{}, model, fmt.Errorf("%w: %s (no entry in the llama-swap config)", errModelNotFound, model)
+		}
+		return lm.ProxyLlamaServer(trackRequests(h.ProxyMan), model), model, nil
+	}
+
+	if h.Cfg.Whisper.URL != "" {
+		return lm.LlamaServer{URL: h.Cfg.Whisper.URL}, model, nil
+	}
+
+	return lm.LlamaServer{}, model, errors.New("no whisper server: enable the llama-swap proxy with whisper.models, or set whisper.url")
+}
+
+// parseAudioRequest decodes and validates a multipart /v1/audio request.
+// The returned file must be closed.
+func parseAudioRequest(c echo.Context, translate bool) (lm.AudioRequest, multipart.File, error) {
+	req := lm.AudioRequest{
+		Model:          c.FormValue("model"),
+		Language:       c.FormValue("language"),
+		Prompt:         c.FormValue("prompt"),
+		ResponseFormat: c.FormValue("response_format"),
+		Priority:       c.FormValue("priority"),
+		Translate:      translate,
+	}
+	var errs FieldErrors
+
+	fh, err := c.FormFile("file")
+	switch {
+	case errors.Is(err, http.ErrMissingFile):
+		errs.add(lm.ErrCodeMissingField, "file", "missing mandatory field: file")
+	case err != nil:
+		return req, nil, fmt.Errorf("the request body must be a multipart form: %w", err)
+	case fh.Size > maxAudioSize:
+		errs.add(lm.ErrCodeOutOfRange, "file", fmt.Sprintf("the audio file exceeds %d MiB", maxAudioSize>>20))
+	}
+
+	if req.ResponseFormat == "" {
+		req.ResponseFormat = "json"
+	}
+	if _, ok := audioContentTypes[req.ResponseFormat]; !ok {
+		errs.add(lm.ErrCodeOutOfRange, "response_format", "response_format must be json, text, srt or vtt, got "+req.ResponseFormat)
+	}
+
+	if v := c.FormValue("temperature"); v != "" {
+		t, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			errs.add(lm.ErrCodeInvalidType, "temperature", "invalid value for temperature: expected a number, got "+v)
+		} else {
+			req.Temperature = float32(t)
+			checkRange(&errs, "temperature", &req.Temperature, 0, 1)
+		}
+	}
+
+	if _, err := state.ParsePriority(req.Priority); err != nil {
+		errs.add(lm.ErrCodeOutOfRange, "priority", err.Error())
+	}
+
+	if len(errs) > 0 {
+		return req, nil, errs
+	}
+
+	file, err := fh.Open()
+	if err != nil {
+		return req, nil, fmt.Errorf("cannot open the audio file: %w", err)
+	}
+	req.File = file
+	req.Filename = fh.Filename
+	return req, file, nil
+}
+
+// TranscriptionsHandler handles the OpenAI /v1/audio/transcriptions requests.
+func (h *Handlers) TranscriptionsHandler(c echo.Context) error {
+	return h.audio(c, false)
+}
+
+// TranslationsHandler handles the OpenAI /v1/audio/translations requests:
+// the audio is transcribed in English.
+func (h *Handlers) TranslationsHandler(c echo.Context) error {
+	return h.audio(c, true)
+}
+
+// audio transcribes the uploaded audio file on the whisper.cpp server of the model.
+func (h *Handlers) audio(c echo.Context, translate bool) error {
+	req, file, err := parseAudioRequest(c, translate)
+	if err != nil {
+		if state.Debug {
+			fmt.Println("Audio parsing error", err)
+		}
+		var fields FieldErrors
+		if errors.As(err, &fields) {
+			return fields
+		}
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+	defer file.Close()
+
+	srv, model, err := h.whisperServer(req.Model)
+	if err != nil {
+		return replyBackendError(c, model, err)
+	}
+
+	return h.runOpenAi(c, model, req.Priority, false, func(sess *state.Session) error {
+		out, err := srv.Transcribe(sess.Context(), req)
+		if err != nil {
+			return err
+		}
+		return c.Blob(http.StatusOK, audioContentTypes[req.ResponseFormat], out)
+	})
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/conf"
+)
+
+// newFakeWhisper starts a fake whisper-server: /inference replies the received
+// form fields in the response format, or an error with a 200 status for an empty file.
+func newFakeWhisper(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/inference" {
+			http.NotFound(w, r)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		audio, _ := io.ReadAll(file)
+		if len(audio) == 0 {
+			fmt.Fprint(w, `{"error":"failed to read audio data"}`)
+			return
+		}
+
+		text := fmt.Sprintf("%s lang=%s translate=%s", audio, r.FormValue("language"), r.FormValue("translate"))
+		if r.FormValue("response_format") == "json" {
+			_ = json.NewEncoder(w).Encode(map[string]string{"text": text})
+			return
+		}
+		fmt.Fprint(w, text)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// postAudio posts a multipart audio request with the file and the form fields.
+func postAudio(e *echo.Echo, path string, file []byte, fields map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if file != nil {
+		part, _ := w.CreateFormFile("file", "speech.wav")
+		_, _ = part.Write(file)
+	}
+	for k, v := range fields {
+		_ = w.WriteField(k, v)
+	}
+	_ = w.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAudioHandlers(t *testing.T) {
+	cfg := conf.GoInferConf{}
+	cfg.Whisper.URL = newFakeWhisper(t).URL
+	e := NewEchoServer(cfg, nil, nil, ":0", "openai")
+
+	rec := postAudio(e, "/v1/audio/transcriptions", []byte("hello"), map[string]string{"language": "fr"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "hello lang=fr translate=false" {
+		t.Errorf("text = %q", res.Text)
+	}
+
+	rec = postAudio(e, "/v1/audio/translations", []byte("hello"), map[string]string{"response_format": "srt"})
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello lang=auto translate=true" {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(ct, "application/x-subrip") {
+		t.Errorf("content type = %s", ct)
+	}
+}
+
+func TestAudioHandlersErrors(t *testing.T) {
+	cfg := conf.GoInferConf{}
+	cfg.Whisper.URL = newFakeWhisper(t).URL
+	e := NewEchoServer(cfg, nil, nil, ":0", "openai")
+
+	tests := []struct {
+		name   string
+		file   []byte
+		fields map[string]string
+		status int
+	}{
+		{"missing file", nil, nil, http.StatusBadRequest},
+		{"response format", []byte("x"), map[string]string{"response_format": "mp3"}, http.StatusBadRequest},
+		{"temperature", []byte("x"), map[string]string{"temperature": "2"}, http.StatusBadRequest},
+		{"whisper error", []byte{}, nil, http.StatusBadRequest},
+		{"too large", bytes.Repeat([]byte("x"), maxAudioSize+2<<20), nil, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postAudio(e, "/v1/audio/transcriptions", tt.file, tt.fields)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/lm"
+	"github.com/synw/goinfer/state"
+)
+
+// ErrorResponse is the body of the error responses of the goinfer and model services.
+type ErrorResponse struct {
+	Error  *lm.InferError   `json:"error"`
+	Errors []*lm.InferError `json:"errors,omitempty"` // the invalid fields of the request
+}
+
+// OpenAiErrorResponse is the body of the error responses of the /v1 routes.
+type OpenAiErrorResponse struct {
+	Error OpenAiError `json:"error"`
+}
+
+// OpenAiError is an error in the OpenAI format.
+type OpenAiError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+// newOpenAiError converts an InferError to the OpenAI format.
+func newOpenAiError(status int, err *lm.InferError, fields ...*lm.InferError) OpenAiError {
+	e := OpenAiError{
+		Message: err.Message,
+		Type:    openAiErrorType(status),
+		Code:    strings.ToLower(err.Code),
+	}
+
+	if len(fields) > 0 {
+		msgs := make([]string, len(fields))
+		for i, f := range fields {
+			msgs[i] = f.Message
+		}
+		e.Message += ": " + strings.Join(msgs, ", ")
+		if param, ok := fields[0].Context.(string); ok {
+			e.Param = &param
+		}
+	}
+
+	return e
+}
+
+// openAiErrorType returns the OpenAI error type of an HTTP status.
+func openAiErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	}
+	return "invalid_request_error"
+}
+
+// errorCode returns the error code of an HTTP status, for the errors without a specific code.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return lm.ErrCodeInvalidParams
+	case http.StatusUnauthorized:
+		return lm.ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return lm.ErrCodeForbidden
+	case http.StatusNotFound:
+		return lm.ErrCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return lm.ErrCodeMethodNotAllowed
+	case http.StatusTooManyRequests:
+		return lm.ErrCodeQueueFull
+	}
+	if status >= http.StatusInternalServerError {
+		return lm.ErrCodeInternal
+	}
+	return fmt.Sprintf("HTTP_%d", status)
+}
+
+// isOpenAiRoute reports whether the request targets the OpenAI API.
+func isOpenAiRoute(c echo.Context) bool {
+	p := c.Request().URL.Path
+	return p == "/v1" || strings.HasPrefix(p, "/v1/")
+}
+
+// replyError writes the error response, in the OpenAI format on the /v1 routes.
+func replyError(c echo.Context, status int, code, message string, context any) error {
+	return replyInferError(c, status, &lm.InferError{Code: code, Message: message, Context: context})
+}
+
+// replyInferError writes the error response, fields lists the invalid fields of the request.
+func replyInferError(c echo.Context, status int, err *lm.InferError, fields ...*lm.InferError) error {
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(status)
+	}
+	if isOpenAiRoute(c) {
+		return c.JSON(status, OpenAiErrorResponse{Error: newOpenAiError(status, err, fields...)})
+	}
+	return c.JSON(status, ErrorResponse{Error: err, Errors: fields})
+}
+
+// HTTPErrorHandler replies the errors returned by the handlers and the middlewares
+// (authentication, binding, routing) with the same error envelope as the handlers.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var fields FieldErrors
+	var httpErr *echo.HTTPError
+	var inferErr *lm.InferError
+
+	switch {
+	case errors.As(err, &fields):
+		err = replyInferError(c, http.StatusBadRequest,
+			&lm.InferError{Code: lm.ErrCodeInvalidParams, Message: "invalid request"}, fields...)
+	case errors.As(err, &httpErr):
+		msg := fmt.Sprint(httpErr.Message)
+		if httpErr.Internal != nil && state.Debug {
+			fmt.Println("HTTP error", httpErr.Code, msg, httpErr.Internal)
+		}
+		err = replyError(c, httpErr.Code, errorCode(httpErr.Code), msg, nil)
+	case errors.As(err, &inferErr):
+		err = replyInferError(c, http.StatusInternalServerError, inferErr)
+	default:
+		err = replyError(c, http.StatusInternalServerError, lm.ErrCodeInternal, err.Error(), nil)
+	}
+
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
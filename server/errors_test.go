@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/lm"
+)
+
+// assertJSON checks that the body is the JSON value want.
+func assertJSON(t *testing.T, name string, body []byte, want string) {
+	t.Helper()
+	var got, expected any
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("%s: invalid JSON %q: %v", name, body, err)
+	}
+	if err := json.Unmarshal([]byte(want), &expected); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("%s:\n got %s\nwant %s", name, body, want)
+	}
+}
+
+func TestHTTPErrorHandlerEcho(t *testing.T) {
+	e := NewEchoServer(conf.GoInferConf{}, nil, nil, ":0", "goinfer openai")
+
+	// the errors of echo, in a test app with a body limit
+	limited := echo.New()
+	limited.HTTPErrorHandler = HTTPErrorHandler
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }
+	limited.POST("/upload", ok, middleware.BodyLimit("1K"))
+	limited.POST("/v1/upload", ok, middleware.BodyLimit("1K"))
+
+	large := strings.Repeat("x", 2048)
+	tests := []struct {
+		name         string
+		e            *echo.Echo
+		method, path string
+		body         string
+		status       int
+		want         string
+	}{
+		{"route not found", e, http.MethodGet, "/nope", "", http.StatusNotFound,
+			`{"error":{"code":"NOT_FOUND","message":"Not Found"}}`},
+		{"method not allowed", e, http.MethodGet, "/tokenize", "", http.StatusMethodNotAllowed,
+			`{"error":{"code":"METHOD_NOT_ALLOWED","message":"Method Not Allowed"}}`},
+		{"body too large", limited, http.MethodPost, "/upload", large, http.StatusRequestEntityTooLarge,
+			`{"error":{"code":"HTTP_413","message":"Request Entity Too Large"}}`},
+		{"OpenAI route not found", e, http.MethodGet, "/v1/nope", "", http.StatusNotFound,
+			`{"error":{"message":"Not Found","type":"invalid_request_error","param":null,"code":"not_found"}}`},
+		{"OpenAI body too large", limited, http.MethodPost, "/v1/upload", large, http.StatusRequestEntityTooLarge,
+			`{"error":{"message":"Request Entity Too Large","type":"invalid_request_error","param":null,"code":"http_413"}}`},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.e.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		assertJSON(t, tt.name, rec.Body.Bytes(), tt.want)
+	}
+}
+
+func TestHTTPErrorHandlerFields(t *testing.T) {
+	e := NewEchoServer(conf.GoInferConf{}, nil, nil, ":0", "goinfer openai")
+
+	rec := postJSON(e, "/completion", `{"foo":1,"temperature":"hot"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+	assertJSON(t, "goinfer", rec.Body.Bytes(), `{
+		"error": {"code": "INVALID_PARAMS", "message": "invalid request"},
+		"errors": [
+			{"code": "UNKNOWN_FIELD", "message": "unknown field foo", "context": "foo"},
+			{"code": "INVALID_TYPE", "message": "invalid value for temperature: got string, expected a number", "context": "temperature"},
+			{"code": "MISSING_FIELD", "message": "missing mandatory field: prompt", "context": "prompt"}
+		]
+	}`)
+
+	// the OpenAI format has a single message and the first invalid field
+	rec = postJSON(e, "/v1/chat/completions", `{"stream":"yes"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+	var res OpenAiErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	got := res.Error
+	if got.Type != "invalid_request_error" || got.Code != "invalid_params" || got.Param == nil || *got.Param != "stream" ||
+		!strings.HasPrefix(got.Message, "invalid request: invalid value for stream") ||
+		!strings.HasSuffix(got.Message, ", missing mandatory field: messages") {
+		t.Errorf("OpenAI error: %s", rec.Body)
+	}
+}
+
+func TestHTTPErrorHandlerErrors(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = HTTPErrorHandler
+	e.GET("/error", func(echo.Context) error { return errors.New("boom") })
+	e.GET("/infer", func(echo.Context) error {
+		return &lm.InferError{Code: lm.ErrCodeInferenceFailed, Message: "failed", Context: "m"}
+	})
+	e.GET("/committed", func(c echo.Context) error {
+		_ = c.String(http.StatusOK, "partial")
+		return errors.New("late")
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/error", http.StatusInternalServerError, `{"error":{"code":"INTERNAL_ERROR","message":"boom"}}`},
+		{"/infer", http.StatusInternalServerError, `{"error":{"code":"INFERENCE_FAILED","message":"failed","context":"m"}}`},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, rec.Code, tt.status)
+		}
+		assertJSON(t, tt.path, rec.Body.Bytes(), tt.want)
+	}
+
+	// the response is committed: left as is
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/committed", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "partial" {
+		t.Errorf("committed response: %d %q", rec.Code, rec.Body)
+	}
+}
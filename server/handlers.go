@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mostlygeek/llama-swap/proxy"
+	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/lm"
+	"github.com/synw/goinfer/models"
+	"github.com/synw/goinfer/state"
+)
+
+// Handlers holds the dependencies of the HTTP handlers.
+type Handlers struct {
+	Cfg      *conf.GoInferConf
+	ProxyMan *SwapProxy      // nil when the llama-swap service is disabled
+	Llama    *lm.Supervisor  // llama-server started by goinfer, nil when llama-swap is enabled
+	Catalog  *models.Catalog // metadata of the model files
+}
+
+// llamaServer returns the llama-server running the model:
+// through llama-swap when enabled, else the llama-server configured in llama.url,
+// else the llama-server started by goinfer.
+func (h *Handlers) llamaServer(model string) (lm.LlamaServer, error) {
+	if h.ProxyMan != nil {
+		if model == "" {
+			return lm.LlamaServer{}, fmt.Errorf("%w: missing model name", errModelNotFound)
+		}
+		px := h.ProxyMan.Config()
+		if _, ok := px.RealModelName(model); !ok {
+			return lm.LlamaServer{}, fmt.Errorf("%w: %s (no entry in the llama-swap config)", errModelNotFound, model)
+		}
+		return lm.ProxyLlamaServer(trackRequests(h.ProxyMan), model), nil
+	}
+
+	if h.Cfg.Llama.URL != "" {
+		return lm.LlamaServer{URL: h.Cfg.Llama.URL}, nil
+	}
+
+	if h.Llama != nil {
+		if srv, ok := h.Llama.Server(); ok {
+			return srv, nil
+		}
+		return lm.LlamaServer{}, fmt.Errorf("llama-server is not ready (%s)", h.Llama.Status().State)
+	}
+
+	return lm.LlamaServer{}, errors.New("no llama-server: enable the llama-swap proxy, set llama.url or llama.model")
+}
+
+// swap returns the llama-swap API, the requests to the models are recorded in state.SwapActivity.
+func (h *Handlers) swap() lm.Swap {
+	return lm.Swap{Handler: trackRequests(h.ProxyMan)}
+}
+
+// proxyConfig returns the llama-swap config, updated when the model files change.
+func (h *Handlers) proxyConfig() proxy.Config {
+	if h.ProxyMan != nil {
+		return h.ProxyMan.Config()
+	}
+	return h.Cfg.Proxy
+}
+
+// errModelNotFound is returned when the requested model is not in the llama-swap config.
+var errModelNotFound = errors.New("model not found")
+
+// goinferLlamaServer returns the llama-server running the model for the goinfer API.
+// With llama-swap, the model is the hidden GI_<name> entry generated by -gen-px-conf.
+func (h *Handlers) goinferLlamaServer(name string) (lm.LlamaServer, error) {
+	if h.ProxyMan == nil {
+		return h.llamaServer(name)
+	}
+
+	if name == "" {
+		return lm.LlamaServer{}, fmt.Errorf("%w: missing model name", errModelNotFound)
+	}
+
+	id, ok := h.goinferModel(name)
+	if !ok {
+		return lm.LlamaServer{}, fmt.Errorf("%w: %s (no hidden GI_ entry in the llama-swap config)", errModelNotFound, name)
+	}
+
+	return h.llamaServer(id)
+}
+
+// goinferModel resolves a model name (file name, stem or GI_ name) to its GI_ llama-swap entry.
+func (h *Handlers) goinferModel(name string) (string, bool) {
+	stem := strings.TrimSuffix(filepath.Base(name), ".gguf")
+	if !strings.HasPrefix(stem, "GI_") {
+		stem = "GI_" + stem
+	}
+
+	px := h.proxyConfig()
+	_, id, found := px.FindConfig(stem)
+	return id, found
+}
+
+// queueKey returns the model name used by the inference queue:
+// the goinfer (GI_) and OpenAI entries of a model file share the same limit.
+func queueKey(model string) string {
+	return strings.TrimPrefix(strings.TrimSuffix(filepath.Base(model), ".gguf"), "GI_")
+}
+
+// queueFull replies 429 Too Many Requests with a Retry-After header.
+func (h *Handlers) queueFull(c echo.Context) error {
+	retryAfter := h.Cfg.Queue.RetryAfter
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return replyError(c, http.StatusTooManyRequests, lm.ErrCodeQueueFull, state.ErrQueueFull.Error(), nil)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/synw/goinfer/types"
+)
+
+// maxImageSize is the maximum size of a decoded image.
+const maxImageSize = 20 << 20
+
+// imageMimeTypes are the image formats decoded by llama-server (no webp).
+var imageMimeTypes = []string{"image/png", "image/jpeg", "image/gif", "image/bmp"}
+
+var errImageTooLarge = fmt.Errorf("the image exceeds %d MiB", maxImageSize>>20)
+
+// imageInput is an image of a request: base64 data, a data URL
+// or an OpenAI image_url content part (with a data URL).
+type imageInput string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (i *imageInput) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*i = imageInput(s)
+		return nil
+	}
+	var part struct {
+		Type     string `json:"type"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+	}
+	err := json.Unmarshal(b, &part)
+	if err != nil || (part.Type != "" && part.Type != "image_url") || part.ImageURL.URL == "" {
+		return errors.New("expected a base64 string, a data URL or an image_url content part")
+	}
+	*i = imageInput(part.ImageURL.URL)
+	return nil
+}
+
+// imageList is an image or an array of images.
+type imageList []imageInput
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (l *imageList) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		var list []imageInput
+		if err := json.Unmarshal(b, &list); err != nil {
+			return err
+		}
+		*l = list
+		return nil
+	}
+	var img imageInput
+	if err := json.Unmarshal(b, &img); err != nil {
+		return err
+	}
+	*l = imageList{img}
+	return nil
+}
+
+// decode returns the image data, its MIME type is detected from the data
+// and must match the one of a data URL.
+func (i imageInput) decode() (types.Image, error) {
+	var img types.Image
+	data := string(i)
+
+	declared := ""
+	if rest, ok := strings.CutPrefix(data, "data:"); ok {
+		header, payload, found := strings.Cut(rest, ",")
+		mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+		if !found || !isBase64 {
+			return img, errors.New("the data URL must be base64 encoded")
+		}
+		declared, _, _ = mime.ParseMediaType(mediaType)
+		if declared == "image/jpg" {
+			declared = "image/jpeg"
+		}
+		data = payload
+	} else if strings.HasPrefix(data, "http://") || strings.HasPrefix(data, "https://") {
+		return img, errors.New("remote image URLs are not supported, send the image data")
+	}
+
+	if base64.StdEncoding.DecodedLen(len(data)) > maxImageSize+2 {
+		return img, errImageTooLarge
+	}
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return img, fmt.Errorf("invalid base64 data: %w", err)
+	}
+	if len(b) > maxImageSize {
+		return img, errImageTooLarge
+	}
+
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(b))
+	if !slices.Contains(imageMimeTypes, detected) {
+		return img, fmt.Errorf("unsupported image type %s, expected %s", detected, strings.Join(imageMimeTypes, ", "))
+	}
+	if declared != "" && declared != detected {
+		return img, fmt.Errorf("the data URL type %s does not match the image data (%s)", declared, detected)
+	}
+
+	img.MimeType = detected
+	img.Data = b
+	return img, nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var (
+	pngData  = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	jpegData = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	webpData = []byte("RIFF\x00\x00\x00\x00WEBPVP8 ")
+)
+
+func b64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestImageInputDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		mime  string
+		data  []byte
+	}{
+		{"raw base64", b64(pngData), "image/png", pngData},
+		{"data URL", "data:image/png;base64," + b64(pngData), "image/png", pngData},
+		{"jpg alias", "data:image/jpg;base64," + b64(jpegData), "image/jpeg", jpegData},
+		{"media type params", "data:image/jpeg;name=a.jpg;base64," + b64(jpegData), "image/jpeg", jpegData},
+	}
+	for _, tt := range tests {
+		img, err := imageInput(tt.input).decode()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if img.MimeType != tt.mime || !bytes.Equal(img.Data, tt.data) {
+			t.Errorf("%s: %s %q", tt.name, img.MimeType, img.Data)
+		}
+	}
+}
+
+func TestImageInputDecodeErrors(t *testing.T) {
+	// one byte too many: rejected after decoding
+	tooLarge := append(slices.Clone(pngData), make([]byte, maxImageSize+1-len(pngData))...)
+
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"not base64", "data:image/png," + b64(pngData), "must be base64 encoded"},
+		{"no payload", "data:image/png;base64", "must be base64 encoded"},
+		{"remote URL", "https://example.com/a.png", "remote image URLs"},
+		{"invalid base64", "iVBOR!!!", "invalid base64 data"},
+		{"not an image", b64([]byte("hello world")), "unsupported image type text/plain"},
+		{"webp", b64(webpData), "unsupported image type image/webp"},
+		{"type mismatch", "data:image/jpeg;base64," + b64(pngData), "does not match the image data (image/png)"},
+		{"too large", b64(tooLarge), errImageTooLarge.Error()},
+		{"too large before decoding", strings.Repeat("A", (maxImageSize+3)/3*4+8), errImageTooLarge.Error()},
+	}
+	for _, tt := range tests {
+		_, err := imageInput(tt.input).decode()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	if _, err := imageInput(b64(tooLarge)).decode(); !errors.Is(err, errImageTooLarge) {
+		t.Errorf("too large: %v is not errImageTooLarge", err)
+	}
+}
+
+func TestImageListUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want imageList
+	}{
+		{"string", `"abc"`, imageList{"abc"}},
+		{"array", `["abc", "def"]`, imageList{"abc", "def"}},
+		{"content part", `{"type":"image_url","image_url":{"url":"data:image/png;base64,abc"}}`, imageList{"data:image/png;base64,abc"}},
+		{"content part without type", `{"image_url":{"url":"abc"}}`, imageList{"abc"}},
+		{"mixed array", `["abc", {"image_url":{"url":"def"}}]`, imageList{"abc", "def"}},
+	}
+	for _, tt := range tests {
+		var got imageList
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{`1`, `{"type":"text","text":"hi"}`, `{"image_url":{}}`, `["abc", 1]`} {
+		var got imageList
+		if err := json.Unmarshal([]byte(invalid), &got); err == nil {
+			t.Errorf("%s: no error", invalid)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"reflect"
+	"slices"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/synw/goinfer/lm"
@@ -12,256 +17,610 @@ import (
 	"github.com/synw/goinfer/types"
 )
 
-// parseInferQuery parses inference parameters from echo.Map using simple type assertions.
-func parseInferQuery(m echo.Map) (types.InferQuery, error) {
-	var errs []error
-	
-	query := types.InferQuery{
-		Prompt:      "",
-		ModelParams: types.DefaultModelConf,
-		InferParams: types.DefaultInferParams,
+// HeaderInferenceID is the response header providing the ID used to abort the inference.
+const HeaderInferenceID = "X-Inference-Id"
+
+// inferRequest is the payload of a /completion request.
+// The optional fields are pointers: nil keeps the default value.
+type inferRequest struct {
+	Prompt           *string   `json:"prompt"`
+	Model            string    `json:"model"`
+	Ctx              *int      `json:"ctx"`
+	Stream           bool      `json:"stream"`
+	MaxTokens        *int      `json:"max_tokens"`
+	TopK             *int      `json:"top_k"`
+	TopP             *float32  `json:"top_p"`
+	MinP             *float32  `json:"min_p"`
+	Temperature      *float32  `json:"temperature"`
+	FrequencyPenalty *float32  `json:"frequency_penalty"`
+	PresencePenalty  *float32  `json:"presence_penalty"`
+	RepeatPenalty    *float32  `json:"repeat_penalty"`
+	Tfs              *float32  `json:"tfs"`
+	Stop             *[]string `json:"stop"`
+	Images           imageList `json:"images"`
+	Audios           []byte    `json:"audios"` // base64 in JSON
+	Priority         string    `json:"priority"`
+	CtxCheck         string    `json:"ctx_check"` // reject or truncate the prompts exceeding the context
+	StripReasoning   bool      `json:"strip_reasoning"`
+
+	images []types.Image // decoded by validate
+}
+
+// The ctx_check modes.
+const (
+	ctxReject   = "reject"
+	ctxTruncate = "truncate"
+)
+
+// fields maps the JSON field names to the struct fields.
+func (r *inferRequest) fields() map[string]any {
+	return map[string]any{
+		"prompt":            &r.Prompt,
+		"model":             &r.Model,
+		"ctx":               &r.Ctx,
+		"stream":            &r.Stream,
+		"max_tokens":        &r.MaxTokens,
+		"top_k":             &r.TopK,
+		"top_p":             &r.TopP,
+		"min_p":             &r.MinP,
+		"temperature":       &r.Temperature,
+		"frequency_penalty": &r.FrequencyPenalty,
+		"presence_penalty":  &r.PresencePenalty,
+		"repeat_penalty":    &r.RepeatPenalty,
+		"tfs":               &r.Tfs,
+		"stop":              &r.Stop,
+		"images":            &r.Images,
+		"audios":            &r.Audios,
+		"priority":          &r.Priority,
+		"ctx_check":         &r.CtxCheck,
+		"strip_reasoning":   &r.StripReasoning,
 	}
+}
 
-	// Parse prompt (required)
-	if v, ok := m["prompt"]; ok {
-		if prompt, ok := v.(string); ok {
-			query.Prompt = prompt
-		} else {
-			errs = append(errs, errors.New("field prompt must be a string"))
-		}
-	} else {
-		errs = append(errs, errors.New("missing mandatory field: prompt"))
+// FieldErrors lists the invalid fields of a request.
+type FieldErrors []*lm.InferError
+
+// Error implements the error interface.
+func (e FieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
 	}
+	return strings.Join(msgs, "\n")
+}
 
-	// Parse model parameters
-	if v, ok := m["model"]; ok {
-		if name, ok := v.(string); ok {
-			query.ModelParams.Name = name
-		}
+// add appends an error about a field.
+func (e *FieldErrors) add(code, field, message string) {
+	*e = append(*e, &lm.InferError{Code: code, Message: message, Context: field})
+}
+
+// has reports whether a field has already an error.
+func (e FieldErrors) has(field string) bool {
+	return slices.ContainsFunc(e, func(err *lm.InferError) bool { return err.Context == field })
+}
+
+// decodeFields decodes a JSON object into the fields of the request, field by field
+// to report every unknown field and every invalid value.
+// The error is not nil when the body is not a JSON object.
+func decodeFields(body io.Reader, fields map[string]any) (FieldErrors, error) {
+	var errs FieldErrors
+
+	raw := map[string]json.RawMessage{}
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("the request body must be a JSON object: %w", err)
 	}
 
-	if v, ok := m["ctx"]; ok {
-		if ctx, ok := v.(int); ok {
-			query.ModelParams.Ctx = ctx
-		}
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
 	}
+	slices.Sort(names)
 
-	// Parse inference parameters
-	if v, ok := m["stream"]; ok {
-		if stream, ok := v.(bool); ok {
-			query.InferParams.Stream = stream
+	for _, name := range names {
+		dst, ok := fields[name]
+		if !ok {
+			errs.add(lm.ErrCodeUnknownField, name, "unknown field "+name)
+			continue
+		}
+		// decode in a new value: a failed decoding must keep the field unset
+		v := reflect.New(reflect.TypeOf(dst).Elem())
+		if err := json.Unmarshal(raw[name], v.Interface()); err != nil {
+			errs.add(lm.ErrCodeInvalidType, name, fmt.Sprintf("invalid value for %s: %s", name, typeErrorMessage(err)))
+			continue
 		}
+		reflect.ValueOf(dst).Elem().Set(v.Elem())
 	}
 
-	if v, ok := m["temperature"]; ok {
-		if temp, ok := v.(float64); ok {
-			query.InferParams.Temperature = float32(temp)
-		}
+	return errs, nil
+}
+
+// typeErrorMessage returns a short message for a JSON decoding error.
+func typeErrorMessage(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Sprintf("got %s, expected %s", typeErr.Value, jsonTypeName(typeErr.Type))
 	}
+	return err.Error()
+}
 
-	if v, ok := m["min_p"]; ok {
-		if minP, ok := v.(float64); ok {
-			query.InferParams.MinP = float32(minP)
+// jsonTypeName names the expected JSON type of a Go type.
+func jsonTypeName(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "a base64 string"
 		}
+		return "an array"
 	}
+	return t.String()
+}
 
-	if v, ok := m["top_p"]; ok {
-		if topP, ok := v.(float64); ok {
-			query.InferParams.TopP = float32(topP)
-		}
+// checkRange reports a value outside [lo, hi].
+func checkRange[T int | float32](errs *FieldErrors, field string, v *T, lo, hi T) {
+	if v != nil && (*v < lo || *v > hi) {
+		errs.add(lm.ErrCodeOutOfRange, field, fmt.Sprintf("%s must be between %v and %v, got %v", field, lo, hi, *v))
 	}
+}
 
-	if v, ok := m["top_k"]; ok {
-		if topK, ok := v.(int); ok {
-			query.InferParams.TopK = topK
-		}
+// checkMin reports a value below lo.
+func checkMin[T int | float32](errs *FieldErrors, field string, v *T, lo T) {
+	if v != nil && *v < lo {
+		errs.add(lm.ErrCodeOutOfRange, field, fmt.Sprintf("%s must be at least %v, got %v", field, lo, *v))
 	}
+}
 
-	if v, ok := m["max_tokens"]; ok {
-		if maxTokens, ok := v.(int); ok {
-			query.InferParams.MaxTokens = maxTokens
-		}
+// validate checks the mandatory fields and the value ranges.
+func (r *inferRequest) validate() FieldErrors {
+	var errs FieldErrors
+
+	if r.Prompt == nil {
+		errs.add(lm.ErrCodeMissingField, "prompt", "missing mandatory field: prompt")
 	}
 
-	if v, ok := m["presence_penalty"]; ok {
-		if penalty, ok := v.(float64); ok {
-			query.InferParams.PresencePenalty = float32(penalty)
-		}
+	checkMin(&errs, "ctx", r.Ctx, 1)
+	checkMin(&errs, "max_tokens", r.MaxTokens, 1)
+	checkMin(&errs, "top_k", r.TopK, 0)
+	checkRange(&errs, "top_p", r.TopP, 0, 1)
+	checkRange(&errs, "min_p", r.MinP, 0, 1)
+	checkRange(&errs, "temperature", r.Temperature, 0, 2)
+	checkRange(&errs, "frequency_penalty", r.FrequencyPenalty, -2, 2)
+	checkRange(&errs, "presence_penalty", r.PresencePenalty, -2, 2)
+	checkMin(&errs, "repeat_penalty", r.RepeatPenalty, 0)
+	checkRange(&errs, "tfs", r.Tfs, 0, 1)
+
+	if _, err := state.ParsePriority(r.Priority); err != nil {
+		errs.add(lm.ErrCodeOutOfRange, "priority", err.Error())
+	}
+	if r.CtxCheck != "" && r.CtxCheck != ctxReject && r.CtxCheck != ctxTruncate {
+		errs.add(lm.ErrCodeOutOfRange, "ctx_check", "ctx_check must be reject or truncate, got "+r.CtxCheck)
 	}
 
-	if v, ok := m["frequency_penalty"]; ok {
-		if penalty, ok := v.(float64); ok {
-			query.InferParams.FrequencyPenalty = float32(penalty)
+	r.images = nil
+	for i, input := range r.Images {
+		img, err := input.decode()
+		if err != nil {
+			code := lm.ErrCodeInvalidType
+			if errors.Is(err, errImageTooLarge) {
+				code = lm.ErrCodeOutOfRange
+			}
+			errs.add(code, "images", fmt.Sprintf("invalid image %d: %s", i, err))
+			continue
 		}
+		r.images = append(r.images, img)
 	}
 
-	if v, ok := m["repeat_penalty"]; ok {
-		if penalty, ok := v.(float64); ok {
-			query.InferParams.RepeatPenalty = float32(penalty)
-		}
+	return errs
+}
+
+// query converts the request to an inference query, the missing fields take the default values.
+func (r *inferRequest) query() types.InferQuery {
+	query := types.InferQuery{
+		ModelParams: types.DefaultModelConf,
+		InferParams: types.DefaultInferParams,
+		Priority:    r.Priority,
 	}
 
-	if v, ok := m["tfs"]; ok {
-		if tfs, ok := v.(float64); ok {
-			query.InferParams.TailFreeSamplingZ = float32(tfs)
+	setIf := func(dst *float32, v *float32) {
+		if v != nil {
+			*dst = *v
 		}
 	}
 
-	// Parse stop prompts (special case for slice)
-	if v, ok := m["stop"]; ok {
-		if stopSlice, ok := v.([]any); ok {
-			if len(stopSlice) > 0 {
-				query.InferParams.StopPrompts = make([]string, len(stopSlice))
-				for i, val := range stopSlice {
-					query.InferParams.StopPrompts[i] = fmt.Sprint(val)
-				}
-			}
-		} else {
-			errs = append(errs, errors.New("field stop must be an array"))
+	if r.Prompt != nil {
+		query.Prompt = *r.Prompt
+	}
+	query.ModelParams.Name = r.Model
+	if r.Ctx != nil {
+		query.ModelParams.Ctx = *r.Ctx
+	}
+
+	p := &query.InferParams
+	p.Stream = r.Stream
+	if r.MaxTokens != nil {
+		p.MaxTokens = *r.MaxTokens
+	}
+	if r.TopK != nil {
+		p.TopK = *r.TopK
+	}
+	setIf(&p.TopP, r.TopP)
+	setIf(&p.MinP, r.MinP)
+	setIf(&p.Temperature, r.Temperature)
+	setIf(&p.FrequencyPenalty, r.FrequencyPenalty)
+	setIf(&p.PresencePenalty, r.PresencePenalty)
+	setIf(&p.RepeatPenalty, r.RepeatPenalty)
+	setIf(&p.TailFreeSamplingZ, r.Tfs)
+	if r.Stop != nil {
+		p.StopPrompts = *r.Stop
+	}
+	p.Images = r.images
+	p.Audios = r.Audios
+	p.StripReasoning = r.StripReasoning
+
+	return query
+}
+
+// parseInferRequest decodes and validates a /completion request.
+// The returned error is a FieldErrors listing every invalid field,
+// unless the body is not a JSON object.
+func parseInferRequest(body io.Reader) (*inferRequest, error) {
+	var req inferRequest
+
+	errs, err := decodeFields(body, req.fields())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, err := range req.validate() {
+		if field, _ := err.Context.(string); !errs.has(field) {
+			errs = append(errs, err)
 		}
 	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
 
-	// Parse images (special case for byte array)
-	if v, ok := m["images"]; ok {
-		if slice, ok := v.([]any); ok {
-			if len(slice) > 0 {
-				query.InferParams.Images = make([]byte, len(slice))
-				for i, val := range slice {
-					if byteVal, ok := val.(byte); ok {
-						query.InferParams.Images[i] = byteVal
-					} else {
-						errs = append(errs, fmt.Errorf("invalid byte value in images array at index %d", i))
-					}
-				}
-			}
-		} else {
-			errs = append(errs, errors.New("field images must be an array"))
+	return &req, nil
+}
+
+// InferHandler handles inference requests.
+func (h *Handlers) InferHandler(c echo.Context) error {
+	req, err := parseInferRequest(c.Request().Body)
+	if err != nil {
+		if state.Debug {
+			fmt.Println("Inference params parsing error", err)
+		}
+		var fields FieldErrors
+		if errors.As(err, &fields) {
+			return fields
 		}
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
 	}
 
-	// Parse audios (special case for byte array)
-	if v, ok := m["audios"]; ok {
-		if slice, ok := v.([]any); ok {
-			if len(slice) > 0 {
-				query.InferParams.Audios = make([]byte, len(slice))
-				for i, val := range slice {
-					if byteVal, ok := val.(byte); ok {
-						query.InferParams.Audios[i] = byteVal
-					} else {
-						errs = append(errs, fmt.Errorf("invalid byte value in audios array at index %d", i))
-					}
-				}
-			}
-		} else {
-			errs = append(errs, errors.New("field audios must be an array"))
+	query := req.query()
+	if req.CtxCheck != "" {
+		ctx := 0
+		if req.Ctx != nil {
+			ctx = *req.Ctx
+		}
+		err := h.fitContext(c.Request().Context(), &query, req.CtxCheck, ctx)
+		if err != nil {
+			return replyBackendError(c, query.ModelParams.Name, err)
 		}
 	}
 
-	// If there are any errors, return them all joined
-	if len(errs) > 0 {
-		return query, errors.Join(errs...)
+	return h.infer(c, query)
+}
+
+// fitContext checks that the prompt tokens plus max_tokens fit in the context: the context
+// of a llama-server slot, or ctx when smaller. In truncate mode the beginning of the prompt
+// is removed, else an InferError CONTEXT_EXCEEDED is returned.
+func (h *Handlers) fitContext(ctx context.Context, query *types.InferQuery, mode string, maxCtx int) error {
+	srv, err := h.goinferLlamaServer(query.ModelParams.Name)
+	if err != nil {
+		return err
+	}
+
+	nctx, err := srv.ContextSize(ctx)
+	if err != nil {
+		return err
+	}
+	if maxCtx > 0 && maxCtx < nctx {
+		nctx = maxCtx
+	}
+
+	tokens, err := srv.Tokenize(ctx, query.Prompt, true)
+	if err != nil {
+		return err
+	}
+
+	maxTokens := query.InferParams.MaxTokens
+	if len(tokens)+maxTokens <= nctx {
+		return nil
+	}
+
+	exceeded := &lm.InferError{
+		Code: lm.ErrCodeContextExceeded,
+		Message: fmt.Sprintf("the prompt (%d tokens) plus max_tokens (%d) exceed the context size (%d)",
+			len(tokens), maxTokens, nctx),
+		Context: map[string]int{"prompt_tokens": len(tokens), "max_tokens": maxTokens, "ctx": nctx},
+	}
+	if mode != ctxTruncate {
+		return exceeded
+	}
+
+	// the special tokens (BOS...) are added again by llama-server
+	text, err := srv.Tokenize(ctx, query.Prompt, false)
+	if err != nil {
+		return err
+	}
+	keep := nctx - maxTokens - (len(tokens) - len(text))
+	if keep <= 0 {
+		return exceeded
 	}
 
-	return query, nil
+	prompt, err := srv.Detokenize(ctx, text[len(text)-keep:])
+	if err != nil {
+		return err
+	}
+	if state.Verbose {
+		fmt.Printf("Prompt truncated from %d to %d tokens\n", len(text), keep)
+	}
+	query.Prompt = prompt
+	return nil
 }
 
-// InferHandler handles inference requests.
-func InferHandler(c echo.Context) error {
-	if state.IsInferring {
-		fmt.Println("An inference query is already running")
-		return c.NoContent(http.StatusAccepted)
+// replyBackendError replies to an error of the llama-server of the model.
+func replyBackendError(c echo.Context, model string, err error) error {
+	if state.Debug {
+		fmt.Println("Inference backend error", err)
 	}
 
-	m := echo.Map{}
-	if err := c.Bind(&m); err != nil {
-		if state.Debug {
-			fmt.Println("Inference params decoding error", err)
+	var inferErr *lm.InferError
+	var upErr *lm.UpstreamError
+	switch {
+	case errors.As(err, &inferErr) && inferErr.Code == lm.ErrCodeContextExceeded:
+		return replyInferError(c, http.StatusBadRequest, inferErr)
+	case errors.Is(err, errModelNotFound):
+		return replyError(c, http.StatusNotFound, lm.ErrCodeModelNotFound, err.Error(), model)
+	case errors.As(err, &upErr) && upErr.StatusCode < http.StatusInternalServerError:
+		return replyError(c, upErr.StatusCode, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+	return replyError(c, http.StatusInternalServerError, lm.ErrCodeBackend, err.Error(), nil)
+}
+
+// infillRequest is the payload of an /infill request: a /completion request
+// with the text around the completion instead of the prompt.
+type infillRequest struct {
+	inferRequest
+	Prefix *string            `json:"prefix"`
+	Suffix *string            `json:"suffix"`
+	Extra  []types.InfillFile `json:"extra"`
+}
+
+// fields maps the JSON field names to the struct fields.
+func (r *infillRequest) fields() map[string]any {
+	fields := r.inferRequest.fields()
+	delete(fields, "prompt")
+	delete(fields, "images")
+	delete(fields, "audios")
+	delete(fields, "ctx_check")
+	delete(fields, "strip_reasoning")
+	fields["prefix"] = &r.Prefix
+	fields["suffix"] = &r.Suffix
+	fields["extra"] = &r.Extra
+	return fields
+}
+
+// validate checks the mandatory fields and the value ranges.
+func (r *infillRequest) validate() FieldErrors {
+	prefix := ""
+	if r.Prefix != nil {
+		prefix = *r.Prefix
+	}
+	r.Prompt = &prefix
+	errs := r.inferRequest.validate()
+
+	if r.Prefix == nil && r.Suffix == nil {
+		errs.add(lm.ErrCodeMissingField, "prefix", "missing mandatory field: prefix or suffix")
+	}
+	for i, f := range r.Extra {
+		if f.Text == "" {
+			errs.add(lm.ErrCodeInvalidParams, "extra", fmt.Sprintf("extra[%d].text must not be empty", i))
+			break
+		}
+	}
+
+	return errs
+}
+
+// query converts the request to a fill-in-the-middle query.
+func (r *infillRequest) query() types.InferQuery {
+	query := r.inferRequest.query()
+	query.Infill = &types.Infill{Extra: r.Extra}
+	if r.Suffix != nil {
+		query.Infill.Suffix = *r.Suffix
+	}
+	return query
+}
+
+// parseInfillQuery decodes and validates an /infill request.
+// The returned error is a FieldErrors listing every invalid field,
+// unless the body is not a JSON object.
+func parseInfillQuery(body io.Reader) (types.InferQuery, error) {
+	var req infillRequest
+
+	errs, err := decodeFields(body, req.fields())
+	if err != nil {
+		return types.InferQuery{}, err
+	}
+
+	for _, err := range req.validate() {
+		if field, _ := err.Context.(string); !errs.has(field) {
+			errs = append(errs, err)
 		}
-		return c.NoContent(http.StatusBadRequest)
 	}
+	if len(errs) > 0 {
+		return types.InferQuery{}, errs
+	}
+
+	return req.query(), nil
+}
 
-	query, err := parseInferQuery(m)
+// InfillHandler handles the fill-in-the-middle requests, run on the llama-server /infill endpoint.
+func (h *Handlers) InfillHandler(c echo.Context) error {
+	query, err := parseInfillQuery(c.Request().Body)
 	if err != nil {
 		if state.Debug {
-			fmt.Println("Inference params parsing error", err)
+			fmt.Println("Infill params parsing error", err)
+		}
+		var fields FieldErrors
+		if errors.As(err, &fields) {
+			return fields
 		}
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	// // Do we need to start/restart llama-server?
-	// if state.IsStartNeeded(query.ModelParams) {
-	// 	err := state.RestartLlamaServer(query.ModelParams)
-	// 	if err != nil {
-	// 		if state.IsDebug {
-	// 			fmt.Println("Error loading model:", err)
-	// 		}
-	// 		return c.JSON(
-	// 			http.StatusInternalServerError,
-	// 			echo.Map{"error": "failed to load model" + err.Error()},
-	// 		)
-	// 	}
-	// }
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+
+	return h.infer(c, query)
+}
+
+// infer runs the inference on the llama-server of the model, once admitted by the queue.
+func (h *Handlers) infer(c echo.Context, query types.InferQuery) error {
+	srv, err := h.goinferLlamaServer(query.ModelParams.Name)
+	if err != nil {
+		return replyBackendError(c, query.ModelParams.Name, err)
+	}
+
+	priority, _ := state.ParsePriority(query.Priority)
+	ticket, err := state.InferenceQueue.Enqueue(queueKey(query.ModelParams.Name), priority)
+	if err != nil {
+		return h.queueFull(c)
+	}
+	defer ticket.Release()
+
+	sess := state.Inferences.Start(c.Request().Context(), query.ModelParams.Name)
+	status := state.StatusFailed
+	defer func() { state.Inferences.Finish(sess, status) }()
+
+	c.Response().Header().Set(HeaderInferenceID, sess.ID)
 
 	if query.InferParams.Stream {
 		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		c.Response().WriteHeader(http.StatusOK)
 	}
 
-	ch := make(chan types.StreamedMessage)
-	errCh := make(chan types.StreamedMessage)
+	err = ticket.Wait(sess.Context(), func(position int) {
+		if !query.InferParams.Stream {
+			return
+		}
+		msg := lm.StreamSystemMessage("queued", 0, map[string]any{"inference_id": sess.ID, "position": position})
+		err := lm.StreamMsg(msg, c, json.NewEncoder(c.Response()))
+		if err != nil && state.Debug {
+			fmt.Println("Streaming error", err)
+		}
+	})
+	if err != nil {
+		return abortedWhileQueued(c, query.InferParams.Stream)
+	}
 
-	defer close(ch)
-	defer close(errCh)
+	// buffered: lm.Infer sends exactly one message and never blocks
+	ch := make(chan types.StreamedMessage, 1)
+	errCh := make(chan types.StreamedMessage, 1)
 
-	go lm.Infer(query, c, ch, errCh)
+	go lm.Infer(query, srv, sess, c, ch, errCh)
 
 	select {
-	case res, ok := <-ch:
-		if ok {
-			if state.Verbose {
-				fmt.Println("-------- result ----------")
-				for key, value := range res.Data {
-					fmt.Printf("%s: %v\n", key, value)
-				}
-				fmt.Println("--------------------------")
-			}
-			if !query.InferParams.Stream {
-				return c.JSON(http.StatusOK, res.Data)
+	case res := <-ch:
+		status = state.StatusDone
+		if state.Verbose {
+			fmt.Println("-------- result ----------")
+			for key, value := range res.Data {
+				fmt.Printf("%s: %v\n", key, value)
 			}
+			fmt.Println("--------------------------")
+		}
+		if !query.InferParams.Stream {
+			return c.JSON(http.StatusOK, res.Data)
 		}
 		return nil
-	case err, ok := <-errCh:
-		if ok {
-			if query.InferParams.Stream {
-				enc := json.NewEncoder(c.Response())
-				err := lm.StreamMsg(&err, c, enc)
-				if err != nil {
-					if state.Debug {
-						fmt.Println("Streaming error", err)
-					}
-					return c.JSON(http.StatusInternalServerError, echo.Map{"error": err})
+	case msg := <-errCh:
+		if c.Request().Context().Err() != nil {
+			return replyCanceled(c, msg.Content)
+		}
+		if query.InferParams.Stream {
+			enc := json.NewEncoder(c.Response())
+			err := lm.StreamMsg(&msg, c, enc)
+			if err != nil {
+				if state.Debug {
+					fmt.Println("Streaming error", err)
 				}
-			} else {
-				return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Content})
+				return nil // the response is committed
 			}
+			return nil
 		}
+		if sess.Aborted() {
+			return replyError(c, http.StatusConflict, lm.ErrCodeInferenceAborted, msg.Content, nil)
+		}
+		return replyError(c, http.StatusInternalServerError, lm.ErrCodeInferenceFailed, msg.Content, nil)
+	}
+}
+
+// abortedWhileQueued replies to a request aborted (or canceled by the client) while waiting in the queue.
+func abortedWhileQueued(c echo.Context, stream bool) error {
+	if c.Request().Context().Err() != nil {
+		return replyCanceled(c, "while queued")
+	}
+	if stream {
+		msg := lm.StreamErrorMessage("inference aborted", 0)
+		return lm.StreamMsg(msg, c, json.NewEncoder(c.Response()))
+	}
+	return replyError(c, http.StatusConflict, lm.ErrCodeInferenceAborted, "inference aborted", nil)
+}
+
+// replyCanceled replies to a request canceled by the client,
+// a streamed response is already committed.
+func replyCanceled(c echo.Context, reason string) error {
+	if state.Verbose {
+		fmt.Println("\nRequest canceled:", reason)
+	}
+	if c.Response().Committed {
 		return nil
-	case <-c.Request().Context().Done():
-		fmt.Println("\nRequest canceled")
-		state.ContinueInferringController = false
-		return c.NoContent(http.StatusNoContent)
 	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// AbortInferenceHandler aborts one running inference, the llama-server generation is also stopped.
+func (h *Handlers) AbortInferenceHandler(c echo.Context) error {
+	id := c.Param("id")
+	sess, ok := state.Inferences.Get(id)
+	if !ok || !sess.Abort() {
+		return replyError(c, http.StatusNotFound, lm.ErrCodeNotFound, "no running inference with id "+id, id)
+	}
+	if state.Verbose {
+		fmt.Println("Aborted inference", id)
+	}
+	return c.NoContent(http.StatusNoContent)
 }
 
-// AbortLlamaHandler aborts ongoing inference.
-func AbortLlamaHandler(c echo.Context) error {
-	if !state.IsInferring {
+// AbortLlamaHandler aborts all the running inferences.
+func (h *Handlers) AbortLlamaHandler(c echo.Context) error {
+	n := state.Inferences.AbortAll()
+	if n == 0 {
 		fmt.Println("No inference running, nothing to abort")
 		return c.NoContent(http.StatusAccepted)
 	}
 	if state.Verbose {
-		fmt.Println("Aborting inference")
+		fmt.Println("Aborted", n, "inferences")
 	}
-	state.ContinueInferringController = false
 	return c.NoContent(http.StatusNoContent)
 }
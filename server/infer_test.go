@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/state"
+)
+
+// newFakeLlama starts a fake llama-server streaming the tokens on /completion.
+func newFakeLlama(t *testing.T, tokens ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path != "/completion" && r.URL.Path != "/infill" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set(echo.HeaderContentType, "text/event-stream")
+		for _, tok := range tokens {
+			fmt.Fprintf(w, "data: {\"content\":%q,\"stop\":false}\n\n", tok)
+		}
+		fmt.Fprint(w, `data: {"content":"","stop":true,"tokens_evaluated":5,`+
+			`"timings":{"cache_n":2,"prompt_n":3,"prompt_ms":10,"predicted_n":2,"predicted_ms":20}}`+"\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newBlockingLlama starts a fake llama-server streaming a token on /completion,
+// then waiting until the request is canceled. started receives the requests.
+func newBlockingLlama(t *testing.T) (srv *httptest.Server, started <-chan struct{}) {
+	t.Helper()
+	ch := make(chan struct{}, 8)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set(echo.HeaderContentType, "text/event-stream")
+		fmt.Fprint(w, "data: {\"content\":\"x\",\"stop\":false}\n\n")
+		w.(http.Flusher).Flush()
+		ch <- struct{}{}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, ch
+}
+
+// newTestServer returns the goinfer service using the llama-server at url.
+func newTestServer(url string) *echo.Echo {
+	cfg := conf.GoInferConf{}
+	cfg.Llama.URL = url
+	return NewEchoServer(cfg, nil, nil, ":0", "goinfer")
+}
+
+func postJSON(e *echo.Echo, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestInferHandler(t *testing.T) {
+	e := newTestServer(newFakeLlama(t, "Hello", " world").URL)
+
+	rec := postJSON(e, "/completion", `{"prompt":"Say hello"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		Text  string         `json:"text"`
+		Stats map[string]any `json:"stats"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "Hello world" {
+		t.Errorf("text = %q, want %q", res.Text, "Hello world")
+	}
+	if res.Stats["promptTokens"] != 5.0 || res.Stats["cachedTokens"] != 2.0 {
+		t.Errorf("stats = %v", res.Stats)
+	}
+	if rec.Header().Get(HeaderInferenceID) == "" {
+		t.Error("missing inference ID header")
+	}
+}
+
+func TestInferHandlerStream(t *testing.T) {
+	e := newTestServer(newFakeLlama(t, "Hello", " world").URL)
+
+	rec := postJSON(e, "/completion", `{"prompt":"Say hello","stream":true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var types, tokens []string
+	for line := range strings.Lines(rec.Body.String()) {
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var msg struct {
+			Content string `json:"content"`
+			MsgType string `json:"msg_type"`
+		}
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			t.Fatalf("invalid message %q: %v", data, err)
+		}
+		types = append(types, msg.MsgType)
+		if msg.MsgType == "token" {
+			tokens = append(tokens, msg.Content)
+		}
+	}
+
+	if strings.Join(tokens, "") != "Hello world" {
+		t.Errorf("tokens = %q", tokens)
+	}
+	if len(types) == 0 || types[len(types)-1] != "system" {
+		t.Errorf("the last message must be the result, got %v", types)
+	}
+}
+
+func TestInferHandlerErrors(t *testing.T) {
+	e := newTestServer(newFakeLlama(t, "x").URL)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"missing prompt", `{}`, http.StatusBadRequest},
+		{"out of range", `{"prompt":"x","temperature":5}`, http.StatusBadRequest},
+		{"unknown field", `{"prompt":"x","foo":1}`, http.StatusBadRequest},
+		{"not an object", `[]`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postJSON(e, "/completion", tt.body)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestInferHandlerBackendDown(t *testing.T) {
+	down := newFakeLlama(t)
+	down.Close()
+	e := newTestServer(down.URL)
+
+	rec := postJSON(e, "/completion", `{"prompt":"x"}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500: %s", rec.Code, rec.Body)
+	}
+
+	// the streamed response is committed: the error is the last message
+	rec = postJSON(e, "/completion", `{"prompt":"x","stream":true}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"msg_type":"error"`) {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// startInference posts the request in the background, the response is sent to the returned channel.
+func startInference(e *echo.Echo, body string) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- postJSON(e, "/completion", body) }()
+	return done
+}
+
+// waitInferences waits until n inferences are running.
+func waitInferences(t *testing.T, n int) []state.SessionInfo {
+	t.Helper()
+	for range 500 {
+		if list := state.Inferences.List(); len(list) == n {
+			return list
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d inferences running, want %d", state.Inferences.Count(), n)
+	return nil
+}
+
+func TestAbortInferenceHandler(t *testing.T) {
+	llama, started := newBlockingLlama(t)
+	e := newTestServer(llama.URL)
+
+	done := startInference(e, `{"prompt":"x"}`)
+	<-started
+	id := waitInferences(t, 1)[0].ID
+
+	if rec := postJSON(e, "/completion/unknown/abort", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown id: status %d, want 404", rec.Code)
+	}
+	if rec := postJSON(e, "/completion/"+id+"/abort", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("abort: status %d, want 204: %s", rec.Code, rec.Body)
+	}
+
+	rec := <-done
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), `"code":"INFERENCE_ABORTED"`) {
+		t.Errorf("aborted inference: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := postJSON(e, "/completion/"+id+"/abort", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("finished inference: status %d, want 404", rec.Code)
+	}
+}
+
+func TestAbortLlamaHandler(t *testing.T) {
+	llama, started := newBlockingLlama(t)
+	e := newTestServer(llama.URL)
+
+	abortAll := func() int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/completion/abort", nil))
+		return rec.Code
+	}
+	if code := abortAll(); code != http.StatusAccepted {
+		t.Errorf("nothing to abort: status %d, want 202", code)
+	}
+
+	// the second inference may wait in the queue
+	first := startInference(e, `{"prompt":"x"}`)
+	second := startInference(e, `{"prompt":"x","stream":true}`)
+	<-started
+	waitInferences(t, 2)
+
+	if code := abortAll(); code != http.StatusNoContent {
+		t.Errorf("abort: status %d, want 204", code)
+	}
+	if rec := <-first; rec.Code != http.StatusConflict {
+		t.Errorf("first inference: status %d, want 409: %s", rec.Code, rec.Body)
+	}
+	if rec := <-second; !strings.Contains(rec.Body.String(), "inference aborted") {
+		t.Errorf("streamed inference: status %d: %s", rec.Code, rec.Body)
+	}
+	waitInferences(t, 0)
+}
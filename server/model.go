@@ -0,0 +1,241 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/lm"
+	"github.com/synw/goinfer/state"
+)
+
+// startModelRequest is the payload of a /model/start request.
+type startModelRequest struct {
+	Model string `json:"model"`
+	Ctx   *int   `json:"ctx"` // only for the llama-server started by goinfer
+}
+
+// StartModelHandler loads a model: 204 when loaded, 202 when already loaded,
+// 404 when the model is unknown and 500 when the model fails to load.
+func (h *Handlers) StartModelHandler(c echo.Context) error {
+	var req startModelRequest
+	errs, err := decodeFields(c.Request().Body, map[string]any{
+		"model": &req.Model,
+		"ctx":   &req.Ctx,
+	})
+	if err != nil {
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+	if req.Model == "" && !errs.has("model") {
+		errs.add(lm.ErrCodeMissingField, "model", "missing mandatory field: model")
+	}
+	checkMin(&errs, "ctx", req.Ctx, 1)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	switch {
+	case h.ProxyMan != nil:
+		return h.startSwapModel(c, req)
+	case h.Llama != nil:
+		return h.startLlamaModel(c, req)
+	}
+	return replyError(c, http.StatusInternalServerError, lm.ErrCodeBackend,
+		"goinfer does not manage the models: enable the llama-swap proxy or unset llama.url", nil)
+}
+
+// startSwapModel loads the model with llama-swap, the GI_ entry first.
+func (h *Handlers) startSwapModel(c echo.Context, req startModelRequest) error {
+	id, ok := h.goinferModel(req.Model)
+	if !ok {
+		px := h.proxyConfig()
+		_, id, ok = px.FindConfig(req.Model)
+	}
+	if !ok {
+		return replyError(c, http.StatusNotFound, lm.ErrCodeModelNotFound, "model not found: "+req.Model, req.Model)
+	}
+
+	if req.Ctx != nil && state.Verbose {
+		fmt.Println("WARNING ctx is ignored: the llama-swap config sets the llama-server args of", id)
+	}
+
+	sw := h.swap()
+	ready, err := sw.IsReady(c.Request().Context(), id)
+	if err != nil {
+		return replyError(c, http.StatusInternalServerError, lm.ErrCodeBackend, err.Error(), id)
+	}
+	if ready {
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	err = sw.Load(c.Request().Context(), id)
+	if err != nil {
+		return replyError(c, http.StatusInternalServerError, lm.ErrCodeModelNotLoaded, "error loading model: "+err.Error(), id)
+	}
+
+	if state.Verbose {
+		fmt.Println("Model", id, "loaded")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// startLlamaModel starts the llama-server supervised by goinfer with the model file.
+func (h *Handlers) startLlamaModel(c echo.Context, req startModelRequest) error {
+	path, ok := h.modelFile(req.Model)
+	if !ok {
+		return replyError(c, http.StatusNotFound, lm.ErrCodeModelNotFound, "model not found: "+req.Model, req.Model)
+	}
+
+	var args []string
+	if req.Ctx != nil {
+		args = []string{"--ctx-size", strconv.Itoa(*req.Ctx)}
+	}
+
+	st := h.Llama.Status()
+	if st.State == lm.ProcessReady && st.Model == path && slices.Equal(st.Args, args) {
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	err := h.Llama.Start(c.Request().Context(), path, args...)
+	if err != nil {
+		return replyError(c, http.StatusInternalServerError, lm.ErrCodeModelNotLoaded, "error loading model: "+err.Error(), req.Model)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// modelFile returns the path of a model file in models_dir, from its file name or stem.
+func (h *Handlers) modelFile(name string) (string, bool) {
+	files, err := h.Catalog.Dir.Search()
+	if err != nil {
+		fmt.Println("WARNING cannot fetch model files:", err)
+		return "", false
+	}
+
+	stem := strings.TrimSuffix(filepath.Base(name), ".gguf")
+	for _, f := range files {
+		if f == name || strings.TrimSuffix(filepath.Base(f), ".gguf") == stem {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// StopModelHandler unloads the models: 204 when unloaded, 202 when no model is loaded.
+func (h *Handlers) StopModelHandler(c echo.Context) error {
+	switch {
+	case h.ProxyMan != nil:
+		sw := h.swap()
+		running, err := sw.Running(c.Request().Context())
+		if err != nil {
+			return replyError(c, http.StatusInternalServerError, lm.ErrCodeBackend, err.Error(), nil)
+		}
+		if len(running) == 0 {
+			return c.NoContent(http.StatusAccepted)
+		}
+		err = sw.Unload(c.Request().Context())
+		if err != nil {
+			return replyError(c, http.StatusInternalServerError, lm.ErrCodeBackend, "error unloading models: "+err.Error(), nil)
+		}
+	case h.Llama != nil:
+		if h.Llama.Status().State == lm.ProcessStopped {
+			return c.NoContent(http.StatusAccepted)
+		}
+		h.Llama.Stop()
+	default:
+		return replyError(c, http.StatusInternalServerError, lm.ErrCodeBackend,
+			"goinfer does not manage the models: enable the llama-swap proxy or unset llama.url", nil)
+	}
+
+	if state.Verbose {
+		fmt.Println("Models unloaded")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RunningModel is the runtime state of a loaded model.
+type RunningModel struct {
+	Model        string    `json:"model"`
+	State        string    `json:"state"` // starting, ready, stopping...
+	Port         int       `json:"port,omitempty"`
+	Loaded       time.Time `json:"loaded,omitzero"`         // when the model was ready, as seen by goinfer
+	TTL          int       `json:"ttl,omitempty"`           // seconds of inactivity before unloading
+	TTLRemaining *int      `json:"ttl_remaining,omitempty"` // seconds before unloading, nil without TTL
+	Groups       []string  `json:"groups,omitempty"`
+	InFlight     int       `json:"in_flight"` // requests in progress
+}
+
+// RunningModelsHandler returns the runtime state of the loaded models.
+func (h *Handlers) RunningModelsHandler(c echo.Context) error {
+	list := []RunningModel{}
+
+	switch {
+	case h.ProxyMan != nil:
+		running, err := h.swap().Running(c.Request().Context())
+		if err != nil {
+			return replyError(c, http.StatusInternalServerError, lm.ErrCodeBackend, err.Error(), nil)
+		}
+		for _, r := range running {
+			list = append(list, h.runningSwapModel(r))
+		}
+	case h.Llama != nil:
+		st := h.Llama.Status()
+		if st.State != lm.ProcessStopped {
+			list = append(list, RunningModel{
+				Model:    strings.TrimSuffix(filepath.Base(st.Model), ".gguf"),
+				State:    string(st.State),
+				Port:     st.Port,
+				Loaded:   st.Started,
+				InFlight: state.Inferences.Count(),
+			})
+		}
+	}
+
+	return c.JSON(http.StatusOK, list)
+}
+
+// runningSwapModel completes a llama-swap model process with the activity recorded by goinfer.
+// The load time is unknown for a model loaded without request (preload).
+func (h *Handlers) runningSwapModel(r lm.RunningModel) RunningModel {
+	act := state.SwapActivity.Get(r.Model)
+
+	m := RunningModel{
+		Model:    r.Model,
+		State:    r.State,
+		TTL:      r.TTL,
+		InFlight: act.InFlight,
+	}
+	if r.State == "ready" {
+		m.Loaded = act.Loaded
+	}
+
+	if u, err := url.Parse(r.Proxy); err == nil {
+		m.Port, _ = strconv.Atoi(u.Port())
+	}
+
+	if r.TTL > 0 && r.State == "ready" {
+		remaining := r.TTL // the TTL starts after the last request
+		if act.InFlight == 0 {
+			since := act.LastRequest
+			if since.Before(act.Loaded) {
+				since = act.Loaded
+			}
+			remaining = max(r.TTL-int(time.Since(since).Seconds()), 0)
+		}
+		m.TTLRemaining = &remaining
+	}
+
+	for name, g := range h.proxyConfig().Groups {
+		if slices.Contains(g.Members, r.Model) {
+			m.Groups = append(m.Groups, name)
+		}
+	}
+	slices.Sort(m.Groups)
+
+	return m
+}
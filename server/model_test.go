@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mostlygeek/llama-swap/proxy"
+	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/lm"
+	"github.com/synw/goinfer/state"
+)
+
+// TestMain runs the fake llama-server when the test binary is started by a supervisor.
+func TestMain(m *testing.M) {
+	if os.Getenv("GOINFER_FAKE_LLAMA") == "1" {
+		fakeLlamaServer()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeLlamaServer replies 200 on /health.
+func fakeLlamaServer() {
+	fs := flag.NewFlagSet("llama-server", flag.ExitOnError)
+	host := fs.String("host", "127.0.0.1", "")
+	port := fs.Int("port", 0, "")
+	fs.String("model", "", "")
+	fs.Int("ctx-size", 0, "")
+	_ = fs.Parse(os.Args[1:])
+
+	http.HandleFunc("/health", func(http.ResponseWriter, *http.Request) {})
+	err := http.ListenAndServe(net.JoinHostPort(*host, strconv.Itoa(*port)), nil)
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// doModel sends a request to the model service, the body is decoded into res if not nil.
+func doModel(t *testing.T, e *echo.Echo, method, path, body string, res any) int {
+	t.Helper()
+	var rec *httptest.ResponseRecorder
+	if method == http.MethodPost {
+		rec = postJSON(e, path, body)
+	} else {
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	}
+	if res != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, rec.Body)
+		}
+	}
+	return rec.Code
+}
+
+func TestModelHandlersSwap(t *testing.T) {
+	p, _ := newFakeSwapProxy(proxy.Config{Models: map[string]proxy.ModelConfig{
+		"GI_a": {Proxy: "http://localhost:5800"},
+		"b":    {Proxy: "http://localhost:5801"},
+	}})
+	e := NewEchoServer(conf.GoInferConf{}, p, nil, ":0", "model")
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"start GI_ entry", http.MethodPost, "/model/start", `{"model":"a.gguf"}`, http.StatusNoContent},
+		{"already loaded", http.MethodPost, "/model/start", `{"model":"a"}`, http.StatusAccepted},
+		{"swap", http.MethodPost, "/model/start", `{"model":"b"}`, http.StatusNoContent},
+		{"unknown model", http.MethodPost, "/model/start", `{"model":"c"}`, http.StatusNotFound},
+		{"missing model", http.MethodPost, "/model/start", `{}`, http.StatusBadRequest},
+		{"stop with GET", http.MethodGet, "/model/stop", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := doModel(t, e, tt.method, tt.path, tt.body, nil); code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.status)
+		}
+	}
+
+	var running []RunningModel
+	if code := doModel(t, e, http.MethodGet, "/model/running", "", &running); code != http.StatusOK {
+		t.Fatalf("running: status %d", code)
+	}
+	if len(running) != 1 || running[0].Model != "b" || running[0].State != "ready" || running[0].Port != 5801 {
+		t.Errorf("running = %+v, want b on the port 5801", running)
+	}
+
+	if code := doModel(t, e, http.MethodPost, "/model/stop", "", nil); code != http.StatusNoContent {
+		t.Errorf("stop: status %d, want 204", code)
+	}
+	if code := doModel(t, e, http.MethodPost, "/model/stop", "", nil); code != http.StatusAccepted {
+		t.Errorf("nothing to stop: status %d, want 202", code)
+	}
+	if doModel(t, e, http.MethodGet, "/model/running", "", &running); len(running) != 0 {
+		t.Errorf("running after stop = %+v", running)
+	}
+}
+
+func TestModelHandlersSupervisor(t *testing.T) {
+	t.Setenv("GOINFER_FAKE_LLAMA", "1")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.gguf"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sup := lm.NewSupervisor(conf.LlamaConf{Exe: os.Args[0]})
+	sup.HealthTimeout = 10 * time.Second
+	t.Cleanup(sup.Stop)
+	e := NewEchoServer(conf.GoInferConf{ModelsDir: dir}, nil, sup, ":0", "model")
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{"nothing to stop", http.MethodPost, "/model/stop", "", http.StatusAccepted},
+		{"start", http.MethodPost, "/model/start", `{"model":"a"}`, http.StatusNoContent},
+		{"already loaded", http.MethodPost, "/model/start", `{"model":"a.gguf"}`, http.StatusAccepted},
+		{"other ctx", http.MethodPost, "/model/start", `{"model":"a","ctx":2048}`, http.StatusNoContent},
+		{"unknown model", http.MethodPost, "/model/start", `{"model":"b"}`, http.StatusNotFound},
+		{"invalid ctx", http.MethodPost, "/model/start", `{"model":"a","ctx":0}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code := doModel(t, e, tt.method, tt.path, tt.body, nil); code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.status)
+		}
+	}
+
+	var running []RunningModel
+	doModel(t, e, http.MethodGet, "/model/running", "", &running)
+	if len(running) != 1 || running[0].Model != "a" || running[0].State != string(lm.ProcessReady) || running[0].Port == 0 {
+		t.Errorf("running = %+v, want a ready", running)
+	}
+
+	if code := doModel(t, e, http.MethodPost, "/model/stop", "", nil); code != http.StatusNoContent {
+		t.Errorf("stop: status %d, want 204", code)
+	}
+	if doModel(t, e, http.MethodGet, "/model/running", "", &running); len(running) != 0 {
+		t.Errorf("running after stop = %+v", running)
+	}
+}
+
+func TestModelHandlersNoBackend(t *testing.T) {
+	e := NewEchoServer(conf.GoInferConf{}, nil, nil, ":0", "model")
+
+	if code := doModel(t, e, http.MethodPost, "/model/start", `{"model":"a"}`, nil); code != http.StatusInternalServerError {
+		t.Errorf("start: status %d, want 500", code)
+	}
+	if code := doModel(t, e, http.MethodPost, "/model/stop", "", nil); code != http.StatusInternalServerError {
+		t.Errorf("stop: status %d, want 500", code)
+	}
+	var running []RunningModel
+	if doModel(t, e, http.MethodGet, "/model/running", "", &running); len(running) != 0 {
+		t.Errorf("running = %+v", running)
+	}
+}
+
+func TestRunningSwapModel(t *testing.T) {
+	t.Parallel()
+	p, _ := newFakeSwapProxy(proxy.Config{
+		Models: map[string]proxy.ModelConfig{"rs-idle": {}, "rs-busy": {}, "rs-starting": {}, "rs-expired": {}},
+		Groups: map[string]proxy.GroupConfig{
+			"small": {Members: []string{"rs-idle", "rs-busy"}},
+			"all":   {Members: []string{"rs-idle", "rs-busy", "rs-starting", "rs-expired"}},
+		},
+	})
+	h := &Handlers{ProxyMan: p}
+
+	state.SwapActivity.Responded("rs-expired")
+	time.Sleep(1100 * time.Millisecond)
+	for _, m := range []string{"rs-idle", "rs-busy"} {
+		state.SwapActivity.Begin(m)
+		state.SwapActivity.Responded(m)
+	}
+	state.SwapActivity.End("rs-idle")
+	defer state.SwapActivity.End("rs-busy")
+
+	ttl := func(n int) *int { return &n }
+	tests := []struct {
+		running   lm.RunningModel
+		inFlight  int
+		loaded    bool
+		remaining *int
+		groups    []string
+	}{
+		{lm.RunningModel{Model: "rs-idle", State: "ready", Proxy: "http://localhost:5800", TTL: 60}, 0, true, ttl(60), []string{"all", "small"}},
+		{lm.RunningModel{Model: "rs-busy", State: "ready", TTL: 1}, 1, true, ttl(1), []string{"all", "small"}},
+		{lm.RunningModel{Model: "rs-starting", State: "starting", TTL: 60}, 0, false, nil, []string{"all"}},
+		{lm.RunningModel{Model: "rs-expired", State: "ready", TTL: 1}, 0, true, ttl(0), []string{"all"}},
+		{lm.RunningModel{Model: "rs-expired", State: "ready"}, 0, true, nil, []string{"all"}},
+	}
+	for _, tt := range tests {
+		m := h.runningSwapModel(tt.running)
+		if m.InFlight != tt.inFlight || m.Loaded.IsZero() == tt.loaded || !slices.Equal(m.Groups, tt.groups) {
+			t.Errorf("%s: %+v", tt.running.Model, m)
+		}
+		if (m.TTLRemaining == nil) != (tt.remaining == nil) ||
+			// the remaining TTL is rounded down to the second
+			(m.TTLRemaining != nil && *m.TTLRemaining != *tt.remaining && *m.TTLRemaining != *tt.remaining-1) {
+			t.Errorf("%s: TTL remaining %v, want %v", tt.running.Model, m.TTLRemaining, tt.remaining)
+		}
+	}
+	if m := h.runningSwapModel(tests[0].running); m.Port != 5800 {
+		t.Errorf("port = %d, want 5800", m.Port)
+	}
+}
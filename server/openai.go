@@ -0,0 +1,568 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/lm"
+	"github.com/synw/goinfer/state"
+	"github.com/synw/goinfer/types"
+)
+
+// chatRequest is the payload of a /v1/chat/completions request.
+// Only the fields used by goinfer are decoded, the other ones are forwarded as is to llama-server.
+type chatRequest struct {
+	Model          string          `json:"model"`
+	Messages       []chatMessage   `json:"messages"`
+	Stream         bool            `json:"stream"`
+	N              *int            `json:"n"`
+	Tools          json.RawMessage `json:"tools"`
+	ToolChoice     json.RawMessage `json:"tool_choice"`
+	Functions      json.RawMessage `json:"functions"`
+	FunctionCall   json.RawMessage `json:"function_call"`
+	Priority       string          `json:"priority"`        // goinfer queue: interactive (default) or batch
+	StripReasoning bool            `json:"strip_reasoning"` // drop the reasoning content
+}
+
+// goinferChatFields are the chat request fields not forwarded to llama-server.
+var goinferChatFields = []string{"priority", "strip_reasoning"}
+
+// chatMessage is a message of a chat request, the other fields (name...) are forwarded.
+type chatMessage struct {
+	Role    string      `json:"role"`
+	Content chatContent `json:"content"`
+}
+
+// chatContent is the content of a message: a string, an array of content parts or null.
+type chatContent json.RawMessage
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *chatContent) UnmarshalJSON(b []byte) error {
+	var s *string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*c = slices.Clone(b)
+		return nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(b, &parts); err != nil {
+		return errors.New("expected a string, an array of content parts or null")
+	}
+	for i, part := range parts {
+		if part.Type == "" {
+			return fmt.Errorf("missing type of the content part %d", i)
+		}
+	}
+	*c = slices.Clone(b)
+	return nil
+}
+
+// fields maps the JSON field names to the struct fields.
+func (r *chatRequest) fields() map[string]any {
+	return map[string]any{
+		"model":           &r.Model,
+		"messages":        &r.Messages,
+		"stream":          &r.Stream,
+		"n":               &r.N,
+		"tools":           &r.Tools,
+		"tool_choice":     &r.ToolChoice,
+		"functions":       &r.Functions,
+		"function_call":   &r.FunctionCall,
+		"priority":        &r.Priority,
+		"strip_reasoning": &r.StripReasoning,
+	}
+}
+
+// validate checks the mandatory fields and rejects the features not supported by goinfer:
+// several choices and the tool calls.
+func (r *chatRequest) validate() FieldErrors {
+	var errs FieldErrors
+
+	switch {
+	case r.Messages == nil:
+		errs.add(lm.ErrCodeMissingField, "messages", "missing mandatory field: messages")
+	case len(r.Messages) == 0:
+		errs.add(lm.ErrCodeInvalidParams, "messages", "messages must not be empty")
+	}
+	for i, msg := range r.Messages {
+		if msg.Role == "" {
+			errs.add(lm.ErrCodeMissingField, "messages", fmt.Sprintf("missing mandatory field: messages[%d].role", i))
+			break
+		}
+	}
+
+	if r.N != nil && *r.N != 1 {
+		errs.add(lm.ErrCodeOutOfRange, "n", fmt.Sprintf("n must be 1, got %d: a single choice is returned", *r.N))
+	}
+	unsupported := []struct {
+		name string
+		v    json.RawMessage
+	}{{"tools", r.Tools}, {"tool_choice", r.ToolChoice}, {"functions", r.Functions}, {"function_call", r.FunctionCall}}
+	for _, f := range unsupported {
+		if f.v != nil && string(f.v) != "null" {
+			errs.add(lm.ErrCodeInvalidParams, f.name, f.name+" is not supported")
+		}
+	}
+
+	if _, err := state.ParsePriority(r.Priority); err != nil {
+		errs.add(lm.ErrCodeOutOfRange, "priority", err.Error())
+	}
+
+	return errs
+}
+
+// parseOpenAiChatRequest decodes and validates a /v1/chat/completions request.
+// The payload forwarded to llama-server is the request without the goinfer fields.
+func parseOpenAiChatRequest(body io.Reader) (lm.OpenAiChatRequest, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return lm.OpenAiChatRequest{}, fmt.Errorf("cannot read the request body: %w", err)
+	}
+
+	var req chatRequest
+	errs, err := decodeFields(bytes.NewReader(data), req.fields())
+	if err != nil {
+		return lm.OpenAiChatRequest{}, err
+	}
+	errs = slices.DeleteFunc(errs, func(err *lm.InferError) bool { return err.Code == lm.ErrCodeUnknownField })
+
+	for _, err := range req.validate() {
+		if field, _ := err.Context.(string); !errs.has(field) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return lm.OpenAiChatRequest{}, errs
+	}
+
+	// cannot fail: decodeFields has decoded the same object
+	payload := map[string]json.RawMessage{}
+	_ = json.Unmarshal(data, &payload)
+	for _, name := range goinferChatFields {
+		delete(payload, name)
+	}
+
+	return lm.OpenAiChatRequest{
+		Model:          req.Model,
+		Stream:         req.Stream,
+		Priority:       req.Priority,
+		StripReasoning: req.StripReasoning,
+		Payload:        payload,
+	}, nil
+}
+
+// ChatCompletionsHandler handles the OpenAI /v1/chat/completions requests.
+func (h *Handlers) ChatCompletionsHandler(c echo.Context) error {
+	req, err := parseOpenAiChatRequest(c.Request().Body)
+	if err != nil {
+		if state.Debug {
+			fmt.Println("Chat completion parsing error", err)
+		}
+		var fields FieldErrors
+		if errors.As(err, &fields) {
+			return fields
+		}
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+
+	srv, err := h.llamaServer(req.Model)
+	if err != nil {
+		return replyBackendError(c, req.Model, err)
+	}
+
+	return h.runOpenAi(c, req.Model, req.Priority, req.Stream, func(sess *state.Session) error {
+		res, err := openAiResult(func(ch chan<- lm.OpenAiChatCompletion, errCh chan<- error) {
+			lm.InferOpenAi(req, srv, sess, c, ch, errCh)
+		})
+		if err != nil || req.Stream {
+			return err
+		}
+		return c.JSON(http.StatusOK, res)
+	})
+}
+
+// stringList is a string or an array of strings.
+type stringList []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.New("expected a string or an array of strings")
+	}
+	*l = list
+	return nil
+}
+
+// completionRequest is the payload of a /v1/completions request.
+// The sampling parameters are the ones of a /completion request.
+type completionRequest struct {
+	inferRequest
+	Prompts  stringList  `json:"prompt"`
+	StopList *stringList `json:"stop"`
+	Suffix   string      `json:"suffix"`
+	Echo     bool        `json:"echo"`
+	Logprobs *int        `json:"logprobs"`
+	BestOf   *int        `json:"best_of"`
+	N        *int        `json:"n"`
+}
+
+// fields maps the JSON field names to the struct fields.
+func (r *completionRequest) fields() map[string]any {
+	fields := map[string]any{
+		"prompt":   &r.Prompts,
+		"stop":     &r.StopList,
+		"suffix":   &r.Suffix,
+		"echo":     &r.Echo,
+		"logprobs": &r.Logprobs,
+		"best_of":  &r.BestOf,
+		"n":        &r.N,
+	}
+	all := r.inferRequest.fields()
+	for _, name := range []string{"model", "stream", "max_tokens", "top_k", "top_p", "min_p", "temperature",
+		"frequency_penalty", "presence_penalty", "repeat_penalty", "priority"} {
+		fields[name] = all[name]
+	}
+	return fields
+}
+
+// validate checks the mandatory fields and the value ranges.
+func (r *completionRequest) validate() FieldErrors {
+	if len(r.Prompts) > 0 {
+		r.Prompt = &r.Prompts[0]
+	}
+	errs := r.inferRequest.validate()
+
+	checkRange(&errs, "logprobs", r.Logprobs, 0, 20)
+	checkRange(&errs, "n", r.N, 1, 20)
+	checkRange(&errs, "best_of", r.BestOf, 1, 20)
+
+	n, bestOf := r.counts()
+	switch {
+	case bestOf < n:
+		errs.add(lm.ErrCodeOutOfRange, "best_of", "best_of must be greater than or equal to n")
+	case bestOf > n && r.Stream:
+		errs.add(lm.ErrCodeInvalidParams, "best_of", "best_of cannot be used with stream")
+	}
+
+	return errs
+}
+
+// counts returns the completions returned and generated per prompt.
+func (r *completionRequest) counts() (n, bestOf int) {
+	n = 1
+	if r.N != nil {
+		n = *r.N
+	}
+	bestOf = n
+	if r.BestOf != nil {
+		bestOf = *r.BestOf
+	}
+	return n, bestOf
+}
+
+// request converts the request to the lm request, the missing fields take the default values.
+func (r *completionRequest) request() lm.OpenAiCompletionRequest {
+	if r.StopList != nil {
+		stop := []string(*r.StopList)
+		r.Stop = &stop
+	}
+	query := r.query()
+	if r.Suffix != "" {
+		query.Infill = &types.Infill{Suffix: r.Suffix}
+	}
+
+	n, bestOf := r.counts()
+	return lm.OpenAiCompletionRequest{
+		Model:    r.Model,
+		Prompts:  r.Prompts,
+		Echo:     r.Echo,
+		Logprobs: r.Logprobs,
+		BestOf:   bestOf,
+		N:        n,
+		Query:    query,
+	}
+}
+
+// parseOpenAiCompletionRequest decodes and validates a /v1/completions request.
+// The other OpenAI fields (user, logit_bias, seed...) are ignored.
+func parseOpenAiCompletionRequest(body io.Reader) (lm.OpenAiCompletionRequest, error) {
+	var req completionRequest
+
+	errs, err := decodeFields(body, req.fields())
+	if err != nil {
+		return lm.OpenAiCompletionRequest{}, err
+	}
+	errs = slices.DeleteFunc(errs, func(err *lm.InferError) bool { return err.Code == lm.ErrCodeUnknownField })
+
+	for _, err := range req.validate() {
+		if field, _ := err.Context.(string); !errs.has(field) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return lm.OpenAiCompletionRequest{}, errs
+	}
+
+	return req.request(), nil
+}
+
+// CompletionsHandler handles the OpenAI legacy /v1/completions requests.
+func (h *Handlers) CompletionsHandler(c echo.Context) error {
+	req, err := parseOpenAiCompletionRequest(c.Request().Body)
+	if err != nil {
+		if state.Debug {
+			fmt.Println("Completion parsing error", err)
+		}
+		var fields FieldErrors
+		if errors.As(err, &fields) {
+			return fields
+		}
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+	stream := req.Query.InferParams.Stream
+
+	srv, err := h.llamaServer(req.Model)
+	if err != nil {
+		return replyBackendError(c, req.Model, err)
+	}
+
+	return h.runOpenAi(c, req.Model, req.Query.Priority, stream, func(sess *state.Session) error {
+		res, err := openAiResult(func(ch chan<- lm.OpenAiCompletion, errCh chan<- error) {
+			lm.InferOpenAiCompletion(req, srv, sess, c, ch, errCh)
+		})
+		if err != nil || stream {
+			return err
+		}
+		return c.JSON(http.StatusOK, res)
+	})
+}
+
+// parseOpenAiEmbeddingRequest decodes and validates a /v1/embeddings request.
+// The other OpenAI fields (user, dimensions...) are ignored.
+func parseOpenAiEmbeddingRequest(body io.Reader) (lm.OpenAiEmbeddingRequest, error) {
+	var req lm.OpenAiEmbeddingRequest
+	var input stringList
+	var format *string
+
+	errs, err := decodeFields(body, map[string]any{
+		"model":           &req.Model,
+		"input":           &input,
+		"encoding_format": &format,
+		"priority":        &req.Priority,
+	})
+	if err != nil {
+		return req, err
+	}
+	errs = slices.DeleteFunc(errs, func(err *lm.InferError) bool { return err.Code == lm.ErrCodeUnknownField })
+
+	switch {
+	case errs.has("input"):
+	case len(input) == 0:
+		errs.add(lm.ErrCodeMissingField, "input", "missing mandatory field: input")
+	case slices.Contains(input, ""):
+		errs.add(lm.ErrCodeInvalidParams, "input", "input must not contain empty strings")
+	}
+	req.Input = input
+
+	req.EncodingFormat = "float"
+	if format != nil {
+		req.EncodingFormat = *format
+	}
+	if req.EncodingFormat != "float" && req.EncodingFormat != "base64" && !errs.has("encoding_format") {
+		errs.add(lm.ErrCodeOutOfRange, "encoding_format", "encoding_format must be float or base64, got "+req.EncodingFormat)
+	}
+	if _, err := state.ParsePriority(req.Priority); err != nil && !errs.has("priority") {
+		errs.add(lm.ErrCodeOutOfRange, "priority", err.Error())
+	}
+
+	if len(errs) > 0 {
+		return req, errs
+	}
+	return req, nil
+}
+
+// EmbeddingsHandler handles the OpenAI /v1/embeddings requests,
+// served by a llama-server started with --embedding.
+func (h *Handlers) EmbeddingsHandler(c echo.Context) error {
+	req, err := parseOpenAiEmbeddingRequest(c.Request().Body)
+	if err != nil {
+		if state.Debug {
+			fmt.Println("Embeddings parsing error", err)
+		}
+		var fields FieldErrors
+		if errors.As(err, &fields) {
+			return fields
+		}
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+
+	srv, err := h.llamaServer(req.Model)
+	if err != nil {
+		return replyBackendError(c, req.Model, err)
+	}
+
+	return h.runOpenAi(c, req.Model, req.Priority, false, func(sess *state.Session) error {
+		list, err := srv.Embeddings(sess.Context(), req)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+}
+
+// runOpenAi runs an OpenAI request once its turn has come in the queue of the model,
+// in an inference session that can be aborted. run replies the response: a stream
+// has its headers sent before waiting in the queue. The errors of run are replied
+// in the OpenAI format, as the last event of a stream.
+func (h *Handlers) runOpenAi(c echo.Context, model, priority string, stream bool, run func(sess *state.Session) error) error {
+	p, _ := state.ParsePriority(priority)
+	ticket, err := state.InferenceQueue.Enqueue(queueKey(model), p)
+	if err != nil {
+		return h.queueFull(c)
+	}
+	defer ticket.Release()
+
+	sess := state.Inferences.Start(c.Request().Context(), model)
+	status := state.StatusFailed
+	defer func() { state.Inferences.Finish(sess, status) }()
+	c.Response().Header().Set(HeaderInferenceID, sess.ID)
+
+	if stream {
+		c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+		c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+		c.Response().WriteHeader(http.StatusOK)
+	}
+
+	// OpenAI clients do not expect the "queued" messages
+	err = ticket.Wait(sess.Context(), nil)
+	if err == nil {
+		err = run(sess)
+		if err == nil {
+			status = state.StatusDone
+			return nil
+		}
+	}
+
+	if c.Request().Context().Err() != nil {
+		return replyCanceled(c, err.Error())
+	}
+	if state.Debug {
+		fmt.Println("Inference error", err)
+	}
+	code := http.StatusInternalServerError
+	var upErr *lm.UpstreamError
+	if errors.As(err, &upErr) {
+		code = upErr.StatusCode
+	}
+	var inferErr *lm.InferError
+	if !errors.As(err, &inferErr) {
+		inferErr = &lm.InferError{Code: lm.ErrCodeInferenceFailed, Message: err.Error()}
+	}
+	if sess.Aborted() {
+		inferErr.Code = lm.ErrCodeInferenceAborted
+		inferErr.Message = "inference aborted"
+		code = http.StatusConflict
+	}
+	if stream {
+		return streamOpenAiError(c, inferErr)
+	}
+	return replyInferError(c, code, inferErr)
+}
+
+// openAiResult runs an lm OpenAI inference and returns the message it sends:
+// the completion or the error.
+func openAiResult[T any](infer func(ch chan<- T, errCh chan<- error)) (T, error) {
+	// buffered: the inferences send exactly one message and never block
+	ch := make(chan T, 1)
+	errCh := make(chan error, 1)
+	infer(ch, errCh)
+	select {
+	case res := <-ch:
+		return res, nil
+	case err := <-errCh:
+		var zero T
+		return zero, err
+	}
+}
+
+// streamOpenAiError sends the error as the last server-sent event of a stream.
+func streamOpenAiError(c echo.Context, err *lm.InferError) error {
+	resp := OpenAiErrorResponse{Error: newOpenAiError(http.StatusInternalServerError, err)}
+	_, werr := fmt.Fprintf(c.Response(), "data: %s\n\n", mustMarshal(resp))
+	if werr != nil && state.Debug {
+		fmt.Println("Streaming error", werr)
+	}
+	c.Response().Flush()
+	return nil
+}
+
+// mustMarshal encodes v in JSON, errors are reported in the JSON output.
+func mustMarshal(v any) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return []byte(`{"error":` + fmt.Sprintf("%q", err.Error()) + `}`)
+	}
+	return b
+}
+
+// ListModelsHandler handles the OpenAI /v1/models requests:
+// the listed models of the llama-swap config and the model files found in models_dir.
+func (h *Handlers) ListModelsHandler(c echo.Context) error {
+	created := time.Now().Unix()
+	list := lm.OpenAiModelList{Object: "list", Data: []lm.OpenAiModel{}}
+	seen := map[string]bool{}
+
+	for id, mc := range h.proxyConfig().Models {
+		seen[id] = true
+		if mc.Unlisted {
+			continue
+		}
+		list.Data = append(list.Data, lm.OpenAiModel{
+			ID:          id,
+			Object:      "model",
+			Created:     created,
+			OwnedBy:     "llama-swap",
+			Name:        mc.Name,
+			Description: mc.Description,
+		})
+	}
+
+	files, err := h.Catalog.Dir.Search()
+	if err != nil {
+		fmt.Println("WARNING cannot fetch model files => list only the llama-swap models:", err)
+	}
+
+	// without the projectors and the other shards of the split models
+	for _, m := range h.Catalog.Classify(files) {
+		id := m.Name
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		list.Data = append(list.Data, lm.OpenAiModel{
+			ID:      id,
+			Object:  "model",
+			Created: created,
+			OwnedBy: "goinfer",
+		})
+	}
+
+	slices.SortFunc(list.Data, func(a, b lm.OpenAiModel) int { return strings.Compare(a.ID, b.ID) })
+
+	return c.JSON(http.StatusOK, list)
+}
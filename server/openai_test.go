@@ -0,0 +1,341 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mostlygeek/llama-swap/proxy"
+	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/lm"
+	"github.com/synw/goinfer/models"
+	"github.com/synw/goinfer/state"
+)
+
+func TestParseOpenAiChatRequest(t *testing.T) {
+	body := `{"model":"m","priority":"batch","strip_reasoning":true,"temperature":0.5,
+		"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]},{"role":"assistant","content":null}]}`
+	req, err := parseOpenAiChatRequest(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Model != "m" || req.Priority != "batch" || !req.StripReasoning {
+		t.Errorf("request = %+v", req)
+	}
+	for _, name := range goinferChatFields {
+		if _, ok := req.Payload[name]; ok {
+			t.Errorf("%s is forwarded to llama-server", name)
+		}
+	}
+	var messages []map[string]any
+	if err := json.Unmarshal(req.Payload["messages"], &messages); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := messages[0]["content"].([]any); !ok {
+		t.Errorf("the content parts are not forwarded: %v", messages[0])
+	}
+	if string(req.Payload["temperature"]) != "0.5" {
+		t.Errorf("temperature = %s", req.Payload["temperature"])
+	}
+}
+
+func TestParseOpenAiChatRequestErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"missing messages", `{"model":"m"}`, "messages"},
+		{"empty messages", `{"messages":[]}`, "messages"},
+		{"missing role", `{"messages":[{"content":"hi"}]}`, "messages"},
+		{"invalid content", `{"messages":[{"role":"user","content":1}]}`, "messages"},
+		{"several choices", `{"messages":[{"role":"user","content":"hi"}],"n":2}`, "n"},
+		{"tools", `{"messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function"}]}`, "tools"},
+		{"priority", `{"messages":[{"role":"user","content":"hi"}],"priority":"urgent"}`, "priority"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOpenAiChatRequest(strings.NewReader(tt.body))
+			var errs FieldErrors
+			if !errors.As(err, &errs) || !errs.has(tt.field) {
+				t.Errorf("want an error on %s, got %v", tt.field, err)
+			}
+		})
+	}
+}
+
+func TestListModelsHandler(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.gguf", "mmproj-a-f16.gguf", "big-00001-of-00002.gguf", "big-00002-of-00002.gguf"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := conf.GoInferConf{ModelsDir: dir}
+	e := NewEchoServer(cfg, nil, nil, ":0", "openai")
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	var list lm.OpenAiModelList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.ID)
+	}
+	if !slices.Equal(ids, []string{"a", "big"}) {
+		t.Errorf("models = %v, want [a big]", ids)
+	}
+}
+
+func TestOpenAiModelNotFound(t *testing.T) {
+	p, _ := newFakeSwapProxy(proxy.Config{Models: map[string]proxy.ModelConfig{"known": {}}})
+	e := NewEchoServer(conf.GoInferConf{}, p, nil, ":0", "openai")
+
+	tests := []struct {
+		path, body string
+	}{
+		{"/v1/chat/completions", `{"model":"unknown","messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/completions", `{"model":"unknown","prompt":"hi"}`},
+		{"/v1/embeddings", `{"model":"unknown","input":"hi"}`},
+		{"/v1/embeddings", `{"input":"hi"}`},
+	}
+	for _, tt := range tests {
+		rec := postJSON(e, tt.path, tt.body)
+		var res OpenAiErrorResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &res)
+		if rec.Code != http.StatusNotFound || res.Error.Code != "model_not_found" {
+			t.Errorf("%s %s: status %d: %s", tt.path, tt.body, rec.Code, rec.Body)
+		}
+	}
+}
+
+// newFakeEmbeddings starts a fake llama-server replying on /v1/embeddings:
+// the vector of an input is [index, length]. The inputs "upstream 400" and
+// "upstream 500" get an error, "missing" gets no vector.
+// The received paths and payloads are sent to the returned channel.
+func newFakeEmbeddings(t *testing.T) (*httptest.Server, <-chan fakeRequest) {
+	t.Helper()
+	received := make(chan fakeRequest, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		received <- fakeRequest{r.URL.Path, payload}
+
+		input, _ := payload["input"].([]any)
+		data := []map[string]any{}
+		for i, in := range input {
+			switch in {
+			case "upstream 400":
+				http.Error(w, `{"error":{"message":"input too long"}}`, http.StatusBadRequest)
+				return
+			case "upstream 500":
+				http.Error(w, `{"error":{"message":"crashed"}}`, http.StatusInternalServerError)
+				return
+			case "missing":
+				continue
+			}
+			data = append(data, map[string]any{"index": i, "embedding": []float32{float32(i), float32(len(in.(string)))}})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data, "usage": map[string]int{"prompt_tokens": 3}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+// fakeRequest is a request received by a fake server.
+type fakeRequest struct {
+	path    string
+	payload map[string]any
+}
+
+func TestEmbeddingsHandler(t *testing.T) {
+	fake, received := newFakeEmbeddings(t)
+	cfg := conf.GoInferConf{}
+	cfg.Llama.URL = fake.URL
+	e := NewEchoServer(cfg, nil, nil, ":0", "openai")
+
+	rec := postJSON(e, "/v1/embeddings", `{"model":"emb","input":"hello","priority":"batch","user":"u1"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	assertJSON(t, "float", rec.Body.Bytes(), `{
+		"object": "list", "model": "emb",
+		"data": [{"object": "embedding", "index": 0, "embedding": [0, 5]}],
+		"usage": {"prompt_tokens": 3, "total_tokens": 3}
+	}`)
+	// the goinfer and the unknown fields are not forwarded, the vectors are always requested as floats
+	req := <-received
+	want := map[string]any{"model": "emb", "input": []any{"hello"}, "encoding_format": "float"}
+	if req.path != "/v1/embeddings" || !reflect.DeepEqual(req.payload, want) {
+		t.Errorf("forwarded %s %v, want %v", req.path, req.payload, want)
+	}
+
+	rec = postJSON(e, "/v1/embeddings", `{"input":["a","bc"],"encoding_format":"base64"}`)
+	var list lm.OpenAiEmbeddingList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list.Data) != 2 {
+		t.Fatalf("base64: %v: %s", err, rec.Body)
+	}
+	if got := list.Data[1].Embedding; got != base64.StdEncoding.EncodeToString([]byte{0, 0, 0x80, 0x3f, 0, 0, 0, 0x40}) {
+		t.Errorf("base64 vector = %v, want [1, 2]", got)
+	}
+	if req := <-received; req.payload["encoding_format"] != "float" {
+		t.Errorf("forwarded %v", req.payload)
+	}
+}
+
+func TestEmbeddingsHandlerErrors(t *testing.T) {
+	fake, _ := newFakeEmbeddings(t)
+	cfg := conf.GoInferConf{}
+	cfg.Llama.URL = fake.URL
+	e := NewEchoServer(cfg, nil, nil, ":0", "openai")
+
+	down := newFakeLlama(t)
+	down.Close()
+	cfg.Llama.URL = down.URL
+	eDown := NewEchoServer(cfg, nil, nil, ":0", "openai")
+
+	tests := []struct {
+		name   string
+		e      *echo.Echo
+		body   string
+		status int
+		code   string
+	}{
+		{"missing input", e, `{"model":"emb"}`, http.StatusBadRequest, "invalid_params"},
+		{"empty input", e, `{"input":["a",""]}`, http.StatusBadRequest, "invalid_params"},
+		{"encoding format", e, `{"input":"a","encoding_format":"int8"}`, http.StatusBadRequest, "invalid_params"},
+		{"upstream client error", e, `{"input":["a","upstream 400"]}`, http.StatusBadRequest, "inference_failed"},
+		{"upstream server error", e, `{"input":"upstream 500"}`, http.StatusInternalServerError, "inference_failed"},
+		{"missing vector", e, `{"input":["a","missing"]}`, http.StatusInternalServerError, "inference_failed"},
+		{"llama-server down", eDown, `{"input":"a"}`, http.StatusInternalServerError, "inference_failed"},
+	}
+	for _, tt := range tests {
+		rec := postJSON(tt.e, "/v1/embeddings", tt.body)
+		var res OpenAiErrorResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &res)
+		if rec.Code != tt.status || res.Error.Code != tt.code {
+			t.Errorf("%s: status %d, want %d %s: %s", tt.name, rec.Code, tt.status, tt.code, rec.Body)
+		}
+	}
+}
+
+// upstreamSwap is a llama-swap proxy.ProxyManager serving the /upstream/<model>/ requests with a llama-server.
+type upstreamSwap struct {
+	srv *httptest.Server
+}
+
+func (u upstreamSwap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/upstream/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	target, _ := url.Parse(u.srv.URL)
+	r.URL.Path = "/" + rest // the fake server receives /<model>/v1/embeddings
+	httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+}
+
+func (upstreamSwap) Shutdown() {}
+
+func TestEmbeddingsHandlerSwap(t *testing.T) {
+	fake, received := newFakeEmbeddings(t)
+
+	// the entries generated from the model files: no hidden GI_ entry for an embedding model
+	files := []models.ModelFile{
+		{Name: "chat", Path: "/models/chat.gguf", Kind: models.KindChat},
+		{Name: "emb", Path: "/models/emb.gguf", Kind: models.KindEmbedding},
+	}
+	data, _, err := conf.MergeProxyConf(nil, files, conf.ModelsConf{"emb": {Aliases: []string{"e5"}}}, conf.WhisperConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	px, err := loadProxyConf(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newSwapProxy(px, func(proxy.Config) swapManager { return upstreamSwap{fake} })
+	e := NewEchoServer(conf.GoInferConf{}, p, nil, ":0", "openai")
+
+	tests := []struct {
+		model  string
+		status int
+		path   string // the llama-swap upstream path
+	}{
+		{"emb", http.StatusOK, "/emb/v1/embeddings"},
+		{"e5", http.StatusOK, "/e5/v1/embeddings"}, // llama-swap resolves the alias
+		{"GI_emb", http.StatusNotFound, ""},
+		{"emb.gguf", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := postJSON(e, "/v1/embeddings", `{"model":"`+tt.model+`","input":"hi"}`)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.model, rec.Code, tt.status, rec.Body)
+			continue
+		}
+		if tt.path == "" {
+			continue
+		}
+		if req := <-received; req.path != tt.path || req.payload["model"] != tt.model {
+			t.Errorf("%s: forwarded to %s %v", tt.model, req.path, req.payload)
+		}
+	}
+}
+
+func TestRunOpenAi(t *testing.T) {
+	h := &Handlers{}
+	tests := []struct {
+		name   string
+		stream bool
+		run    func(c echo.Context, sess *state.Session) error
+		status int
+		body   string
+	}{
+		{"ok", false, func(c echo.Context, _ *state.Session) error {
+			return c.JSON(http.StatusOK, "done")
+		}, http.StatusOK, `"done"`},
+		{"upstream error", false, func(echo.Context, *state.Session) error {
+			return &lm.UpstreamError{StatusCode: http.StatusBadRequest, Body: "bad audio"}
+		}, http.StatusBadRequest, `"code":"inference_failed"`},
+		{"aborted", false, func(_ echo.Context, sess *state.Session) error {
+			sess.Abort()
+			return sess.Context().Err()
+		}, http.StatusConflict, `"code":"inference_aborted"`},
+		{"stream error", true, func(echo.Context, *state.Session) error {
+			return errors.New("failed")
+		}, http.StatusOK, `data: {"error":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/v1/embeddings", nil), rec)
+			err := h.runOpenAi(c, "m", "", tt.stream, func(sess *state.Session) error {
+				if _, ok := state.Inferences.Get(sess.ID); !ok {
+					t.Error("the session is not registered")
+				}
+				return tt.run(c, sess)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if rec.Header().Get(HeaderInferenceID) == "" {
+				t.Error("missing inference ID header")
+			}
+		})
+	}
+}
@@ -9,15 +9,21 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
 	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/lm"
 	"github.com/synw/goinfer/models"
 )
 
 //go:embed all:dist
 var embeddedFiles embed.FS
 
-func NewEchoServer(cfg conf.GoInferConf, addr, services string) *echo.Echo {
+// NewEchoServer creates the Echo server for the services listening on addr.
+// pm is the llama-swap proxy (nil if disabled), sup the llama-server started by goinfer (nil if none).
+func NewEchoServer(cfg conf.GoInferConf, pm *SwapProxy, sup *lm.Supervisor, addr, services string) *echo.Echo {
+	h := &Handlers{Cfg: &cfg, ProxyMan: pm, Llama: sup, Catalog: models.NewCatalog(cfg.ModelsDir)}
+
 	e := echo.New()
 	e.HideBanner = true
+	e.HTTPErrorHandler = HTTPErrorHandler
 
 	// logger
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
@@ -32,6 +38,7 @@ func NewEchoServer(cfg conf.GoInferConf, addr, services string) *echo.Echo {
 		AllowOrigins:     strings.Split(cfg.Server.Origins, ","),
 		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAuthorization},
 		AllowMethods:     []string{http.MethodGet, http.MethodOptions, http.MethodPost},
+		ExposeHeaders:    []string{HeaderInferenceID},
 		AllowCredentials: true,
 	}))
 
@@ -51,42 +58,44 @@ func NewEchoServer(cfg conf.GoInferConf, addr, services string) *echo.Echo {
 
 	// ------------ Models ------------
 	if strings.Contains(services, "model") {
-		grp := e.Group("/model")
-		apiKey := conf.ApiKey(cfg.Server.ApiKeys, "model")
-		if apiKey != "" {
-			grp.Use(middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
-				return key == apiKey, nil
-			}))
-		}
-		grp.GET("/state", models.Dir(cfg.ModelsDir).StateHandler)
+		grp := e.Group("/model", keyAuth(conf.ApiKey(cfg.Server.ApiKeys, "model")))
+		grp.GET("/state", h.Catalog.StateHandler)
+		grp.GET("/running", h.RunningModelsHandler)
+		grp.POST("/start", h.StartModelHandler)
+		grp.POST("/stop", h.StopModelHandler)
 		atLeastOneService = true
 	}
 
 	// ----- Inference (llama.cpp) -----
 	if strings.Contains(services, "goinfer") {
-		grp := e.Group("/completion")
-		apiKey := conf.ApiKey(cfg.Server.ApiKeys, "goinfer")
-		if apiKey != "" {
-			grp.Use(middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
-				return key == apiKey, nil
-			}))
-		}
-		grp.POST("", InferHandler)
-		grp.GET("/abort", AbortLlamaHandler)
+		auth := keyAuth(conf.ApiKey(cfg.Server.ApiKeys, "goinfer"))
+		grp := e.Group("/completion", auth)
+		grp.POST("", h.InferHandler)
+		grp.GET("/abort", h.AbortLlamaHandler)
+		grp.POST("/:id/abort", h.AbortInferenceHandler)
+
+		e.POST("/infill", h.InfillHandler, auth)
+		e.POST("/tokenize", h.TokenizeHandler, auth)
+		e.POST("/detokenize", h.DetokenizeHandler, auth)
+		e.POST("/count_tokens", h.CountTokensHandler, auth)
+
+		tsk := e.Group("/task", auth)
+		tsk.GET("", h.ListTasksHandler)
+		tsk.GET("/*", h.ReadTaskHandler)
+		tsk.POST("/save", h.SaveTaskHandler)
+		tsk.POST("/execute", h.ExecuteTaskHandler)
 		atLeastOneService = true
 	}
 
 	// ----- Inference OpenAI API -----
 	if strings.Contains(services, "openai") {
-		oai := e.Group("/v1")
-		apiKey := conf.ApiKey(cfg.Server.ApiKeys, "openai")
-		if apiKey != "" {
-			oai.Use(middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
-				return key == apiKey, nil
-			}))
-		}
-		// oai.POST("/chat/completions", CreateCompletionHandler)
-		// oai.GET("/models", OpenAiListModels)
+		oai := e.Group("/v1", keyAuth(conf.ApiKey(cfg.Server.ApiKeys, "openai")))
+		oai.POST("/chat/completions", h.ChatCompletionsHandler)
+		oai.POST("/completions", h.CompletionsHandler)
+		oai.POST("/embeddings", h.EmbeddingsHandler)
+		oai.POST("/audio/transcriptions", h.TranscriptionsHandler, audioBodyLimit)
+		oai.POST("/audio/translations", h.TranslationsHandler, audioBodyLimit)
+		oai.GET("/models", h.ListModelsHandler)
 		atLeastOneService = true
 	}
 
@@ -95,3 +104,14 @@ func NewEchoServer(cfg conf.GoInferConf, addr, services string) *echo.Echo {
 	}
 	return nil
 }
+
+// keyAuth returns the middleware checking the API key of a service,
+// all the requests pass when the service has no key.
+func keyAuth(apiKey string) echo.MiddlewareFunc {
+	if apiKey == "" {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+	return middleware.KeyAuth(func(key string, _ echo.Context) (bool, error) {
+		return key == apiKey, nil
+	})
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/conf"
+)
+
+func TestKeyAuth(t *testing.T) {
+	key := "secret"
+	cfg := conf.GoInferConf{}
+	cfg.Server.ApiKeys = map[string]string{"user": key}
+	e := NewEchoServer(cfg, nil, nil, ":0", "goinfer model openai")
+
+	post := func(path, key string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, path := range []string{"/completion", "/infill", "/tokenize", "/task/save", "/model/start", "/v1/embeddings"} {
+		if status := post(path, "wrong"); status != http.StatusUnauthorized {
+			t.Errorf("%s with a wrong key: status %d, want 401", path, status)
+		}
+		if status := post(path, key); status == http.StatusUnauthorized {
+			t.Errorf("%s with the key: status 401", path)
+		}
+	}
+}
@@ -1,23 +1,355 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mostlygeek/llama-swap/proxy"
 	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/models"
+	"github.com/synw/goinfer/state"
 )
 
-func NewProxyServer(cfg conf.GoInferConf) (*http.Server, *proxy.ProxyManager) {
+// swapManager is a llama-swap proxy.ProxyManager.
+type swapManager interface {
+	http.Handler
+	Shutdown()
+}
+
+// SwapProxy is the llama-swap proxy, its config can be replaced while running.
+// It is safe for concurrent use.
+type SwapProxy struct {
+	mu      sync.RWMutex
+	pm      swapManager
+	cfg     proxy.Config
+	stopped chan struct{} // closed once the models of the previous proxy are stopped
+
+	newManager func(cfg proxy.Config) swapManager
+}
+
+// NewSwapProxy creates the llama-swap proxy.
+func NewSwapProxy(cfg proxy.Config) *SwapProxy {
+	return newSwapProxy(cfg, func(cfg proxy.Config) swapManager { return proxy.New(cfg) })
+}
+
+func newSwapProxy(cfg proxy.Config, newManager func(cfg proxy.Config) swapManager) *SwapProxy {
+	stopped := make(chan struct{})
+	close(stopped)
+	return &SwapProxy{pm: newManager(cfg), cfg: cfg, stopped: stopped, newManager: newManager}
+}
+
+// ServeHTTP forwards the request to the current proxy.ProxyManager,
+// once the models of the previous one are stopped: they free their ports.
+func (p *SwapProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	pm, stopped := p.pm, p.stopped
+	p.mu.RUnlock()
+
+	select {
+	case <-stopped:
+		pm.ServeHTTP(w, r)
+	case <-r.Context().Done():
+		http.Error(w, "llama-swap is reloading", http.StatusServiceUnavailable)
+	}
+}
+
+// Config returns the current llama-swap config (macros expanded).
+func (p *SwapProxy) Config() proxy.Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cfg
+}
+
+// Reload replaces the llama-swap config: the running models are stopped
+// and a new proxy.ProxyManager serves the new config.
+func (p *SwapProxy) Reload(cfg proxy.Config) {
+	pm := p.newManager(cfg)
+	stopped := make(chan struct{})
+
+	p.mu.Lock()
+	old, oldCfg, previous := p.pm, p.cfg, p.stopped
+	p.pm, p.cfg, p.stopped = pm, cfg, stopped
+	p.mu.Unlock()
+
+	<-previous // a previous reload is stopping its models
+	old.Shutdown()
+	unloaded(oldCfg.Models)
+	close(stopped)
+}
+
+// Shutdown stops the running models.
+func (p *SwapProxy) Shutdown() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.pm.Shutdown()
+	unloaded(p.cfg.Models)
+}
+
+// unloaded records in state.SwapActivity that the model processes have stopped.
+func unloaded(models map[string]proxy.ModelConfig) {
+	for id := range models {
+		state.SwapActivity.Unloaded(id)
+	}
+}
+
+// WatchModelFiles updates the model entries generated from the model files
+// when files are added to or removed from models_dir, and reloads the proxy.
+// The config file is not modified: the entries are merged in memory.
+func (p *SwapProxy) WatchModelFiles(ctx context.Context, cfg *conf.GoInferConf, proxyCfgFile string) {
+	var applied []byte // the merged config of the running proxy
+	interval := time.Duration(cfg.ModelsWatch) * time.Second
+
+	models.Dir(cfg.ModelsDir).Watch(ctx, interval, func(files []string) {
+		applied = p.reloadModelFiles(cfg, proxyCfgFile, files, applied)
+	})
+}
+
+// reloadModelFiles merges the entries generated from the model files into the config file,
+// and reloads the proxy if the result differs from the applied config.
+// Returns the config of the running proxy, nil if unknown.
+func (p *SwapProxy) reloadModelFiles(cfg *conf.GoInferConf, proxyCfgFile string, files []string, applied []byte) []byte {
+	data, err := os.ReadFile(proxyCfgFile)
+	if err != nil {
+		fmt.Printf("WARNING cannot read %s: %v => llama-swap config not updated\n", proxyCfgFile, err)
+		return applied
+	}
+
+	modelFiles := models.Classify(files)
+	merged, changes, err := conf.MergeProxyConf(data, modelFiles, cfg.Models, cfg.Whisper)
+	if err != nil {
+		fmt.Printf("ERROR cannot merge the model files into %s: %v\n", proxyCfgFile, err)
+		return applied
+	}
+
+	if applied == nil && !slices.ContainsFunc(changes, func(c conf.ProxyChange) bool { return c.Kind != conf.ChangeKeep }) {
+		return merged // the running config is up to date
+	}
+	if bytes.Equal(merged, applied) {
+		return applied
+	}
+
+	// the scan drops all the generated entries: models_dir may be unmounted
+	// or transiently empty, a reload would stop all the models
+	if len(modelFiles) == 0 {
+		fmt.Println("WARNING no model file found in", cfg.ModelsDir, "=> llama-swap config not updated, restart goinfer to remove the model entries")
+		return applied
+	}
+
+	px, err := loadProxyConf(merged)
+	if err != nil {
+		fmt.Println("ERROR invalid llama-swap config => not reloaded:", err)
+		return applied
+	}
+
+	p.Reload(px)
+	if state.Verbose {
+		fmt.Println("llama-swap config reloaded:", len(px.Models), "models,", len(files), "model files")
+	}
+	return merged
+}
+
+// loadProxyConf parses a llama-swap config with the llama-swap loader (macros, defaults).
+func loadProxyConf(data []byte) (proxy.Config, error) {
+	f, err := os.CreateTemp("", "llama-swap-*.yml")
+	if err != nil {
+		return proxy.Config{}, err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return proxy.Config{}, err
+	}
+	return proxy.LoadConfig(f.Name())
+}
+
+// NewProxyServer creates the llama-swap server if a listen address has the swap service.
+func NewProxyServer(cfg conf.GoInferConf) (*http.Server, *SwapProxy) {
 	for addr, services := range cfg.Server.Listen {
 		if strings.Contains(services, "swap") {
-			pm := proxy.New(cfg.Proxy)
+			p := NewSwapProxy(cfg.Proxy)
 			srv := &http.Server{
 				Addr:    addr,
-				Handler: pm,
+				Handler: trackRequests(p),
 			}
-			return srv, pm
+			return srv, p
 		}
 	}
 	return nil, nil // llama-swap not present => not enabled
 }
+
+// trackRequests records the requests to the llama-swap models in state.SwapActivity,
+// and the model processes started and stopped by llama-swap to serve them.
+func trackRequests(p *SwapProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := p.Config()
+		if r.URL.Path == "/unload" {
+			p.ServeHTTP(w, r)
+			unloaded(cfg.Models)
+			return
+		}
+
+		model := requestModel(r, &cfg)
+		if model == "" {
+			p.ServeHTTP(w, r)
+			return
+		}
+
+		expire(model, cfg.Models[model].UnloadAfter)
+		state.SwapActivity.Begin(model)
+		defer state.SwapActivity.End(model)
+		p.ServeHTTP(&activityWriter{ResponseWriter: w, model: model, swapped: swappedModels(&cfg, model)}, r)
+	})
+}
+
+// expire records the unloading of a model idle for more than its TTL (seconds):
+// llama-swap has stopped it.
+func expire(model string, ttl int) {
+	act := state.SwapActivity.Get(model)
+	if ttl <= 0 || act.InFlight > 0 || act.Loaded.IsZero() {
+		return
+	}
+	since := act.LastRequest // the TTL starts after the last request
+	if since.Before(act.Loaded) {
+		since = act.Loaded
+	}
+	if time.Since(since) > time.Duration(ttl)*time.Second {
+		state.SwapActivity.Unloaded(model)
+	}
+}
+
+// defaultGroup is the llama-swap group of the models without group.
+const defaultGroup = "(default)"
+
+// swappedModels returns the models llama-swap stops to run the model:
+// the other members of a swap group, and the models of the other groups
+// (except the persistent ones) for an exclusive group.
+func swappedModels(cfg *proxy.Config, model string) []string {
+	groups := swapGroups(cfg)
+
+	var swapped []string
+	for name, g := range groups {
+		if !slices.Contains(g.Members, model) {
+			continue
+		}
+		for other, o := range groups {
+			if (other == name && g.Swap) || (other != name && g.Exclusive && !o.Persistent) {
+				swapped = append(swapped, slices.DeleteFunc(slices.Clone(o.Members), func(m string) bool { return m == model })...)
+			}
+		}
+	}
+	return swapped
+}
+
+// swapGroups returns the llama-swap groups, with the default group of the models without group.
+func swapGroups(cfg *proxy.Config) map[string]proxy.GroupConfig {
+	groups := maps.Clone(cfg.Groups)
+	if groups == nil {
+		groups = map[string]proxy.GroupConfig{}
+	}
+	grouped := map[string]bool{}
+	for _, g := range groups {
+		for _, m := range g.Members {
+			grouped[m] = true
+		}
+	}
+	def := proxy.GroupConfig{Swap: true, Exclusive: true}
+	for id := range cfg.Models {
+		if !grouped[id] {
+			def.Members = append(def.Members, id)
+		}
+	}
+	if _, ok := groups[defaultGroup]; !ok && len(def.Members) > 0 {
+		groups[defaultGroup] = def
+	}
+	return groups
+}
+
+// requestModel returns the llama-swap model of a request: from the /upstream/<model>/
+// path, else from the model field of a JSON body. Returns "" if the model is unknown.
+func requestModel(r *http.Request, cfg *proxy.Config) string {
+	var name string
+
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/upstream/"); ok {
+		name, _, _ = strings.Cut(rest, "/")
+		name, _ = url.PathUnescape(name)
+	} else if r.Method == http.MethodPost && r.Body != nil {
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mt != "application/json" {
+			return ""
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body)) // for llama-swap
+		if err != nil {
+			return ""
+		}
+		var req struct {
+			Model string `json:"model"`
+		}
+		_ = json.Unmarshal(body, &req)
+		name = req.Model
+	}
+
+	if name == "" {
+		return ""
+	}
+	id, _ := cfg.RealModelName(name)
+	return id
+}
+
+// activityWriter records the first response of the model: llama-swap replies once the model is loaded,
+// after stopping the swapped models.
+type activityWriter struct {
+	http.ResponseWriter
+	model   string
+	swapped []string
+	wrote   bool
+}
+
+func (w *activityWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.wrote = true
+		if code < http.StatusBadRequest {
+			for _, m := range w.swapped {
+				state.SwapActivity.Unloaded(m)
+			}
+			state.SwapActivity.Responded(w.model)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *activityWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps the streamed responses flowing.
+func (w *activityWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController.
+func (w *activityWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
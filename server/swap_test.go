@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy"
+	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/lm"
+	"github.com/synw/goinfer/state"
+)
+
+func TestSwappedModels(t *testing.T) {
+	cfg := proxy.Config{
+		Models: map[string]proxy.ModelConfig{
+			"a1": {}, "a2": {}, "b1": {}, "b2": {}, "p": {}, "x": {}, "y": {},
+		},
+		Groups: map[string]proxy.GroupConfig{
+			"a":    {Swap: true, Exclusive: true, Members: []string{"a1", "a2"}},
+			"b":    {Swap: false, Exclusive: false, Members: []string{"b1", "b2"}},
+			"pers": {Swap: true, Persistent: true, Members: []string{"p"}},
+		},
+	}
+
+	tests := []struct {
+		model string
+		want  []string
+	}{
+		{"a1", []string{"a2", "b1", "b2", "x", "y"}}, // swap and exclusive
+		{"b1", nil}, // neither swap nor exclusive
+		{"p", nil},
+		{"x", []string{"a1", "a2", "b1", "b2", "y"}}, // default group: swap and exclusive
+	}
+	for _, tt := range tests {
+		got := swappedModels(&cfg, tt.model)
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: swapped %v, want %v", tt.model, got, tt.want)
+		}
+	}
+}
+
+// fakeSwap is a llama-swap proxy.ProxyManager starting the models on request.
+type fakeSwap struct {
+	cfg      proxy.Config
+	mu       sync.Mutex
+	running  map[string]bool
+	requests int
+	shutdown bool
+	stopping chan struct{} // if not nil, Shutdown waits until it is closed
+}
+
+func (f *fakeSwap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/running":
+		list := []lm.RunningModel{}
+		for id := range f.running {
+			list = append(list, lm.RunningModel{Model: id, State: "ready", Proxy: f.cfg.Models[id].Proxy})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"running": list})
+	case r.URL.Path == "/unload":
+		clear(f.running)
+	case strings.HasPrefix(r.URL.Path, "/upstream/"):
+		model, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/upstream/"), "/")
+		for _, id := range swappedModels(&f.cfg, model) {
+			delete(f.running, id)
+		}
+		f.running[model] = true
+		f.requests++
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeSwap) Shutdown() {
+	if f.stopping != nil {
+		<-f.stopping
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clear(f.running)
+	f.shutdown = true
+}
+
+// newFakeSwapProxy returns a SwapProxy of fakeSwap managers, listed by creation order.
+func newFakeSwapProxy(cfg proxy.Config) (*SwapProxy, *[]*fakeSwap) {
+	var managers []*fakeSwap
+	p := newSwapProxy(cfg, func(cfg proxy.Config) swapManager {
+		f := &fakeSwap{cfg: cfg, running: map[string]bool{}}
+		managers = append(managers, f)
+		return f
+	})
+	return p, &managers
+}
+
+func load(p *SwapProxy, models ...string) {
+	for _, m := range models {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/upstream/"+m+"/health", nil))
+	}
+}
+
+func TestSwapProxyReload(t *testing.T) {
+	p, managers := newFakeSwapProxy(proxy.Config{Models: map[string]proxy.ModelConfig{"a": {}}})
+	load(p, "a")
+	old := (*managers)[0]
+	old.stopping = make(chan struct{})
+
+	reloaded := make(chan struct{})
+	go func() {
+		p.Reload(proxy.Config{Models: map[string]proxy.ModelConfig{"a": {}, "b": {}}})
+		close(reloaded)
+	}()
+
+	// the config is swapped while the previous models are stopping
+	for len(p.Config().Models) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	served := make(chan struct{})
+	go func() {
+		load(p, "b")
+		close(served)
+	}()
+	select {
+	case <-served:
+		t.Fatal("request served before the previous models are stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(old.stopping)
+	<-reloaded
+	<-served
+	current := (*managers)[1]
+	if !old.shutdown || !maps.Equal(current.running, map[string]bool{"b": true}) {
+		t.Errorf("previous proxy shutdown %v, current running %v", old.shutdown, current.running)
+	}
+}
+
+func TestSwapProxyReloadCanceled(t *testing.T) {
+	p, managers := newFakeSwapProxy(proxy.Config{})
+	old := (*managers)[0]
+	old.stopping = make(chan struct{})
+	defer close(old.stopping)
+	go p.Reload(proxy.Config{Models: map[string]proxy.ModelConfig{"a": {}}})
+
+	for len(p.Config().Models) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/running", nil).WithContext(ctx))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rec.Code)
+	}
+}
+
+func TestReloadModelFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfgFile := filepath.Join(dir, "llama-swap.yml")
+	if err := os.WriteFile(cfgFile, []byte("models:\n  manual:\n    cmd: llama-server --port ${PORT}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &conf.GoInferConf{ModelsDir: dir}
+	p, managers := newFakeSwapProxy(proxy.Config{})
+
+	// the running config is up to date: not reloaded
+	applied := p.reloadModelFiles(cfg, cfgFile, nil, nil)
+	if applied == nil || len(*managers) != 1 {
+		t.Fatalf("applied %q, %d managers", applied, len(*managers))
+	}
+
+	files := []string{filepath.Join(dir, "a.gguf"), filepath.Join(dir, "b.gguf")}
+	applied = p.reloadModelFiles(cfg, cfgFile, files, applied)
+	if len(*managers) != 2 || len(p.Config().Models) != 5 {
+		t.Fatalf("%d managers, models %v", len(*managers), slices.Sorted(maps.Keys(p.Config().Models)))
+	}
+
+	// unchanged files: not reloaded
+	if p.reloadModelFiles(cfg, cfgFile, files, applied); len(*managers) != 2 {
+		t.Errorf("reloaded with unchanged files")
+	}
+
+	// an empty scan keeps the generated entries
+	if got := p.reloadModelFiles(cfg, cfgFile, nil, applied); len(*managers) != 2 || !bytes.Equal(got, applied) {
+		t.Errorf("reloaded after an empty scan: %d managers", len(*managers))
+	}
+
+	applied = p.reloadModelFiles(cfg, cfgFile, files[:1], applied)
+	if len(*managers) != 3 || len(p.Config().Models) != 3 {
+		t.Errorf("%d managers, models %v", len(*managers), slices.Sorted(maps.Keys(p.Config().Models)))
+	}
+	if !strings.Contains(string(applied), "manual:") {
+		t.Errorf("the hand-written entry is lost:\n%s", applied)
+	}
+}
+
+func TestTrackRequests(t *testing.T) {
+	p, _ := newFakeSwapProxy(proxy.Config{
+		Models: map[string]proxy.ModelConfig{"tr-a1": {}, "tr-a2": {}, "tr-b": {}},
+		Groups: map[string]proxy.GroupConfig{"a": {Swap: true, Members: []string{"tr-a1", "tr-a2"}}},
+	})
+	h := trackRequests(p)
+	serve := func(path string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	loaded := func(model string) bool {
+		return !state.SwapActivity.Get(model).Loaded.IsZero()
+	}
+
+	serve("/upstream/tr-a1/health")
+	if act := state.SwapActivity.Get("tr-a1"); act.Loaded.IsZero() || act.InFlight != 0 || act.LastRequest.IsZero() {
+		t.Fatalf("tr-a1 activity: %+v", act)
+	}
+
+	// the swap group a: tr-a2 stops tr-a1
+	serve("/upstream/tr-a2/health")
+	if loaded("tr-a1") || !loaded("tr-a2") {
+		t.Errorf("loaded: tr-a1 %v, tr-a2 %v", loaded("tr-a1"), loaded("tr-a2"))
+	}
+
+	// the default group is exclusive: tr-b stops the group a
+	serve("/upstream/tr-b/health")
+	if loaded("tr-a2") || !loaded("tr-b") {
+		t.Errorf("loaded: tr-a2 %v, tr-b %v", loaded("tr-a2"), loaded("tr-b"))
+	}
+
+	// a failed request stops nothing
+	w := &activityWriter{ResponseWriter: httptest.NewRecorder(), model: "tr-a1", swapped: []string{"tr-b"}}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if loaded("tr-a1") || !loaded("tr-b") {
+		t.Errorf("after an error: tr-a1 %v, tr-b %v", loaded("tr-a1"), loaded("tr-b"))
+	}
+
+	serve("/unload")
+	if loaded("tr-b") {
+		t.Error("tr-b loaded after /unload")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	t.Parallel()
+	for _, m := range []string{"ex-idle", "ex-busy", "ex-nottl", "ex-recent"} {
+		state.SwapActivity.Begin(m)
+		state.SwapActivity.Responded(m)
+		if m != "ex-busy" {
+			state.SwapActivity.End(m)
+		}
+	}
+	expire("ex-idle", 1) // not expired yet
+	time.Sleep(1100 * time.Millisecond)
+	state.SwapActivity.Begin("ex-recent")
+	state.SwapActivity.End("ex-recent") // the TTL starts after the last request
+
+	tests := []struct {
+		model   string
+		ttl     int
+		expired bool
+	}{
+		{"ex-idle", 1, true},
+		{"ex-busy", 1, false}, // a request is in flight
+		{"ex-nottl", 0, false},
+		{"ex-recent", 1, false},
+	}
+	for _, tt := range tests {
+		expire(tt.model, tt.ttl)
+		if expired := state.SwapActivity.Get(tt.model).Loaded.IsZero(); expired != tt.expired {
+			t.Errorf("%s: expired %v, want %v", tt.model, expired, tt.expired)
+		}
+	}
+	state.SwapActivity.End("ex-busy")
+}
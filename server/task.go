@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/lm"
+	"github.com/synw/goinfer/state"
+	"github.com/synw/goinfer/tasks"
+)
+
+// executeTaskRequest is the payload of a /task/execute request.
+type executeTaskRequest struct {
+	Task        string `json:"task"`
+	Prompt      string `json:"prompt"`
+	Instruction string `json:"instruction"`
+	Stream      *bool  `json:"stream"` // overrides the stream param of the task
+}
+
+// replyTaskError replies 404 when the task does not exist, 400 for an invalid path, else 500.
+func replyTaskError(c echo.Context, name string, err error) error {
+	if errors.Is(err, tasks.ErrNotFound) {
+		return replyError(c, http.StatusNotFound, lm.ErrCodeNotFound, err.Error(), name)
+	}
+	if errors.Is(err, tasks.ErrInvalidPath) {
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), name)
+	}
+	return replyError(c, http.StatusInternalServerError, lm.ErrCodeInternal, err.Error(), name)
+}
+
+// ListTasksHandler returns the tree of the tasks.
+func (h *Handlers) ListTasksHandler(c echo.Context) error {
+	nodes, err := tasks.Dir(h.Cfg.TasksDir).List()
+	if err != nil {
+		return replyError(c, http.StatusInternalServerError, lm.ErrCodeInternal, "cannot read the tasks: "+err.Error(), nil)
+	}
+	return c.JSON(http.StatusOK, nodes)
+}
+
+// ReadTaskHandler returns a task, the path is relative to tasks_dir (e.g. code/json/fix).
+func (h *Handlers) ReadTaskHandler(c echo.Context) error {
+	name := c.Param("*")
+	t, err := tasks.Dir(h.Cfg.TasksDir).Read(name)
+	if err != nil {
+		return replyTaskError(c, name, err)
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+// SaveTaskHandler saves a task in tasks_dir, the missing params take the default values.
+func (h *Handlers) SaveTaskHandler(c echo.Context) error {
+	t := tasks.New("")
+	var modelConf, inferParams json.RawMessage
+	errs, err := decodeFields(c.Request().Body, map[string]any{
+		"name":        &t.Name,
+		"template":    &t.Template,
+		"modelConf":   &modelConf,
+		"inferParams": &inferParams,
+	})
+	if err != nil {
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+	if t.Name == "" && !errs.has("name") {
+		errs.add(lm.ErrCodeMissingField, "name", "missing mandatory field: name")
+	}
+
+	// decoded over the default values
+	params := []struct {
+		name string
+		raw  json.RawMessage
+		dst  any
+	}{{"modelConf", modelConf, &t.ModelConf}, {"inferParams", inferParams, &t.InferParams}}
+	for _, p := range params {
+		if p.raw == nil {
+			continue
+		}
+		if err := json.Unmarshal(p.raw, p.dst); err != nil {
+			errs.add(lm.ErrCodeInvalidType, p.name, fmt.Sprintf("invalid value for %s: %s", p.name, typeErrorMessage(err)))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	err = tasks.Dir(h.Cfg.TasksDir).Save(t)
+	if err != nil {
+		if errors.Is(err, tasks.ErrInvalidPath) {
+			return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), "name")
+		}
+		return replyError(c, http.StatusInternalServerError, lm.ErrCodeInternal, "failed to save task: "+err.Error(), t.Name)
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// ExecuteTaskHandler runs a task: {prompt} and {instruction} are substituted in the task template.
+func (h *Handlers) ExecuteTaskHandler(c echo.Context) error {
+	var req executeTaskRequest
+	errs, err := decodeFields(c.Request().Body, map[string]any{
+		"task":        &req.Task,
+		"prompt":      &req.Prompt,
+		"instruction": &req.Instruction,
+		"stream":      &req.Stream,
+	})
+	if err != nil {
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+	if req.Task == "" && !errs.has("task") {
+		errs.add(lm.ErrCodeMissingField, "task", "missing mandatory field: task")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	t, err := tasks.Dir(h.Cfg.TasksDir).Read(req.Task)
+	if err != nil {
+		return replyTaskError(c, req.Task, err)
+	}
+
+	query := t.Query(req.Prompt, req.Instruction)
+	if req.Stream != nil {
+		query.InferParams.Stream = *req.Stream
+	}
+
+	if state.Verbose {
+		fmt.Println("Executing task", t.Name)
+	}
+
+	return h.infer(c, query)
+}
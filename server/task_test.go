@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/synw/goinfer/conf"
+	"github.com/synw/goinfer/tasks"
+)
+
+func TestTaskHandlers(t *testing.T) {
+	cfg := conf.GoInferConf{TasksDir: t.TempDir()}
+	e := NewEchoServer(cfg, nil, nil, ":0", "goinfer")
+
+	rec := postJSON(e, "/task/save", `{"name":"code/fix","template":"{prompt}","inferParams":{"top_k":10}}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/task/code/fix", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var task tasks.Task
+	if err := json.Unmarshal(rec.Body.Bytes(), &task); err != nil {
+		t.Fatal(err)
+	}
+	// the missing params take the default values
+	if task.InferParams.TopK != 10 || task.InferParams.MaxTokens != tasks.New("").InferParams.MaxTokens {
+		t.Errorf("inferParams = %+v", task.InferParams)
+	}
+}
+
+func TestTaskHandlersErrors(t *testing.T) {
+	cfg := conf.GoInferConf{TasksDir: t.TempDir()}
+	e := NewEchoServer(cfg, nil, nil, ":0", "goinfer")
+
+	saves := []struct {
+		name string
+		body string
+	}{
+		{"missing name", `{"template":"{prompt}"}`},
+		{"unknown field", `{"name":"x","foo":1}`},
+		{"invalid params", `{"name":"x","inferParams":{"top_k":"ten"}}`},
+		{"invalid path", `{"name":"../x"}`},
+		{"not an object", `[]`},
+	}
+	for _, tt := range saves {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postJSON(e, "/task/save", tt.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want 400: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+
+	for path, status := range map[string]int{
+		"/task/missing":     http.StatusNotFound,
+		"/task/../outside":  http.StatusBadRequest,
+		"/task//etc/passwd": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != status {
+			t.Errorf("%s: status %d, want %d: %s", path, rec.Code, status, rec.Body)
+		}
+	}
+}
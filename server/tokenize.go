@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"github.com/synw/goinfer/lm"
+)
+
+// TokenizeHandler forwards a /tokenize request to the llama-server of the model.
+func (h *Handlers) TokenizeHandler(c echo.Context) error {
+	return h.forwardLlama(c, "/tokenize")
+}
+
+// DetokenizeHandler forwards a /detokenize request to the llama-server of the model.
+func (h *Handlers) DetokenizeHandler(c echo.Context) error {
+	return h.forwardLlama(c, "/detokenize")
+}
+
+// forwardLlama forwards the request payload to the llama-server of the model,
+// the model field is removed from the payload. The response is copied as is.
+func (h *Handlers) forwardLlama(c echo.Context, path string) error {
+	data, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, "cannot read the request body: "+err.Error(), nil)
+	}
+
+	var name string
+	errs, err := decodeFields(bytes.NewReader(data), map[string]any{"model": &name})
+	if err != nil {
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+	// the other fields are the ones of the llama-server endpoint
+	errs = slices.DeleteFunc(errs, func(err *lm.InferError) bool { return err.Code == lm.ErrCodeUnknownField })
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// cannot fail: decodeFields has decoded the same object
+	payload := map[string]json.RawMessage{}
+	_ = json.Unmarshal(data, &payload)
+	delete(payload, "model")
+
+	srv, err := h.goinferLlamaServer(name)
+	if err != nil {
+		return replyBackendError(c, name, err)
+	}
+
+	resp, err := srv.Post(c.Request().Context(), path, payload)
+	if err != nil {
+		return replyBackendError(c, name, err)
+	}
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get(echo.HeaderContentType)
+	if contentType == "" {
+		contentType = echo.MIMEApplicationJSON
+	}
+	return c.Stream(resp.StatusCode, contentType, resp.Body)
+}
+
+// countTokensRequest is the payload of a /count_tokens request.
+type countTokensRequest struct {
+	Model      string  `json:"model"`
+	Content    *string `json:"content"`
+	AddSpecial *bool   `json:"add_special"`
+}
+
+// CountTokensResponse is the response of a /count_tokens request.
+type CountTokensResponse struct {
+	Count int `json:"count"` // tokens of the content
+	Ctx   int `json:"ctx"`   // context size of a llama-server slot
+}
+
+// CountTokensHandler returns the number of tokens of the content and the context size
+// of the llama-server of the model: the prompt plus max_tokens must fit in it.
+func (h *Handlers) CountTokensHandler(c echo.Context) error {
+	var req countTokensRequest
+	errs, err := decodeFields(c.Request().Body, map[string]any{
+		"model":       &req.Model,
+		"content":     &req.Content,
+		"add_special": &req.AddSpecial,
+	})
+	if err != nil {
+		return replyError(c, http.StatusBadRequest, lm.ErrCodeInvalidParams, err.Error(), nil)
+	}
+	if req.Content == nil && !errs.has("content") {
+		errs.add(lm.ErrCodeMissingField, "content", "missing mandatory field: content")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	addSpecial := true // like a prompt
+	if req.AddSpecial != nil {
+		addSpecial = *req.AddSpecial
+	}
+
+	srv, err := h.goinferLlamaServer(req.Model)
+	if err != nil {
+		return replyBackendError(c, req.Model, err)
+	}
+
+	tokens, err := srv.Tokenize(c.Request().Context(), *req.Content, addSpecial)
+	if err != nil {
+		return replyBackendError(c, req.Model, err)
+	}
+
+	nctx, err := srv.ContextSize(c.Request().Context())
+	if err != nil {
+		return replyBackendError(c, req.Model, err)
+	}
+
+	return c.JSON(http.StatusOK, CountTokensResponse{Count: len(tokens), Ctx: nctx})
+}
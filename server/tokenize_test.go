@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestTokenizeHandler(t *testing.T) {
+	// the fake llama-server replies the payload it receives
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		_, _ = io.Copy(w, r.Body)
+	}))
+	t.Cleanup(srv.Close)
+	e := newTestServer(srv.URL)
+
+	rec := postJSON(e, "/tokenize", `{"model":"m","content":"Hello","with_pieces":true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := payload["model"]; ok || payload["content"] != "Hello" || payload["with_pieces"] != true {
+		t.Errorf("forwarded payload = %v", payload)
+	}
+
+	for _, body := range []string{`{"model":1}`, `[]`} {
+		rec = postJSON(e, "/detokenize", body)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400: %s", body, rec.Code, rec.Body)
+		}
+	}
+}
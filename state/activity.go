@@ -0,0 +1,82 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// ModelActivity is the activity of a llama-swap model as seen by goinfer:
+// llama-swap reports the running models but not their requests.
+type ModelActivity struct {
+	InFlight    int       // requests in progress
+	LastRequest time.Time // end of the last request
+	Loaded      time.Time // first response of the current model process
+}
+
+// Activity records the requests to the llama-swap models. It is safe for concurrent use.
+type Activity struct {
+	mu     sync.Mutex
+	models map[string]*ModelActivity
+}
+
+// NewActivity creates an empty activity record.
+func NewActivity() *Activity {
+	return &Activity{models: map[string]*ModelActivity{}}
+}
+
+// SwapActivity records the requests to the llama-swap proxy.
+var SwapActivity = NewActivity()
+
+func (a *Activity) model(name string) *ModelActivity {
+	m, ok := a.models[name]
+	if !ok {
+		m = &ModelActivity{}
+		a.models[name] = m
+	}
+	return m
+}
+
+// Begin records the start of a request.
+func (a *Activity) Begin(model string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.model(model).InFlight++
+}
+
+// Responded records a response of the model: the model is loaded.
+func (a *Activity) Responded(model string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m := a.model(model)
+	if m.Loaded.IsZero() {
+		m.Loaded = time.Now()
+	}
+}
+
+// End records the end of a request.
+func (a *Activity) End(model string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	m := a.model(model)
+	m.InFlight = max(m.InFlight-1, 0)
+	m.LastRequest = time.Now()
+}
+
+// Unloaded records that the model process has stopped.
+func (a *Activity) Unloaded(model string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if m, ok := a.models[model]; ok {
+		m.Loaded = time.Time{}
+	}
+}
+
+// Get returns the activity of a model.
+func (a *Activity) Get(model string) ModelActivity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if m, ok := a.models[model]; ok {
+		return *m
+	}
+	return ModelActivity{}
+}
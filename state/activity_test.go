@@ -0,0 +1,66 @@
+package state
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestActivity(t *testing.T) {
+	a := NewActivity()
+
+	if act := a.Get("m"); act != (ModelActivity{}) {
+		t.Errorf("unknown model: %+v", act)
+	}
+
+	a.Begin("m")
+	a.Begin("m")
+	if act := a.Get("m"); act.InFlight != 2 || !act.Loaded.IsZero() {
+		t.Errorf("before the response: %+v", act)
+	}
+
+	a.Responded("m")
+	loaded := a.Get("m").Loaded
+	a.Responded("m") // the model is loaded since the first response
+	if loaded.IsZero() || !a.Get("m").Loaded.Equal(loaded) {
+		t.Errorf("loaded %v, then %v", loaded, a.Get("m").Loaded)
+	}
+
+	a.End("m")
+	a.End("m")
+	a.End("m") // never below 0
+	act := a.Get("m")
+	if act.InFlight != 0 || act.LastRequest.Before(loaded) {
+		t.Errorf("after the requests: %+v", act)
+	}
+
+	a.Unloaded("m")
+	a.Unloaded("other")
+	if act := a.Get("m"); !act.Loaded.IsZero() || act.LastRequest.IsZero() {
+		t.Errorf("unloaded: %+v", act)
+	}
+	if act := a.Get("other"); act != (ModelActivity{}) {
+		t.Errorf("unloaded unknown model: %+v", act)
+	}
+}
+
+func TestActivityConcurrent(t *testing.T) {
+	a := NewActivity()
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.Begin("m")
+			a.Responded("m")
+			a.Get("m")
+			a.Unloaded("m")
+			a.End("m")
+		}()
+	}
+	wg.Wait()
+
+	if act := a.Get("m"); act.InFlight != 0 {
+		t.Errorf("%d requests in flight", act.InFlight)
+	}
+}
@@ -0,0 +1,227 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// Priority of an inference request in the queue.
+type Priority int
+
+const (
+	PriorityBatch       Priority = 0
+	PriorityInteractive Priority = 1
+)
+
+// ParsePriority converts "interactive" (default) or "batch".
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "", "interactive":
+		return PriorityInteractive, nil
+	case "batch":
+		return PriorityBatch, nil
+	default:
+		return PriorityInteractive, errors.New("priority must be interactive or batch, got " + s)
+	}
+}
+
+// ErrQueueFull is returned by Enqueue when the waiting line is full.
+var ErrQueueFull = errors.New("inference queue is full")
+
+// Queue admits the inferences: at most a number of running inferences per model,
+// the others wait by priority, then in FIFO order. It is safe for concurrent use.
+type Queue struct {
+	mu          sync.Mutex
+	depth       int            // max waiting tickets, 0 => unbounded
+	concurrency int            // default max running inferences per model
+	limits      map[string]int // per-model max running inferences
+	running     map[string]int
+	waiting     []*Ticket // sorted: priority desc, then seq asc
+	seq         uint64
+}
+
+// NewQueue creates a queue. depth is the max number of waiting requests (0 => unbounded),
+// concurrency the default max running inferences per model, limits the per-model overrides.
+func NewQueue(depth, concurrency int, limits map[string]int) *Queue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Queue{
+		depth:       depth,
+		concurrency: concurrency,
+		limits:      limits,
+		running:     map[string]int{},
+	}
+}
+
+// InferenceQueue schedules the inferences running on this goinfer instance.
+var InferenceQueue = NewQueue(0, 1, nil)
+
+// Ticket is a place in the queue.
+type Ticket struct {
+	q        *Queue
+	model    string
+	priority Priority
+	seq      uint64
+	admitted bool
+	released bool
+	ready    chan struct{} // closed when admitted
+	position chan int      // latest position while waiting
+	sent     int           // last position sent, 0 => none
+}
+
+// Enqueue takes a ticket for the model. The ticket is admitted immediately
+// if the model has a free slot, else it waits (see Wait).
+// Returns ErrQueueFull when the waiting line is full.
+func (q *Queue) Enqueue(model string, priority Priority) (*Ticket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	t := &Ticket{
+		q:        q,
+		model:    model,
+		priority: priority,
+		seq:      q.seq,
+		ready:    make(chan struct{}),
+		position: make(chan int, 1),
+	}
+
+	// a free slot implies nobody waits for this model
+	if q.running[model] < q.limit(model) {
+		q.admit(t)
+		return t, nil
+	}
+
+	if q.depth > 0 && len(q.waiting) >= q.depth {
+		return nil, ErrQueueFull
+	}
+
+	i, _ := slices.BinarySearchFunc(q.waiting, t, compareTickets)
+	q.waiting = slices.Insert(q.waiting, i, t)
+	q.dispatch()
+	return t, nil
+}
+
+// Position returns the position in the waiting line of the model (1 = next), 0 when admitted.
+func (t *Ticket) Position() int {
+	t.q.mu.Lock()
+	defer t.q.mu.Unlock()
+	return t.q.position(t)
+}
+
+// Wait blocks until the ticket is admitted. onPosition is called when the position changes.
+// When ctx is canceled, the ticket leaves the queue and ctx.Err() is returned.
+func (t *Ticket) Wait(ctx context.Context, onPosition func(position int)) error {
+	for {
+		select {
+		case <-t.ready:
+			return nil
+		case pos := <-t.position:
+			if onPosition != nil {
+				onPosition(pos)
+			}
+		case <-ctx.Done():
+			t.Release()
+			return ctx.Err()
+		}
+	}
+}
+
+// Release frees the slot (or leaves the waiting line). Safe to call several times.
+func (t *Ticket) Release() {
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if t.released {
+		return
+	}
+	t.released = true
+
+	if t.admitted {
+		q.running[t.model]--
+	} else {
+		q.waiting = slices.DeleteFunc(q.waiting, func(w *Ticket) bool { return w == t })
+	}
+	q.dispatch()
+}
+
+// Waiting returns the number of waiting tickets.
+func (q *Queue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// dispatch admits the waiting tickets having a free slot and notifies the positions that changed.
+// q.mu must be locked.
+func (q *Queue) dispatch() {
+	q.waiting = slices.DeleteFunc(q.waiting, func(t *Ticket) bool {
+		if q.running[t.model] < q.limit(t.model) {
+			q.admit(t)
+			return true
+		}
+		return false
+	})
+
+	for _, t := range q.waiting {
+		pos := q.position(t)
+		if pos == t.sent {
+			continue
+		}
+		t.sent = pos
+		select {
+		case <-t.position: // drop the outdated position
+		default:
+		}
+		t.position <- pos
+	}
+}
+
+// admit marks the ticket as running. q.mu must be locked.
+func (q *Queue) admit(t *Ticket) {
+	t.admitted = true
+	q.running[t.model]++
+	close(t.ready)
+}
+
+// position of a waiting ticket among the tickets of the same model. q.mu must be locked.
+func (q *Queue) position(t *Ticket) int {
+	if t.admitted {
+		return 0
+	}
+	pos := 1
+	for _, w := range q.waiting {
+		if w == t {
+			return pos
+		}
+		if w.model == t.model {
+			pos++
+		}
+	}
+	return 0
+}
+
+// limit returns the max running inferences of the model.
+func (q *Queue) limit(model string) int {
+	if n, ok := q.limits[model]; ok && n > 0 {
+		return n
+	}
+	return q.concurrency
+}
+
+func compareTickets(a, b *Ticket) int {
+	if a.priority != b.priority {
+		return int(b.priority - a.priority) // higher priority first
+	}
+	switch {
+	case a.seq < b.seq:
+		return -1
+	case a.seq > b.seq:
+		return 1
+	}
+	return 0
+}
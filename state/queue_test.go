@@ -0,0 +1,124 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueConcurrent(t *testing.T) {
+	q := NewQueue(0, 2, map[string]int{"b": 1})
+
+	var running [2]atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 40 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, limit := i%2, int32(2-i%2)
+			priority := Priority(i % 3 % 2)
+			ticket, err := q.Enqueue([]string{"a", "b"}[m], priority)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer ticket.Release()
+
+			ctx := context.Background()
+			if i%5 == 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Millisecond)
+				defer cancel()
+			}
+			if err := ticket.Wait(ctx, func(int) {}); err != nil {
+				return // left the queue
+			}
+			if n := running[m].Add(1); n > limit {
+				t.Errorf("%d running inferences, limit %d", n, limit)
+			}
+			time.Sleep(time.Millisecond)
+			running[m].Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if n := q.Waiting(); n != 0 {
+		t.Errorf("%d waiting tickets left", n)
+	}
+	if q.running["a"] != 0 || q.running["b"] != 0 {
+		t.Errorf("running = %v", q.running)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := NewQueue(0, 1, nil)
+
+	first, _ := q.Enqueue("m", PriorityInteractive)
+	batch, _ := q.Enqueue("m", PriorityBatch)
+	interactive, _ := q.Enqueue("m", PriorityInteractive)
+
+	if p := batch.Position(); p != 2 {
+		t.Errorf("batch position = %d, want 2", p)
+	}
+	if p := interactive.Position(); p != 1 {
+		t.Errorf("interactive position = %d, want 1", p)
+	}
+
+	first.Release()
+	if p := interactive.Position(); p != 0 {
+		t.Errorf("interactive not admitted, position %d", p)
+	}
+	first.Release() // no effect
+	if p := batch.Position(); p != 1 {
+		t.Errorf("batch position = %d, want 1", p)
+	}
+	interactive.Release()
+	batch.Release()
+}
+
+func TestQueueFull(t *testing.T) {
+	q := NewQueue(1, 1, nil)
+
+	running, _ := q.Enqueue("m", PriorityInteractive)
+	waiting, _ := q.Enqueue("m", PriorityInteractive)
+	if _, err := q.Enqueue("m", PriorityInteractive); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("err = %v, want %v", err, ErrQueueFull)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waiting.Wait(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	if n := q.Waiting(); n != 0 {
+		t.Errorf("%d waiting tickets, the canceled ticket must leave the queue", n)
+	}
+	running.Release()
+}
+
+func TestQueuePositionChanges(t *testing.T) {
+	q := NewQueue(0, 1, nil)
+
+	running, _ := q.Enqueue("m", PriorityInteractive)
+	waiting, _ := q.Enqueue("m", PriorityInteractive)
+	if pos := <-waiting.position; pos != 1 {
+		t.Fatalf("position = %d, want 1", pos)
+	}
+
+	// the tickets of the other models do not move the position
+	other, _ := q.Enqueue("other", PriorityInteractive)
+	more, _ := q.Enqueue("m", PriorityBatch)
+	select {
+	case pos := <-waiting.position:
+		t.Errorf("position %d sent again", pos)
+	default:
+	}
+
+	more.Release()
+	other.Release()
+	running.Release()
+	waiting.Release()
+}
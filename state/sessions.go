@@ -0,0 +1,196 @@
+package state
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status of an inference session.
+type Status string
+
+const (
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusAborted Status = "aborted"
+	StatusFailed  Status = "failed"
+)
+
+// Session is one running inference: its own ID, cancellation context and status.
+type Session struct {
+	ID      string
+	Model   string
+	Started time.Time
+
+	ctx    context.Context // the session owns the inference lifetime
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	status Status
+}
+
+// Context is canceled when the session is aborted or when the client disconnects.
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// Status returns the current status of the session.
+func (s *Session) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Abort cancels the inference. Returns false if the session is already finished.
+func (s *Session) Abort() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != StatusRunning {
+		return false
+	}
+	s.status = StatusAborted
+	s.cancel()
+	return true
+}
+
+// Aborted reports whether Abort has been called (or the client has disconnected).
+func (s *Session) Aborted() bool {
+	return s.ctx.Err() != nil
+}
+
+// finish sets the final status, unless the session has been aborted.
+// A failure caused by a client disconnection is also an abort.
+func (s *Session) finish(status Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == StatusRunning {
+		if status == StatusFailed && s.ctx.Err() != nil {
+			status = StatusAborted
+		}
+		s.status = status
+	}
+	s.cancel() // release the context resources
+}
+
+// SessionInfo is a snapshot of a session, safe to marshal.
+type SessionInfo struct {
+	ID      string    `json:"id"`
+	Model   string    `json:"model"`
+	Started time.Time `json:"started"`
+	Status  Status    `json:"status"`
+}
+
+// Sessions tracks the running inferences. It is safe for concurrent use.
+type Sessions struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+// NewSessions creates an empty session manager.
+func NewSessions() *Sessions {
+	return &Sessions{sessions: map[string]*Session{}}
+}
+
+// Inferences tracks the inferences running on this goinfer instance.
+var Inferences = NewSessions()
+
+// Start registers a new running session. Its context is derived from parent
+// (the HTTP request context) so the session is canceled when the client disconnects.
+func (ss *Sessions) Start(parent context.Context, model string) *Session {
+	ctx, cancel := context.WithCancel(parent)
+	s := &Session{
+		ID:      newSessionID(),
+		Model:   model,
+		Started: time.Now(),
+		ctx:     ctx,
+		cancel:  cancel,
+		status:  StatusRunning,
+	}
+
+	ss.mu.Lock()
+	ss.sessions[s.ID] = s
+	ss.mu.Unlock()
+
+	return s
+}
+
+// Finish sets the final status of the session and forgets it.
+func (ss *Sessions) Finish(s *Session, status Status) {
+	s.finish(status)
+
+	ss.mu.Lock()
+	delete(ss.sessions, s.ID)
+	ss.mu.Unlock()
+}
+
+// Get returns a running session.
+func (ss *Sessions) Get(id string) (*Session, bool) {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	s, ok := ss.sessions[id]
+	return s, ok
+}
+
+// Count returns the number of running sessions.
+func (ss *Sessions) Count() int {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return len(ss.sessions)
+}
+
+// CountModel returns the number of running sessions for a model.
+func (ss *Sessions) CountModel(model string) int {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	n := 0
+	for _, s := range ss.sessions {
+		if s.Model == model {
+			n++
+		}
+	}
+	return n
+}
+
+// List returns a snapshot of the running sessions, oldest first.
+func (ss *Sessions) List() []SessionInfo {
+	ss.mu.RLock()
+	list := make([]SessionInfo, 0, len(ss.sessions))
+	for _, s := range ss.sessions {
+		list = append(list, SessionInfo{ID: s.ID, Model: s.Model, Started: s.Started, Status: s.Status()})
+	}
+	ss.mu.RUnlock()
+
+	slices.SortFunc(list, func(a, b SessionInfo) int {
+		if c := a.Started.Compare(b.Started); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+// AbortAll aborts all the running sessions and returns how many were aborted.
+func (ss *Sessions) AbortAll() int {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	n := 0
+	for _, s := range ss.sessions {
+		if s.Abort() {
+			n++
+		}
+	}
+	return n
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,67 @@
+package state
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestSessionsConcurrent(t *testing.T) {
+	ss := NewSessions()
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := ss.Start(context.Background(), "model")
+			if _, ok := ss.Get(s.ID); !ok {
+				t.Errorf("session %s not found", s.ID)
+			}
+			_ = ss.List()
+			if i%2 == 0 {
+				s.Abort()
+			}
+			ss.Finish(s, StatusDone)
+			if i%2 == 0 && s.Status() != StatusAborted {
+				t.Errorf("status = %s, want %s", s.Status(), StatusAborted)
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ss.AbortAll()
+			ss.CountModel("model")
+		}()
+	}
+	wg.Wait()
+
+	if n := ss.Count(); n != 0 {
+		t.Errorf("%d sessions left", n)
+	}
+}
+
+func TestSessionStatus(t *testing.T) {
+	ss := NewSessions()
+
+	s := ss.Start(context.Background(), "model")
+	ss.Finish(s, StatusDone)
+	if s.Status() != StatusDone {
+		t.Errorf("status = %s, want %s", s.Status(), StatusDone)
+	}
+	if s.Abort() {
+		t.Error("a finished session cannot be aborted")
+	}
+
+	// a failure caused by the client disconnection is an abort
+	ctx, cancel := context.WithCancel(context.Background())
+	s = ss.Start(ctx, "model")
+	cancel()
+	if !s.Aborted() {
+		t.Error("the session is not canceled with its parent")
+	}
+	ss.Finish(s, StatusFailed)
+	if s.Status() != StatusAborted {
+		t.Errorf("status = %s, want %s", s.Status(), StatusAborted)
+	}
+}
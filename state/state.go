@@ -1,11 +1,5 @@
 package state
 
-// Inference state.
-var (
-	ContinueInferringController = true
-	IsInferring                 = false
-)
-
 // app state.
 var (
 	Verbose = true
@@ -0,0 +1,326 @@
+package tasks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/synw/goinfer/state"
+	"github.com/synw/goinfer/types"
+	"gopkg.in/yaml.v3"
+)
+
+// Task is a predefined inference: a model, some inference parameters and a template.
+//
+//	name: code/json/fix
+//	modelConf:
+//	  name: mistral-7b-instruct-v0.1.Q4_K_M.gguf
+//	  ctx: 4096
+//	inferParams:
+//	  top_p: 0.35
+//	  temperature: 0.2
+//	template: |-
+//	  <s>[INST] {instruction}: {prompt} [/INST]
+type Task struct {
+	Name        string            `json:"name"        yaml:"name"`
+	ModelConf   types.ModelParams `json:"modelConf"   yaml:"modelConf"`
+	InferParams types.InferParams `json:"inferParams" yaml:"inferParams"`
+	Template    string            `json:"template"    yaml:"template"`
+}
+
+// New returns a task with the default model and inference parameters.
+func New(name string) Task {
+	return Task{
+		Name:        name,
+		ModelConf:   types.DefaultModelConf,
+		InferParams: types.DefaultInferParams,
+	}
+}
+
+// Render substitutes {prompt} and {instruction} in the template.
+func (t Task) Render(prompt, instruction string) string {
+	return strings.NewReplacer("{prompt}", prompt, "{instruction}", instruction).Replace(t.Template)
+}
+
+// Query returns the inference query of the task.
+func (t Task) Query(prompt, instruction string) types.InferQuery {
+	return types.InferQuery{
+		Prompt:      t.Render(prompt, instruction),
+		ModelParams: t.ModelConf,
+		InferParams: t.InferParams,
+	}
+}
+
+// ErrNotFound is returned when the task file does not exist.
+var ErrNotFound = errors.New("task not found")
+
+// ErrInvalidPath is returned when the task path is outside the tasks directory.
+var ErrInvalidPath = errors.New("invalid task path")
+
+// Dir is the root directory of the task files (*.yml).
+type Dir string
+
+// path returns the file path of a task: "code/json/fix" => "<dir>/code/json/fix.yml".
+// The path must stay inside the tasks directory.
+func (dir Dir) path(name string) (string, error) {
+	name = strings.TrimSuffix(filepath.ToSlash(name), ".yml") + ".yml"
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%w %q", ErrInvalidPath, name)
+	}
+	return filepath.Join(string(dir), filepath.FromSlash(name)), nil
+}
+
+// Read reads a task file, the missing parameters take the default values.
+func (dir Dir) Read(name string) (Task, error) {
+	p, err := dir.path(name)
+	if err != nil {
+		return Task{}, err
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Task{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to read task file %s: %w", p, err)
+	}
+
+	t, err := Parse(data)
+	if err != nil {
+		return t, fmt.Errorf("failed to parse task file %s: %w", p, err)
+	}
+
+	if t.Name == "" {
+		t.Name = strings.TrimSuffix(name, ".yml")
+	}
+
+	return t, nil
+}
+
+// Parse decodes a task in YAML. The former format (list of single-key maps
+// for modelConf and inferParams, n_predict, tfs_z) is still accepted.
+func Parse(data []byte) (Task, error) {
+	var node yaml.Node
+	err := yaml.Unmarshal(data, &node)
+	if err != nil {
+		return Task{}, err
+	}
+
+	flattenLegacyLists(&node)
+
+	t := New("")
+	if node.Kind == 0 {
+		return t, nil // empty file
+	}
+
+	// re-encode the node to decode it with unknown field detection
+	var buf bytes.Buffer
+	err = yaml.NewEncoder(&buf).Encode(&node)
+	if err != nil {
+		return t, err
+	}
+
+	dec := yaml.NewDecoder(&buf)
+	dec.KnownFields(true)
+	err = dec.Decode(&t)
+	return t, err
+}
+
+// legacyKeys renames the parameters of the former format, "" drops an obsolete parameter.
+var legacyKeys = map[string]string{
+	"n_predict":      "max_tokens",
+	"tfs_z":          "tfs",
+	"threads":        "",
+	"gpu_layers":     "",
+	"rope_freq_base": "",
+}
+
+// flattenLegacyLists converts the former modelConf and inferParams lists
+// of single-key maps into plain maps, and renames the former parameters.
+func flattenLegacyLists(node *yaml.Node) {
+	doc := node
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, val := doc.Content[i], doc.Content[i+1]
+		if key.Value != "modelConf" && key.Value != "inferParams" {
+			continue
+		}
+
+		var pairs []*yaml.Node
+		switch val.Kind {
+		case yaml.SequenceNode:
+			for _, item := range val.Content {
+				if item.Kind == yaml.MappingNode {
+					pairs = append(pairs, item.Content...)
+				}
+			}
+		case yaml.MappingNode:
+			pairs = val.Content
+		default:
+			continue
+		}
+
+		m := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for j := 0; j+1 < len(pairs); j += 2 {
+			k := pairs[j]
+			if newKey, ok := legacyKeys[k.Value]; ok {
+				if newKey == "" {
+					continue
+				}
+				k.Value = newKey
+			}
+			m.Content = append(m.Content, k, pairs[j+1])
+		}
+		doc.Content[i+1] = m
+	}
+}
+
+// Save writes the task in <dir>/<name>.yml, creating the sub-directories.
+func (dir Dir) Save(t Task) error {
+	if t.Name == "" {
+		return errors.New("missing task name")
+	}
+
+	p, err := dir.path(t.Name)
+	if err != nil {
+		return err
+	}
+
+	t.Name = strings.TrimSuffix(filepath.ToSlash(t.Name), ".yml")
+
+	var node yaml.Node
+	err = node.Encode(&t)
+	if err != nil {
+		return err
+	}
+	quoteStrings(&node, t)
+
+	data, err := yaml.Marshal(&node)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(p, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if state.Verbose {
+		fmt.Println("Task", t.Name, "saved in", p)
+	}
+
+	return nil
+}
+
+// quoteStrings sets the template and the stop prompts double-quoted: yaml.v3 loses
+// the trailing newlines of its literal block scalars ("\n\n" is read "\n").
+func quoteStrings(node *yaml.Node, t Task) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], node.Content[i+1]
+		switch key.Value {
+		case "template":
+			setQuoted(val, t.Template)
+		case "inferParams":
+			for j := 0; j+1 < len(val.Content); j += 2 {
+				if val.Content[j].Value == "stop" {
+					for k, stop := range val.Content[j+1].Content {
+						setQuoted(stop, t.InferParams.StopPrompts[k])
+					}
+				}
+			}
+		}
+	}
+}
+
+func setQuoted(node *yaml.Node, value string) {
+	if strings.HasSuffix(value, "\n") {
+		node.Value = value
+		node.Style = yaml.DoubleQuotedStyle
+	}
+}
+
+// Node is a directory or a task in the tree of tasks.
+type Node struct {
+	Key      string  `json:"key"`
+	Label    string  `json:"label"`
+	Path     string  `json:"path"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// List returns the tree of the task files, sorted by label.
+func (dir Dir) List() ([]*Node, error) {
+	root := &Node{}
+	key := 0
+
+	err := filepath.WalkDir(string(dir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".yml" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(string(dir), path)
+		if err != nil {
+			return err
+		}
+
+		current := root
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		for i, part := range parts {
+			label := strings.TrimSuffix(part, ".yml")
+			idx := slices.IndexFunc(current.Children, func(n *Node) bool { return n.Label == label })
+			if idx >= 0 {
+				current = current.Children[idx]
+				continue
+			}
+			key++
+			n := &Node{
+				Key:   strconv.Itoa(key),
+				Label: label,
+				Path:  strings.Join(parts[:i+1], "/"),
+			}
+			current.Children = append(current.Children, n)
+			current = n
+		}
+
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return []*Node{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sortNodes(root.Children)
+	if root.Children == nil {
+		return []*Node{}, nil
+	}
+
+	return root.Children, nil
+}
+
+func sortNodes(nodes []*Node) {
+	slices.SortFunc(nodes, func(a, b *Node) int { return strings.Compare(a.Label, b.Label) })
+	for _, n := range nodes {
+		sortNodes(n.Children)
+	}
+}
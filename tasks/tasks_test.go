@@ -0,0 +1,298 @@
+package tasks
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/synw/goinfer/types"
+)
+
+// writeTasks writes the task files in a new tasks directory.
+func writeTasks(t *testing.T, files map[string]string) Dir {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Dir(dir)
+}
+
+func TestRead(t *testing.T) {
+	dir := writeTasks(t, map[string]string{
+		"test_task.yml": `
+name: test_task
+template: "{system}\n\n{prompt}"
+modelConf:
+  name: test_model
+  ctx: 4096
+inferParams:
+  stream: true
+  max_tokens: 100
+  top_k: 50
+  top_p: 0.9
+  temperature: 0.7
+  frequency_penalty: 0.1
+  presence_penalty: 0.1
+  repeat_penalty: 1.1
+  tfs: 0.5
+  stop: ["\n", "User:", "Assistant:"]
+`,
+	})
+
+	task, err := dir.Read("test_task")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Task{
+		Name:      "test_task",
+		Template:  "{system}\n\n{prompt}",
+		ModelConf: types.ModelParams{Name: "test_model", Ctx: 4096},
+	}
+	want.InferParams = types.DefaultInferParams
+	want.InferParams.Stream = true
+	want.InferParams.MaxTokens = 100
+	want.InferParams.TopK = 50
+	want.InferParams.TopP = 0.9
+	want.InferParams.Temperature = 0.7
+	want.InferParams.FrequencyPenalty = 0.1
+	want.InferParams.PresencePenalty = 0.1
+	want.InferParams.RepeatPenalty = 1.1
+	want.InferParams.TailFreeSamplingZ = 0.5
+	want.InferParams.StopPrompts = []string{"\n", "User:", "Assistant:"}
+	assertTask(t, task, want)
+
+	// the .yml extension is optional
+	if _, err := dir.Read("test_task.yml"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadLegacyFormat(t *testing.T) {
+	dir := writeTasks(t, map[string]string{
+		"legacy.yml": `
+name: legacy
+template: "{prompt}"
+modelConf:
+  - name: test_model
+  - ctx: 2048
+    gpu_layers: 1
+inferParams:
+  - stream: false
+    threads: 4
+    n_predict: 100
+    tfs_z: 0.5
+`,
+	})
+
+	task, err := dir.Read("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := New("legacy")
+	want.Template = "{prompt}"
+	want.ModelConf.Name = "test_model"
+	want.InferParams.MaxTokens = 100
+	want.InferParams.TailFreeSamplingZ = 0.5
+	assertTask(t, task, want)
+}
+
+func TestReadDefaults(t *testing.T) {
+	dir := writeTasks(t, map[string]string{
+		"sub/minimal.yml": `template: "{prompt}"`,
+		"empty.yml":       "",
+	})
+
+	task, err := dir.Read("sub/minimal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := New("sub/minimal") // the name defaults to the path
+	want.Template = "{prompt}"
+	assertTask(t, task, want)
+
+	task, err = dir.Read("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTask(t, task, New("empty"))
+}
+
+func TestReadErrors(t *testing.T) {
+	dir := writeTasks(t, map[string]string{
+		"invalid.yml": "name: invalid\ninvalid: yaml: structure\n",
+		"unknown.yml": "name: unknown\ninferParams:\n  foo: 1\n",
+	})
+
+	_, err := dir.Read("missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v, want %v", err, ErrNotFound)
+	}
+
+	for _, name := range []string{"invalid", "unknown", "../outside", "/etc/passwd"} {
+		_, err := dir.Read(name)
+		if err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+
+	if _, err := dir.Read("../outside"); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("err = %v, want %v", err, ErrInvalidPath)
+	}
+}
+
+func TestReadPermissionError(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores the file permissions")
+	}
+	dir := writeTasks(t, map[string]string{"readonly/task.yml": "name: task"})
+	sub := filepath.Join(string(dir), "readonly")
+	if err := os.Chmod(sub, 0o300); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(sub, 0o755) })
+
+	_, err := dir.Read("readonly/task")
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v, want a read error", err)
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir := Dir(t.TempDir())
+
+	tests := []struct{ name, saved string }{
+		{"saved", "saved"},
+		{"sub/saved.yml", "sub/saved"},
+		{"level1/level2/level3/special-chars_task_123", "level1/level2/level3/special-chars_task_123"},
+	}
+	for _, tt := range tests {
+		task := New(tt.name)
+		task.Template = "Special: {prompt}\nWith: \"quotes\" and 'apostrophes'\n\n"
+		task.InferParams.StopPrompts = []string{"STOP", "\n\n"}
+		if err := dir.Save(task); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		read, err := dir.Read(tt.saved)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		task.Name = tt.saved
+		assertTask(t, read, task)
+	}
+}
+
+func TestSaveErrors(t *testing.T) {
+	dir := Dir(t.TempDir())
+
+	for _, name := range []string{"", "../outside", "/tmp/abs"} {
+		if err := dir.Save(New(name)); err == nil {
+			t.Errorf("%q: no error", name)
+		}
+	}
+
+	if os.Geteuid() != 0 {
+		sub := filepath.Join(string(dir), "readonly")
+		if err := os.Mkdir(sub, 0o500); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = os.Chmod(sub, 0o755) })
+		if err := dir.Save(New("readonly/task")); err == nil {
+			t.Error("saved in a read-only directory")
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := writeTasks(t, map[string]string{
+		"b_task.yml":              "name: b",
+		"a_task.yml":              "name: a",
+		"notes.txt":               "not a task",
+		"code/json/fix.yml":       "name: fix",
+		"code/json/explain.yml":   "name: explain",
+		"code/refactor.yml":       "name: refactor",
+		"special-chars_123/x.yml": "name: x",
+	})
+
+	nodes, err := dir.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := func(nodes []*Node) []string {
+		var l []string
+		for _, n := range nodes {
+			l = append(l, n.Label)
+		}
+		return l
+	}
+	if got := labels(nodes); !slices.Equal(got, []string{"a_task", "b_task", "code", "special-chars_123"}) {
+		t.Fatalf("labels = %v", got)
+	}
+	if nodes[0].Path != "a_task.yml" || nodes[0].Children != nil {
+		t.Errorf("node = %+v", nodes[0])
+	}
+
+	code := nodes[2]
+	if got := labels(code.Children); !slices.Equal(got, []string{"json", "refactor"}) {
+		t.Fatalf("code labels = %v", got)
+	}
+	json := code.Children[0]
+	if got := labels(json.Children); !slices.Equal(got, []string{"explain", "fix"}) {
+		t.Errorf("json labels = %v", got)
+	}
+	if json.Path != "code/json" || json.Children[1].Path != "code/json/fix.yml" {
+		t.Errorf("paths = %s, %s", json.Path, json.Children[1].Path)
+	}
+
+	keys := map[string]bool{}
+	var walk func(nodes []*Node)
+	walk = func(nodes []*Node) {
+		for _, n := range nodes {
+			if keys[n.Key] {
+				t.Errorf("duplicate key %s", n.Key)
+			}
+			keys[n.Key] = true
+			walk(n.Children)
+		}
+	}
+	walk(nodes)
+}
+
+func TestListEmpty(t *testing.T) {
+	for _, dir := range []Dir{Dir(t.TempDir()), Dir(filepath.Join(t.TempDir(), "missing"))} {
+		nodes, err := dir.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodes == nil || len(nodes) != 0 {
+			t.Errorf("nodes = %v, want an empty list", nodes)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	task := Task{Template: "{instruction}: {prompt} ({prompt})"}
+	if got := task.Render("text", "fix"); got != "fix: text (text)" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func assertTask(t *testing.T, got, want Task) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("task = %+v\nwant %+v", got, want)
+	}
+}
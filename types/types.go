@@ -14,18 +14,19 @@ var DefaultModelConf = ModelParams{
 // InferParams holds parameters for inference.
 type InferParams struct {
 	Stream            bool     `json:"stream,omitempty"            yaml:"stream,omitempty"`
-	MaxTokens         int      `json:"max_tokens,omitempty"        yaml:"max_tokens,omitempty"`
-	TopK              int      `json:"top_k,omitempty"             yaml:"top_k,omitempty"`
-	TopP              float32  `json:"top_p,omitempty"             yaml:"top_p,omitempty"`
-	MinP              float32  `json:"min_p,omitempty"             yaml:"min_p,omitempty"`
-	Temperature       float32  `json:"temperature,omitempty"       yaml:"temperature,omitempty"`
-	FrequencyPenalty  float32  `json:"frequency_penalty,omitempty" yaml:"frequency_penalty,omitempty"`
-	PresencePenalty   float32  `json:"presence_penalty,omitempty"  yaml:"presence_penalty,omitempty"`
-	RepeatPenalty     float32  `json:"repeat_penalty,omitempty"    yaml:"repeat_penalty,omitempty"`
-	TailFreeSamplingZ float32  `json:"tfs,omitempty"               yaml:"tfs,omitempty"`
+	MaxTokens         int      `json:"max_tokens,omitempty"        yaml:"max_tokens"`
+	TopK              int      `json:"top_k,omitempty"             yaml:"top_k"`
+	TopP              float32  `json:"top_p,omitempty"             yaml:"top_p"`
+	MinP              float32  `json:"min_p,omitempty"             yaml:"min_p"`
+	Temperature       float32  `json:"temperature,omitempty"       yaml:"temperature"`
+	FrequencyPenalty  float32  `json:"frequency_penalty,omitempty" yaml:"frequency_penalty"`
+	PresencePenalty   float32  `json:"presence_penalty,omitempty"  yaml:"presence_penalty"`
+	RepeatPenalty     float32  `json:"repeat_penalty,omitempty"    yaml:"repeat_penalty"`
+	TailFreeSamplingZ float32  `json:"tfs,omitempty"               yaml:"tfs"`
 	StopPrompts       []string `json:"stop,omitempty"              yaml:"stop,omitempty"`
-	Images            []byte   `json:"images,omitempty"            yaml:"images,omitempty"`
+	Images            []Image  `json:"images,omitempty"            yaml:"images,omitempty"` // for a model with a multimodal projector
 	Audios            []byte   `json:"audios,omitempty"            yaml:"audios,omitempty"`
+	StripReasoning    bool     `json:"strip_reasoning,omitempty"   yaml:"strip_reasoning,omitempty"` // drop the <think> segments
 }
 
 var DefaultInferParams = InferParams{
@@ -43,11 +44,31 @@ var DefaultInferParams = InferParams{
 	Images:            nil,
 }
 
+// Image is an image input of a multimodal inference.
+type Image struct {
+	MimeType string `json:"mime_type" yaml:"mime_type"`
+	Data     []byte `json:"data"      yaml:"data"` // base64 in JSON
+}
+
 // InferQuery represents a task to be executed.
 type InferQuery struct {
-	Prompt      string      `json:"prompt"  yaml:"prompt"`
-	ModelParams ModelParams `json:"model"   yaml:"model"`
-	InferParams InferParams `json:"params"  yaml:"params"`
+	Prompt      string      `json:"prompt"             yaml:"prompt"`
+	Infill      *Infill     `json:"infill,omitempty"   yaml:"infill,omitempty"` // fill-in-the-middle, nil for a completion
+	ModelParams ModelParams `json:"model"              yaml:"model"`
+	InferParams InferParams `json:"params"             yaml:"params"`
+	Priority    string      `json:"priority,omitempty" yaml:"priority,omitempty"` // interactive (default) or batch
+}
+
+// Infill is the fill-in-the-middle part of a query: the prompt is the text before the completion.
+type Infill struct {
+	Suffix string       `json:"suffix"          yaml:"suffix"`          // text after the completion
+	Extra  []InfillFile `json:"extra,omitempty" yaml:"extra,omitempty"` // context from other files
+}
+
+// InfillFile is a chunk of context for a fill-in-the-middle query.
+type InfillFile struct {
+	Filename string `json:"filename" yaml:"filename"`
+	Text     string `json:"text"     yaml:"text"`
 }
 
 // StreamedMessage represents a streamed message.
@@ -62,7 +83,8 @@ type StreamedMessage struct {
 type MsgType string
 
 const (
-	TokenMsgType  MsgType = "token"
-	SystemMsgType MsgType = "system"
-	ErrorMsgType  MsgType = "error"
+	TokenMsgType     MsgType = "token"
+	ReasoningMsgType MsgType = "reasoning" // token of a <think> segment
+	SystemMsgType    MsgType = "system"
+	ErrorMsgType     MsgType = "error"
 )